@@ -3,10 +3,17 @@ package aws
 import (
 	"context"
 	"fmt"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/sensu/sensu-plugin-sdk/sensu"
 )
 
@@ -20,6 +27,124 @@ type AWSPluginConfig struct {
 	AWSSecretAccessKey  string
 	AWSConfig           *aws.Config
 	AWSCredentials      *aws.Credentials
+	//Assume role elements
+	AWSRoleArn              string
+	AWSExternalID           string
+	AWSRoleSessionName      string
+	AWSRoleDuration         int
+	AWSWebIdentityTokenFile string
+	//Account of the credentials in use, set by ResolveAccountID
+	AWSAccountID string
+	//Endpoint URL replacing the default CloudWatch and STS endpoints, Ex: LocalStack or a VPC interface endpoint
+	AWSEndpointURL string
+}
+
+// CheckEndpointURL validates an endpoint URL, an empty URL selects the default AWS endpoints
+func CheckEndpointURL(endpointURL string) error {
+	if len(endpointURL) == 0 {
+		return nil
+	}
+	parsed, err := url.Parse(endpointURL)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint URL %q: %v", endpointURL, err)
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || len(parsed.Host) == 0 {
+		return fmt.Errorf("invalid endpoint URL %q: must be an http or https URL", endpointURL)
+	}
+	return nil
+}
+
+// CloudWatchClient creates a CloudWatch client for the config, sending requests to the endpoint URL if set.
+// Requests are still signed for the region of the config.
+func (plugin *AWSPluginConfig) CloudWatchClient(cfg aws.Config, optFns ...func(*cloudwatch.Options)) *cloudwatch.Client {
+	return cloudwatch.NewFromConfig(cfg, append([]func(*cloudwatch.Options){func(o *cloudwatch.Options) {
+		if len(plugin.AWSEndpointURL) > 0 {
+			o.BaseEndpoint = aws.String(plugin.AWSEndpointURL)
+		}
+	}}, optFns...)...)
+}
+
+// AccountIDFromRoleArn returns the account id of an IAM role ARN, Ex: arn:aws:iam::123456789012:role/monitoring
+func AccountIDFromRoleArn(roleArn string) (string, error) {
+	parsed, err := arn.Parse(roleArn)
+	if err != nil {
+		return "", fmt.Errorf("invalid role ARN %q: %v", roleArn, err)
+	}
+	if parsed.Service != "iam" || !strings.HasPrefix(parsed.Resource, "role/") || len(parsed.AccountID) == 0 {
+		return "", fmt.Errorf("invalid role ARN %q: not an IAM role", roleArn)
+	}
+	return parsed.AccountID, nil
+}
+
+// checkRoleArgs validates the assume role arguments
+func (plugin *AWSPluginConfig) checkRoleArgs() error {
+	if len(plugin.AWSRoleArn) == 0 {
+		if len(plugin.AWSExternalID) > 0 || len(plugin.AWSWebIdentityTokenFile) > 0 {
+			return fmt.Errorf("--external-id and --web-identity-token-file require --role-arn")
+		}
+		return nil
+	}
+	if _, err := AccountIDFromRoleArn(plugin.AWSRoleArn); err != nil {
+		return err
+	}
+	if plugin.AWSRoleDuration < 0 {
+		return fmt.Errorf("--duration can not be negative")
+	}
+	if len(plugin.AWSWebIdentityTokenFile) > 0 {
+		if len(plugin.AWSExternalID) > 0 {
+			return fmt.Errorf("--external-id can not be combined with --web-identity-token-file")
+		}
+		if !fileExists(plugin.AWSWebIdentityTokenFile) {
+			return fmt.Errorf("Web identity token file missing: %s", plugin.AWSWebIdentityTokenFile)
+		}
+	}
+	return nil
+}
+
+// stsClient creates an STS client for the config, sending requests to the endpoint URL if set
+func (plugin *AWSPluginConfig) stsClient(cfg aws.Config) *sts.Client {
+	return sts.NewFromConfig(cfg, func(o *sts.Options) {
+		if len(plugin.AWSEndpointURL) > 0 {
+			o.BaseEndpoint = aws.String(plugin.AWSEndpointURL)
+		}
+	})
+}
+
+// ResolveAccountID sets the account id to the account of the final credentials, the assumed role if any, as
+// returned by STS GetCallerIdentity, which every identity is allowed to call
+func (plugin *AWSPluginConfig) ResolveAccountID(ctx context.Context) error {
+	output, err := plugin.stsClient(*plugin.AWSConfig).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return err
+	}
+	plugin.AWSAccountID = aws.ToString(output.Account)
+	return nil
+}
+
+// roleProvider returns a credentials provider assuming the configured role with the base config credentials,
+// or with the web identity token if a token file is set
+func (plugin *AWSPluginConfig) roleProvider(cfg aws.Config) aws.CredentialsProvider {
+	client := plugin.stsClient(cfg)
+	sessionName := plugin.AWSRoleSessionName
+	if len(sessionName) == 0 {
+		sessionName = "sensu-cloudwatch-check"
+	}
+	duration := time.Duration(plugin.AWSRoleDuration) * time.Second
+	if len(plugin.AWSWebIdentityTokenFile) > 0 {
+		return stscreds.NewWebIdentityRoleProvider(client, plugin.AWSRoleArn,
+			stscreds.IdentityTokenFile(plugin.AWSWebIdentityTokenFile),
+			func(o *stscreds.WebIdentityRoleOptions) {
+				o.RoleSessionName = sessionName
+				o.Duration = duration
+			})
+	}
+	return stscreds.NewAssumeRoleProvider(client, plugin.AWSRoleArn, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = sessionName
+		o.Duration = duration
+		if len(plugin.AWSExternalID) > 0 {
+			o.ExternalID = aws.String(plugin.AWSExternalID)
+		}
+	})
 }
 
 func fileExists(filename string) bool {
@@ -43,6 +168,12 @@ func (plugin *AWSPluginConfig) CheckAWSCreds() (int, error) {
 			return sensu.CheckStateCritical, fmt.Errorf("Config file missing: %s", f)
 		}
 	}
+	if err := plugin.checkRoleArgs(); err != nil {
+		return sensu.CheckStateCritical, err
+	}
+	if err := CheckEndpointURL(plugin.AWSEndpointURL); err != nil {
+		return sensu.CheckStateCritical, err
+	}
 	// Note: slight workaround here as sdk wont let me pass an array of arguments
 	// due to a type mismatch
 	// workaround for now is to pass the same function pointer multiple times in some cases
@@ -64,6 +195,9 @@ func (plugin *AWSPluginConfig) CheckAWSCreds() (int, error) {
 	if err != nil {
 		return sensu.CheckStateCritical, err
 	}
+	if len(plugin.AWSRoleArn) > 0 {
+		cfg.Credentials = aws.NewCredentialsCache(plugin.roleProvider(cfg))
+	}
 	plugin.AWSConfig = &cfg
 	creds, err := plugin.AWSConfig.Credentials.Retrieve(context.Background())
 	if err != nil {
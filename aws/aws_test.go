@@ -0,0 +1,127 @@
+package aws
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/smithy-go/encoding/cbor"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountIDFromRoleArn(t *testing.T) {
+	assert := assert.New(t)
+	account, err := AccountIDFromRoleArn("arn:aws:iam::123456789012:role/monitoring")
+	assert.NoError(err)
+	assert.Equal("123456789012", account)
+	account, err = AccountIDFromRoleArn("arn:aws-us-gov:iam::210987654321:role/path/to/monitoring")
+	assert.NoError(err)
+	assert.Equal("210987654321", account)
+	_, err = AccountIDFromRoleArn("monitoring")
+	assert.Error(err)
+	_, err = AccountIDFromRoleArn("arn:aws:iam::123456789012:user/monitoring")
+	assert.Error(err)
+	_, err = AccountIDFromRoleArn("arn:aws:s3:::bucket")
+	assert.Error(err)
+}
+
+func TestCheckRoleArgs(t *testing.T) {
+	assert := assert.New(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.NoError(os.WriteFile(tokenFile, []byte("token"), 0600))
+	roleArn := "arn:aws:iam::123456789012:role/monitoring"
+	cases := []struct {
+		config    AWSPluginConfig
+		expectErr bool
+	}{
+		{config: AWSPluginConfig{}},
+		{config: AWSPluginConfig{AWSRoleArn: roleArn, AWSExternalID: "secret"}},
+		{config: AWSPluginConfig{AWSRoleArn: roleArn, AWSWebIdentityTokenFile: tokenFile}},
+		{config: AWSPluginConfig{AWSExternalID: "secret"}, expectErr: true},
+		{config: AWSPluginConfig{AWSWebIdentityTokenFile: tokenFile}, expectErr: true},
+		{config: AWSPluginConfig{AWSRoleArn: "monitoring"}, expectErr: true},
+		{config: AWSPluginConfig{AWSRoleArn: roleArn, AWSRoleDuration: -1}, expectErr: true},
+		{config: AWSPluginConfig{AWSRoleArn: roleArn, AWSWebIdentityTokenFile: tokenFile + ".missing"}, expectErr: true},
+		{config: AWSPluginConfig{AWSRoleArn: roleArn, AWSWebIdentityTokenFile: tokenFile, AWSExternalID: "secret"}, expectErr: true},
+	}
+	for _, tt := range cases {
+		err := tt.config.checkRoleArgs()
+		if tt.expectErr {
+			assert.Error(err)
+			continue
+		}
+		assert.NoError(err)
+	}
+}
+
+func TestCheckEndpointURL(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(CheckEndpointURL(""))
+	assert.NoError(CheckEndpointURL("http://localhost:4566"))
+	assert.NoError(CheckEndpointURL("https://vpce-0123-abcd.monitoring.us-east-1.vpce.amazonaws.com"))
+	assert.Error(CheckEndpointURL("localhost:4566"))
+	assert.Error(CheckEndpointURL("ftp://localhost"))
+	assert.Error(CheckEndpointURL("http://"))
+}
+
+func TestEndpointURL(t *testing.T) {
+	assert := assert.New(t)
+	signed := []string{}
+	// a single endpoint serving CloudWatch and STS, like LocalStack
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signed = append(signed, r.Header.Get("Authorization"))
+		// CloudWatch uses the Smithy RPC v2 CBOR protocol, STS the query protocol
+		if strings.HasSuffix(r.URL.Path, "/operation/ListMetrics") {
+			w.Header().Set("Smithy-Protocol", "rpc-v2-cbor")
+			_, _ = w.Write(cbor.Encode(cbor.Map{"Metrics": cbor.List{
+				cbor.Map{"Namespace": cbor.String("AWS/EC2"), "MetricName": cbor.String("CPUUtilization")},
+			}}))
+			return
+		}
+		_ = r.ParseForm()
+		switch r.Form.Get("Action") {
+		case "GetCallerIdentity":
+			_, _ = w.Write([]byte(`<GetCallerIdentityResponse><GetCallerIdentityResult><Arn>arn:aws:sts::123456789012:assumed-role/monitoring/sensu</Arn><UserId>AROAEXAMPLE:sensu</UserId><Account>123456789012</Account></GetCallerIdentityResult></GetCallerIdentityResponse>`))
+		case "AssumeRole":
+			_, _ = w.Write([]byte(`<AssumeRoleResponse><AssumeRoleResult><Credentials><AccessKeyId>ASIAROLE</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>token</SessionToken><Expiration>2100-01-01T00:00:00Z</Expiration></Credentials></AssumeRoleResult></AssumeRoleResponse>`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	plugin := AWSPluginConfig{AWSEndpointURL: server.URL, AWSRoleArn: "arn:aws:iam::123456789012:role/monitoring"}
+	cfg := aws.Config{Region: "eu-west-1", Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", "")}
+	cfg.Credentials = aws.NewCredentialsCache(plugin.roleProvider(cfg))
+	creds, err := cfg.Credentials.Retrieve(context.TODO())
+	assert.NoError(err)
+	assert.Equal("ASIAROLE", creds.AccessKeyID)
+	if assert.Equal(1, len(signed)) {
+		assert.True(strings.Contains(signed[0], "/eu-west-1/sts/"), signed[0])
+	}
+
+	// the account id is the one of the final credentials, with or without a role
+	plugin.AWSConfig = &cfg
+	assert.NoError(plugin.ResolveAccountID(context.TODO()))
+	assert.Equal("123456789012", plugin.AWSAccountID)
+	if assert.Equal(2, len(signed)) {
+		assert.True(strings.Contains(signed[1], "Credential=ASIAROLE/"), signed[1])
+	}
+
+	for _, region := range []string{"eu-west-1", "ap-southeast-2"} {
+		cfg.Region = region
+		output, err := plugin.CloudWatchClient(cfg).ListMetrics(context.TODO(), &cloudwatch.ListMetricsInput{})
+		if assert.NoError(err) {
+			assert.Equal(1, len(output.Metrics))
+		}
+		assert.True(strings.Contains(signed[len(signed)-1], "Credential=ASIAROLE/"), signed[len(signed)-1])
+		assert.True(strings.Contains(signed[len(signed)-1], "/"+region+"/monitoring/"), signed[len(signed)-1])
+	}
+}
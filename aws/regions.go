@@ -0,0 +1,40 @@
+package aws
+
+import (
+	"context"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// EnabledRegions lists the regions enabled for the account using the EC2 DescribeRegions API
+// of the config region, or us-east-1 if no region is set
+func EnabledRegions(ctx context.Context, cfg aws.Config) ([]string, error) {
+	if len(cfg.Region) == 0 {
+		cfg.Region = "us-east-1"
+	}
+	return describeRegions(ctx, ec2.NewFromConfig(cfg))
+}
+
+// describeRegionsAPI is the part of the EC2 client listing regions, replaced in tests
+type describeRegionsAPI interface {
+	DescribeRegions(ctx context.Context, params *ec2.DescribeRegionsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error)
+}
+
+// describeRegions lists the regions that do not require opting in along with the opted in ones, sorted by name
+func describeRegions(ctx context.Context, client describeRegionsAPI) ([]string, error) {
+	output, err := client.DescribeRegions(ctx, &ec2.DescribeRegionsInput{})
+	if err != nil {
+		return nil, err
+	}
+	regions := []string{}
+	for _, r := range output.Regions {
+		if aws.ToString(r.OptInStatus) == "not-opted-in" {
+			continue
+		}
+		regions = append(regions, aws.ToString(r.RegionName))
+	}
+	sort.Strings(regions)
+	return regions, nil
+}
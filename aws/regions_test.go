@@ -0,0 +1,46 @@
+package aws
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDescribeRegions(t *testing.T) {
+	assert := assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_ = r.ParseForm()
+		if r.Form.Get("Action") != "DescribeRegions" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`<DescribeRegionsResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <regionInfo>
+    <item><regionName>us-east-1</regionName><optInStatus>opt-in-not-required</optInStatus></item>
+    <item><regionName>eu-west-1</regionName><optInStatus>opt-in-not-required</optInStatus></item>
+    <item><regionName>af-south-1</regionName><optInStatus>not-opted-in</optInStatus></item>
+    <item><regionName>ap-east-1</regionName><optInStatus>opted-in</optInStatus></item>
+  </regionInfo>
+</DescribeRegionsResponse>`))
+	}))
+	defer server.Close()
+
+	cfg := aws.Config{Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""), BaseEndpoint: aws.String(server.URL)}
+	regions, err := EnabledRegions(context.TODO(), cfg)
+	assert.NoError(err)
+	assert.Equal([]string{"ap-east-1", "eu-west-1", "us-east-1"}, regions)
+
+	cfg.Credentials = credentials.NewStaticCredentialsProvider("OTHER", "SECRET", "")
+	_, err = EnabledRegions(context.TODO(), cfg)
+	assert.Error(err)
+}
@@ -1,17 +1,35 @@
 package common
 
 import (
+	"bytes"
 	"fmt"
+	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"text/template"
+	"unicode"
 
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	v2 "github.com/sensu/sensu-go/api/core/v2"
 )
 
 var (
 	// Setup regexp for use with toSnakeCase
 	matchFirstCap = regexp.MustCompile("(.)([A-Z][a-z]+)")
 	matchAllCap   = regexp.MustCompile("([a-z0-9])([A-Z])")
+	// Characters not allowed in metric labels
+	matchUnsafe = regexp.MustCompile("_*[^a-zA-Z0-9_]+_*")
+
+	// Setup regexp for CloudWatch statistics, see:
+	//  https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/Statistics-definitions.html
+	standardStats  = []string{"SampleCount", "Average", "Sum", "Minimum", "Maximum", "IQM"}
+	matchShortStat = regexp.MustCompile(`^(p|tm|wm|tc|ts)(\d+(?:\.\d+)?)$`)
+	matchRangeStat = regexp.MustCompile(`^(TM|WM|TC|TS|PR)\(([^:()]*):([^:()]*)\)$`)
+	matchStatBound = regexp.MustCompile(`^(\d+(?:\.\d+)?)(%?)$`)
+
+	// Template placeholders, Ex: {region} or {LoadBalancer}
+	matchPlaceholder = regexp.MustCompile(`\{([^{}]*)\}`)
 )
 
 func ToSnakeCase(str string) string {
@@ -20,6 +38,82 @@ func ToSnakeCase(str string) string {
 	return strings.ToLower(snake)
 }
 
+// SanitizeLabel replaces every run of characters not allowed in a metric label (such as dots and colons) with an
+// underscore, dropping those at either end. Underscores of the label itself are kept.
+func SanitizeLabel(str string) string {
+	str = strings.TrimFunc(str, func(r rune) bool {
+		return !(r == '_' || r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)))
+	})
+	return matchUnsafe.ReplaceAllString(str, "_")
+}
+
+// ValidStatistic reports whether stat is a CloudWatch statistic GetMetricData accepts, including
+// extended statistics like p99.9, tm99, TM(10%:90%) or PR(:300)
+func ValidStatistic(stat string) bool {
+	for _, s := range standardStats {
+		if stat == s {
+			return true
+		}
+	}
+	if m := matchShortStat.FindStringSubmatch(stat); m != nil {
+		value, err := strconv.ParseFloat(m[2], 64)
+		return err == nil && value >= 0 && value <= 100
+	}
+	if m := matchRangeStat.FindStringSubmatch(stat); m != nil {
+		lower, upper := strings.TrimSpace(m[2]), strings.TrimSpace(m[3])
+		if len(lower) == 0 && len(upper) == 0 {
+			return false
+		}
+		percent := ""
+		for i, bound := range []string{lower, upper} {
+			if len(bound) == 0 {
+				continue
+			}
+			b := matchStatBound.FindStringSubmatch(bound)
+			if b == nil {
+				return false
+			}
+			// both bounds must be expressed the same way, and percentile rank only takes absolute values
+			if i == 1 && len(lower) > 0 && b[2] != percent {
+				return false
+			}
+			percent = b[2]
+			if value, _ := strconv.ParseFloat(b[1], 64); percent == "%" && value > 100 {
+				return false
+			}
+		}
+		return !(m[1] == "PR" && percent == "%")
+	}
+	return false
+}
+
+// ValidUnit reports whether unit is a CloudWatch standard unit, Ex: "Seconds", "Bytes/Second" or "Percent"
+func ValidUnit(unit string) bool {
+	for _, u := range types.StandardUnit("").Values() {
+		if unit == string(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// StatisticLabel builds a metric label suffix for a statistic, Ex: "SampleCount" -> "sample_count",
+// "p99.9" -> "p99_9", "TM(10%:90%)" -> "tm_10_90" and "TM(:95%)" -> "tm_min_95"
+func StatisticLabel(stat string) string {
+	if m := matchRangeStat.FindStringSubmatch(stat); m != nil {
+		lower := strings.TrimSuffix(strings.TrimSpace(m[2]), "%")
+		upper := strings.TrimSuffix(strings.TrimSpace(m[3]), "%")
+		if len(lower) == 0 {
+			lower = "min"
+		}
+		if len(upper) == 0 {
+			upper = "max"
+		}
+		return SanitizeLabel(ToSnakeCase(strings.ToLower(m[1]) + "_" + lower + "_" + upper))
+	}
+	return SanitizeLabel(ToSnakeCase(stat))
+}
+
 func BuildLabelBase(m types.Metric) string {
 	s := strings.Split("Unknown/Namespace", "/")
 	if m.Namespace != nil {
@@ -60,6 +154,72 @@ func BuildDimensionFilters(input []string) ([]types.DimensionFilter, error) {
 	return output, nil
 }
 
+// ExpandDimensionFilterTemplates resolves the Go templates in dimension filters against the Sensu event,
+// Ex: InstanceId={{ .Entity.Labels.aws_instance_id }}. Filters without a template are returned as is, a missing
+// event, a missing label or annotation, or a template resolving to an empty name or value is an error.
+func ExpandDimensionFilterTemplates(filters []string, event *v2.Event) ([]string, error) {
+	output := make([]string, 0, len(filters))
+	for _, filter := range filters {
+		if !strings.Contains(filter, "{{") {
+			output = append(output, filter)
+			continue
+		}
+		if event == nil {
+			return nil, fmt.Errorf("dimension filter %q is a template and requires the Sensu event, set --event-stdin and stdin: true in the check definition", filter)
+		}
+		tmpl, err := template.New("dimension-filter").Option("missingkey=error").Parse(filter)
+		if err != nil {
+			return nil, fmt.Errorf("dimension filter %q: %v", filter, err)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, event); err != nil {
+			return nil, fmt.Errorf("dimension filter %q: %v", filter, err)
+		}
+		expanded := strings.TrimSpace(buf.String())
+		name, value, found := strings.Cut(expanded, "=")
+		if len(strings.TrimSpace(name)) == 0 || (found && len(strings.TrimSpace(value)) == 0) {
+			return nil, fmt.Errorf("dimension filter %q resolves to %q without a dimension name or value", filter, expanded)
+		}
+		output = append(output, expanded)
+	}
+	return output, nil
+}
+
+// CheckPlaceholders checks that every placeholder of a template names a value and braces are balanced
+func CheckPlaceholders(template string) error {
+	for _, m := range matchPlaceholder.FindAllStringSubmatch(template, -1) {
+		if len(strings.TrimSpace(m[1])) == 0 {
+			return fmt.Errorf("template %q has an empty placeholder", template)
+		}
+	}
+	if strings.ContainsAny(matchPlaceholder.ReplaceAllString(template, ""), "{}") {
+		return fmt.Errorf("template %q has unbalanced braces", template)
+	}
+	return nil
+}
+
+// ReplacePlaceholders replaces every {name} placeholder of a template with its value
+func ReplacePlaceholders(template string, value func(name string) string) string {
+	return matchPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		return value(strings.TrimSpace(placeholder[1 : len(placeholder)-1]))
+	})
+}
+
+// CheckHTTPURL checks that a URL is an http or https URL with a host, an empty URL is not checked
+func CheckHTTPURL(str string) error {
+	if len(str) == 0 {
+		return nil
+	}
+	parsed, err := url.Parse(str)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q: %v", str, err)
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || len(parsed.Host) == 0 {
+		return fmt.Errorf("invalid URL %q: must be an http or https URL", str)
+	}
+	return nil
+}
+
 func RemoveDuplicateStrings(elements []string) []string {
 	// Use map to record duplicates as we find them.
 	encountered := map[string]bool{}
@@ -78,3 +238,56 @@ func RemoveDuplicateStrings(elements []string) []string {
 	// Return the new slice.
 	return result
 }
+
+// ExpressionReferences returns the identifiers used in a CloudWatch metric math expression,
+// skipping quoted strings such as SEARCH arguments
+func ExpressionReferences(expression string) []string {
+	refs := []string{}
+	ReplaceExpressionReferences(expression, func(id string) string {
+		refs = append(refs, id)
+		return id
+	})
+	return refs
+}
+
+// ReplaceExpressionReferences rewrites every identifier outside quoted strings in a metric math expression
+func ReplaceExpressionReferences(expression string, replace func(id string) string) string {
+	var output strings.Builder
+	var quote rune
+	number := false
+	token := []rune{}
+	flush := func() {
+		if len(token) > 0 {
+			output.WriteString(replace(string(token)))
+			token = token[:0]
+		}
+	}
+	for _, r := range expression {
+		switch {
+		case quote != 0:
+			output.WriteRune(r)
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			flush()
+			number = false
+			quote = r
+			output.WriteRune(r)
+		case number && (r == '.' || unicode.IsLetter(r) || unicode.IsDigit(r)):
+			output.WriteRune(r)
+		case r == '_' || unicode.IsLetter(r) || (len(token) > 0 && unicode.IsDigit(r)):
+			token = append(token, r)
+		case unicode.IsDigit(r) || r == '.':
+			flush()
+			number = true
+			output.WriteRune(r)
+		default:
+			flush()
+			number = false
+			output.WriteRune(r)
+		}
+	}
+	flush()
+	return output.String()
+}
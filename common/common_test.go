@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	v2 "github.com/sensu/sensu-go/api/core/v2"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -89,3 +90,132 @@ func TestBuildDimensionFilters(t *testing.T) {
 	assert.NoError(err)
 	assert.Equal(2, len(output))
 }
+
+func TestExpandDimensionFilterTemplates(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	event := v2.FixtureEvent("webserver01", "cloudwatch")
+	event.Entity.Labels = map[string]string{"aws_instance_id": "i-0123456789abcdef0"}
+	event.Entity.Annotations = map[string]string{"aws/load-balancer": "app/my-lb/123"}
+
+	output, err := ExpandDimensionFilterTemplates([]string{
+		"AutoScalingGroupName",
+		"InstanceId={{ .Entity.Labels.aws_instance_id }}",
+		`LoadBalancer={{ index .Entity.Annotations "aws/load-balancer" }}`,
+		"Host={{ .Entity.Name }}",
+	}, event)
+	assert.NoError(err)
+	assert.Equal([]string{"AutoScalingGroupName", "InstanceId=i-0123456789abcdef0", "LoadBalancer=app/my-lb/123", "Host=webserver01"}, output)
+
+	// filters without a template do not need the event
+	output, err = ExpandDimensionFilterTemplates([]string{"InstanceId=i-1"}, nil)
+	assert.NoError(err)
+	assert.Equal([]string{"InstanceId=i-1"}, output)
+
+	invalid := []string{
+		"InstanceId={{ .Entity.Labels.missing }}",
+		"InstanceId={{ .Entity.Labels.aws_instance_id",
+		"InstanceId={{ .Entity.Annotations.empty }}",
+		"{{ .Entity.Annotations.empty }}=value",
+	}
+	event.Entity.Annotations["empty"] = ""
+	for _, filter := range invalid {
+		_, err = ExpandDimensionFilterTemplates([]string{filter}, event)
+		assert.Error(err, filter)
+	}
+	_, err = ExpandDimensionFilterTemplates([]string{"InstanceId={{ .Entity.Labels.aws_instance_id }}"}, nil)
+	assert.Error(err)
+}
+
+func TestExpressionReferences(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	refs := ExpressionReferences(`100 * errors / (requests + 1e-9)`)
+	assert.Equal([]string{"errors", "requests"}, refs)
+	refs = ExpressionReferences(`SUM(SEARCH('{AWS/EC2,InstanceId} errors', 'Average', 300))`)
+	assert.Equal([]string{"SUM", "SEARCH"}, refs)
+	output := ReplaceExpressionReferences(`m1/m2*100`, func(id string) string {
+		return id + "_g0"
+	})
+	assert.Equal("m1_g0/m2_g0*100", output)
+}
+
+func TestValidStatistic(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	valid := []string{"Average", "Sum", "SampleCount", "Maximum", "Minimum", "IQM",
+		"p50", "p90", "p99.9", "p100", "tm99", "wm95", "tc90", "ts99.5",
+		"TM(10%:90%)", "TM(:95)", "TM(:95%)", "WM(5%:)", "TC(150:1000)", "TS(0.5%:99.5%)", "PR(:300)", "PR(100:2000)"}
+	for _, stat := range valid {
+		assert.True(ValidStatistic(stat), stat)
+	}
+	invalid := []string{"", "average", "Avg", "p", "p101", "P99", "tm", "TM(:)", "TM(10%:90)", "TM(10:200%)",
+		"PR(10%:90%)", "TM(a:b)", "tm(10%:90%)", "p99.9.9"}
+	for _, stat := range invalid {
+		assert.False(ValidStatistic(stat), stat)
+	}
+}
+
+func TestValidUnit(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	for _, unit := range []string{"Seconds", "Milliseconds", "Bytes", "Bytes/Second", "Percent", "Count", "None"} {
+		assert.True(ValidUnit(unit), unit)
+	}
+	for _, unit := range []string{"", "seconds", "ms", "%"} {
+		assert.False(ValidUnit(unit), unit)
+	}
+}
+
+func TestStatisticLabel(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	cases := map[string]string{
+		"SampleCount":  "sample_count",
+		"Average":      "average",
+		"p99":          "p99",
+		"p99.9":        "p99_9",
+		"tm99":         "tm99",
+		"TM(10%:90%)":  "tm_10_90",
+		"TM(:95)":      "tm_min_95",
+		"WM(5%:)":      "wm_5_max",
+		"PR(100:2000)": "pr_100_2000",
+		"TS(0.5%:99%)": "ts_0_5_99",
+	}
+	for stat, expected := range cases {
+		assert.Equal(expected, StatisticLabel(stat), stat)
+	}
+}
+
+func TestPlaceholders(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	assert.NoError(CheckPlaceholders("aws-{region}-{ LoadBalancer }"))
+	assert.NoError(CheckPlaceholders("no placeholders"))
+	assert.Error(CheckPlaceholders("aws-{}"))
+	assert.Error(CheckPlaceholders("aws-{region"))
+	assert.Error(CheckPlaceholders("aws-region}"))
+	values := map[string]string{"region": "us-east-1", "LoadBalancer": "app/my-lb/123"}
+	assert.Equal("aws-us-east-1-app/my-lb/123-", ReplacePlaceholders("aws-{region}-{ LoadBalancer }-{missing}", func(name string) string { return values[name] }))
+}
+
+func TestCheckHTTPURL(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	for _, u := range []string{"", "http://localhost:4318/v1/metrics", "https://otlp.example.com"} {
+		assert.NoError(CheckHTTPURL(u), u)
+	}
+	for _, u := range []string{"localhost:4318", "ftp://example.com", "http://", "://bad"} {
+		assert.Error(CheckHTTPURL(u), u)
+	}
+}
+
+func TestSanitizeLabel(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	assert.Equal("aws_alb_target_response_time_p99_9", SanitizeLabel("aws.alb.target_response_time.p99.9"))
+	assert.Equal("aws_test_tm_10_90", SanitizeLabel("aws.test.tm(10%:90%)"))
+	// underscores at either end are kept, so existing measurement names are not renamed
+	assert.Equal("_private_", SanitizeLabel("_private_"))
+	assert.Equal("already_safe", SanitizeLabel("already_safe"))
+}
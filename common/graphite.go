@@ -0,0 +1,64 @@
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// Characters not allowed in a Graphite path node
+	matchGraphiteUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_\-]+`)
+)
+
+// GraphiteNode sanitizes a value for use as a single Graphite path node, replacing every run of characters
+// like dots and slashes with an underscore, Ex: app/my-lb/123 becomes app_my-lb_123
+func GraphiteNode(str string) string {
+	return strings.Trim(matchGraphiteUnsafe.ReplaceAllString(str, "_"), "_")
+}
+
+// CheckGraphiteTemplate checks a dotted Graphite path template, Ex: aws.{region}.alb.{LoadBalancer}.{metric}.{stat}
+func CheckGraphiteTemplate(template string) error {
+	if len(strings.TrimSpace(template)) == 0 {
+		return fmt.Errorf("graphite template is empty")
+	}
+	for _, node := range strings.Split(template, ".") {
+		if len(node) == 0 {
+			return fmt.Errorf("graphite template %q has an empty path node", template)
+		}
+	}
+	if err := CheckPlaceholders(template); err != nil {
+		return fmt.Errorf("graphite %v", err)
+	}
+	return nil
+}
+
+// ExpandGraphiteTemplate builds a Graphite path from a checked template, looking up the values of each placeholder.
+// A node holding only a placeholder becomes one node per value, placeholders inside a longer node join their
+// values with underscores. Values are sanitized with GraphiteNode and nodes left empty are dropped.
+func ExpandGraphiteTemplate(template string, values func(name string) []string) string {
+	nodes := []string{}
+	for _, node := range strings.Split(template, ".") {
+		if m := matchPlaceholder.FindStringSubmatch(node); m != nil && m[0] == node {
+			for _, v := range values(strings.TrimSpace(m[1])) {
+				if v = GraphiteNode(v); len(v) > 0 {
+					nodes = append(nodes, v)
+				}
+			}
+			continue
+		}
+		node = ReplacePlaceholders(node, func(name string) string {
+			parts := []string{}
+			for _, v := range values(name) {
+				if v = GraphiteNode(v); len(v) > 0 {
+					parts = append(parts, v)
+				}
+			}
+			return strings.Join(parts, "_")
+		})
+		if node = GraphiteNode(node); len(node) > 0 {
+			nodes = append(nodes, node)
+		}
+	}
+	return strings.Join(nodes, ".")
+}
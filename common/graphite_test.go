@@ -0,0 +1,51 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGraphiteNode(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	assert.Equal("app_my-lb_123", GraphiteNode("app/my-lb/123"))
+	assert.Equal("us-east-1a", GraphiteNode("us-east-1a"))
+	assert.Equal("i-0abc_example_com", GraphiteNode(" i-0abc.example.com "))
+	assert.Equal("", GraphiteNode("//"))
+}
+
+func TestCheckGraphiteTemplate(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	assert.NoError(CheckGraphiteTemplate("aws.{region}.alb.{LoadBalancer}.{metric}.{stat}"))
+	assert.NoError(CheckGraphiteTemplate("aws.lb_{LoadBalancer}.{metric}"))
+	assert.Error(CheckGraphiteTemplate(""))
+	assert.Error(CheckGraphiteTemplate("aws..{metric}"))
+	assert.Error(CheckGraphiteTemplate("aws.{}.{metric}"))
+	assert.Error(CheckGraphiteTemplate("aws.{region.{metric}"))
+	assert.Error(CheckGraphiteTemplate("aws.region}.{metric}"))
+}
+
+func TestExpandGraphiteTemplate(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	values := map[string][]string{
+		"region":       {"us-east-1"},
+		"namespace":    {"aws", "application_elb"},
+		"metric":       {"request_count"},
+		"stat":         {"sum"},
+		"LoadBalancer": {"app/my-lb/123"},
+		"dimensions":   {"app/my-lb/123", "us-east-1a"},
+	}
+	lookup := func(name string) []string { return values[name] }
+	assert.Equal("aws.us-east-1.alb.app_my-lb_123.request_count.sum",
+		ExpandGraphiteTemplate("aws.{region}.alb.{LoadBalancer}.{metric}.{stat}", lookup))
+	assert.Equal("aws.application_elb.app_my-lb_123.us-east-1a.request_count.sum",
+		ExpandGraphiteTemplate("{namespace}.{dimensions}.{metric}.{stat}", lookup))
+	assert.Equal("aws.lb_app_my-lb_123.request_count_sum",
+		ExpandGraphiteTemplate("aws.lb_{LoadBalancer}.{metric}_{stat}", lookup))
+	// missing values drop the node
+	assert.Equal("aws.request_count",
+		ExpandGraphiteTemplate("aws.{TargetGroup}.{metric}", lookup))
+}
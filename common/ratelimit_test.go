@@ -0,0 +1,39 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	var disabled *RateLimiter
+	assert.Nil(NewRateLimiter(0))
+	assert.Nil(NewRateLimiter(-1))
+	assert.NoError(disabled.Wait(context.TODO()))
+
+	limiter := NewRateLimiter(100)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(limiter.Wait(context.TODO()))
+		}()
+	}
+	wg.Wait()
+	// the first call is immediate, the other five are spaced 10ms apart
+	assert.True(time.Since(start) >= 45*time.Millisecond)
+
+	limiter = NewRateLimiter(0.1)
+	assert.NoError(limiter.Wait(context.TODO()))
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer cancel()
+	assert.Error(limiter.Wait(ctx))
+}
@@ -0,0 +1,65 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Threshold is a single comparison against a fixed value, parsed from strings such as ">80", "<=5" or "==0".
+// A bare number is treated as ">=" so "80" breaches at 80 and above.
+type Threshold struct {
+	Operator string
+	Value    float64
+}
+
+var thresholdOperators = []string{">=", "<=", "==", "!=", ">", "<"}
+
+func ParseThreshold(input string) (*Threshold, error) {
+	str := strings.TrimSpace(input)
+	if len(str) == 0 {
+		return nil, nil
+	}
+	operator := ">="
+	for _, op := range thresholdOperators {
+		if strings.HasPrefix(str, op) {
+			operator = op
+			str = strings.TrimSpace(strings.TrimPrefix(str, op))
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid threshold %q: %v", input, err)
+	}
+	return &Threshold{Operator: operator, Value: value}, nil
+}
+
+// Breached reports whether value violates the threshold. A nil threshold is never breached.
+func (t *Threshold) Breached(value float64) bool {
+	if t == nil {
+		return false
+	}
+	switch t.Operator {
+	case ">":
+		return value > t.Value
+	case ">=":
+		return value >= t.Value
+	case "<":
+		return value < t.Value
+	case "<=":
+		return value <= t.Value
+	case "==":
+		return value == t.Value
+	case "!=":
+		return value != t.Value
+	}
+	return false
+}
+
+func (t *Threshold) String() string {
+	if t == nil {
+		return ""
+	}
+	return t.Operator + strconv.FormatFloat(t.Value, 'f', -1, 64)
+}
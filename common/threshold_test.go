@@ -0,0 +1,52 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseThreshold(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	cases := []struct {
+		input    string
+		operator string
+		value    float64
+	}{
+		{">80", ">", 80},
+		{">= 95.5", ">=", 95.5},
+		{"<5", "<", 5},
+		{"<=0", "<=", 0},
+		{"==1", "==", 1},
+		{"!=1", "!=", 1},
+		{"80", ">=", 80},
+	}
+	for _, c := range cases {
+		threshold, err := ParseThreshold(c.input)
+		assert.NoError(err)
+		assert.Equal(c.operator, threshold.Operator)
+		assert.Equal(c.value, threshold.Value)
+	}
+	threshold, err := ParseThreshold("")
+	assert.NoError(err)
+	assert.Nil(threshold)
+	_, err = ParseThreshold(">eighty")
+	assert.Error(err)
+}
+
+func TestThresholdBreached(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	threshold, err := ParseThreshold(">80")
+	assert.NoError(err)
+	assert.True(threshold.Breached(81))
+	assert.False(threshold.Breached(80))
+	threshold, err = ParseThreshold("<=5")
+	assert.NoError(err)
+	assert.True(threshold.Breached(5))
+	assert.False(threshold.Breached(6))
+	assert.Equal("<=5", threshold.String())
+	var none *Threshold
+	assert.False(none.Breached(100))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/sensu/sensu-cloudwatch-check/presets"
+)
+
+// discoveryResult summarizes the ListMetrics result pages fetched for a preset
+type discoveryResult struct {
+	Pages   int
+	Metrics int
+	// Truncated is set when more pages were available after stopping at the max pages limit
+	Truncated bool
+}
+
+// discoverMetrics follows the ListMetrics NextToken through every result page, adding each page of metrics
+// to the preset, until the last page or maxPages pages have been fetched. A zero maxPages disables the limit.
+func discoverMetrics(ctx context.Context, client ServiceAPI, preset presets.PresetInterface, maxPages int) (discoveryResult, error) {
+	result := discoveryResult{}
+	input, err := buildListMetricsInput(preset)
+	if err != nil {
+		return result, fmt.Errorf("could not create ListMetricsInput: %v", err)
+	}
+	paginator := cloudwatch.NewListMetricsPaginator(client, input, func(o *cloudwatch.ListMetricsPaginatorOptions) {
+		o.StopOnDuplicateToken = true
+	})
+	for paginator.HasMorePages() {
+		if maxPages > 0 && result.Pages >= maxPages {
+			result.Truncated = true
+			break
+		}
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return result, fmt.Errorf("could not get metrics list: %v", err)
+		}
+		result.Pages++
+		result.Metrics += len(page.Metrics)
+		if err := preset.AddMetrics(page.Metrics); err != nil {
+			return result, fmt.Errorf("preset AddMetrics error: %v", err)
+		}
+	}
+	return result, nil
+}
+
+func (r discoveryResult) Warning(maxPages int) string {
+	return fmt.Sprintf("max allowed ListMetrics result pages (%v) exceeded after %v metrics, results are truncated. Either filter via --namespace or --metric option or increase --max-pages value",
+		maxPages, r.Metrics)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/sensu/sensu-cloudwatch-check/common"
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// eventOutputFormat submits the results as the metrics of an event to the Sensu agent events API
+const eventOutputFormat = "event"
+
+// Characters not allowed in Sensu entity names
+var matchEntityUnsafe = regexp.MustCompile(`[^\w\.\-\:]+`)
+
+// newMetricsEvent builds an event holding the points of every query in its metrics. Without an entity name
+// the agent fills in its own entity, otherwise the event is for a proxy entity of that name. The check of
+// the event carries the problems found as its output. Events for the agent entity are status-neutral, status 0
+// without check handlers, as the executing check already returns the state, while proxy entity events carry
+// the state of their own thresholds.
+func newMetricsEvent(report checkReport, entityName string) (*v2.Event, error) {
+	points, err := queryPoints(report.Queries)
+	if err != nil {
+		return nil, err
+	}
+	metrics := &v2.Metrics{Points: []*v2.MetricPoint{}, Handlers: plugin.MetricHandlers}
+	for _, p := range points {
+		// JSON has no representation for NaN and infinite values
+		if math.IsNaN(p.Value) || math.IsInf(p.Value, 0) {
+			continue
+		}
+		metrics.Points = append(metrics.Points, p)
+	}
+	status := uint32(sensu.CheckStateOK)
+	if len(entityName) > 0 {
+		status = uint32(report.State)
+	}
+	now := time.Now().Unix()
+	output := append(append([]string{}, report.Problems...), report.Summary...)
+	output = append(output, fmt.Sprintf("%v points from %v series", len(metrics.Points), len(report.Queries)))
+	event := &v2.Event{
+		Timestamp: now,
+		Check: &v2.Check{
+			ObjectMeta:      v2.ObjectMeta{Name: plugin.EventCheckName},
+			Status:          status,
+			Output:          strings.Join(output, "\n"),
+			Executed:        now,
+			Issued:          now,
+			ProxyEntityName: entityName,
+		},
+		Metrics: metrics,
+	}
+	if len(entityName) > 0 {
+		event.Entity = &v2.Entity{ObjectMeta: v2.ObjectMeta{Name: entityName}, EntityClass: v2.EntityProxyClass}
+	}
+	if err := event.Check.Validate(); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// entityName builds the proxy entity name of a query from the --entity-name-template, or the value of the
+// --entity-dimension without a template. It returns an empty name for queries without the dimension, and an error
+// for names Sensu rejects, such as names left empty once the characters not allowed are replaced.
+func (q MetricQueryMap) entityName() (string, error) {
+	found := false
+	for _, d := range q.Dimensions {
+		if aws.ToString(d.Name) == plugin.EntityDimension {
+			found = true
+		}
+	}
+	if !found {
+		return "", nil
+	}
+	template := plugin.EntityNameTemplate
+	if len(template) == 0 {
+		template = "{" + plugin.EntityDimension + "}"
+	}
+	name := common.ReplacePlaceholders(template, func(name string) string {
+		switch name {
+		case "region":
+			return q.awsRegion()
+		case "account":
+			return q.AccountId
+		}
+		for _, d := range q.Dimensions {
+			if aws.ToString(d.Name) == name {
+				return aws.ToString(d.Value)
+			}
+		}
+		return ""
+	})
+	name = strings.Trim(matchEntityUnsafe.ReplaceAllString(name, "_"), "_")
+	if err := v2.ValidateName(name); err != nil {
+		return "", fmt.Errorf("entity name %v", err)
+	}
+	return name, nil
+}
+
+// proxyEntityName returns the proxy entity name of a query, or an empty name for the queries submitted for the
+// agent entity, which includes the queries whose entity name is invalid
+func (q MetricQueryMap) proxyEntityName() string {
+	name, err := q.entityName()
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// entityProblems returns a problem line for every series whose proxy entity name is invalid, their points are
+// submitted for the agent entity instead
+func entityProblems(queries []MetricQueryMap) []string {
+	if plugin.OutputFormat != eventOutputFormat || len(plugin.EntityDimension) == 0 {
+		return nil
+	}
+	problems := []string{}
+	for _, q := range queries {
+		if _, err := q.entityName(); err != nil {
+			problems = append(problems, fmt.Sprintf("Warning: %v %v has an invalid proxy entity name, submitted for the agent entity: %v",
+				q.Label, common.DimString(q.Dimensions), err))
+		}
+	}
+	return problems
+}
+
+// metricsEvents builds the events to submit. With an --entity-dimension the queries are grouped into an event per
+// proxy entity, each with the status of its own thresholds, and queries without the dimension stay on the agent entity.
+func metricsEvents(report checkReport) ([]*v2.Event, error) {
+	if len(plugin.EntityDimension) == 0 {
+		event, err := newMetricsEvent(report, "")
+		if err != nil {
+			return nil, err
+		}
+		return []*v2.Event{event}, nil
+	}
+	names := []string{}
+	groups := make(map[string][]MetricQueryMap)
+	agentQueries := []MetricQueryMap{}
+	for _, q := range report.Queries {
+		name := q.proxyEntityName()
+		if len(name) == 0 {
+			agentQueries = append(agentQueries, q)
+			continue
+		}
+		if _, ok := groups[name]; !ok {
+			names = append(names, name)
+		}
+		groups[name] = append(groups[name], q)
+	}
+	events := []*v2.Event{}
+	for _, name := range names {
+		state, summary := evaluateThresholds(groups[name])
+		event, err := newMetricsEvent(checkReport{State: state, Summary: summary, Queries: groups[name]}, name)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	if len(agentQueries) > 0 {
+		_, summary := evaluateThresholds(agentQueries)
+		event, err := newMetricsEvent(checkReport{Summary: summary, Queries: agentQueries}, "")
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// thresholdQueries returns the queries whose thresholds set the state of the executing check. The series of proxy
+// entities submitted with --output-format event and an --entity-dimension alert on their own events instead, so a
+// breach alerts once.
+func thresholdQueries(queries []MetricQueryMap) []MetricQueryMap {
+	if plugin.OutputFormat != eventOutputFormat || len(plugin.EntityDimension) == 0 {
+		return queries
+	}
+	agentQueries := []MetricQueryMap{}
+	for _, q := range queries {
+		if len(q.proxyEntityName()) == 0 {
+			agentQueries = append(agentQueries, q)
+		}
+	}
+	return agentQueries
+}
+
+// reportEvent submits the results to the agent events API, metric handlers receive the points with their
+// tags without parsing the check output. The check output keeps the comment lines describing the problems found.
+func reportEvent(w io.Writer, report checkReport) error {
+	events, err := metricsEvents(report)
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		if err := postJSON(context.Background(), plugin.AgentAPIURL, nil, event); err != nil {
+			return fmt.Errorf("event submission failed: %v", err)
+		}
+	}
+	for _, line := range append(report.Problems, report.Summary...) {
+		if _, err := fmt.Fprintf(w, "# %v\n", line); err != nil {
+			return err
+		}
+	}
+	for _, event := range events {
+		entity := "the agent entity"
+		if event.Entity != nil {
+			entity = "entity " + event.Entity.Name
+		}
+		_, err = fmt.Fprintf(w, "# Submitted %v points to %v as check %v for %v\n", len(event.Metrics.Points), plugin.AgentAPIURL, plugin.EventCheckName, entity)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
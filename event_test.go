@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/sensu/sensu-cloudwatch-check/common"
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMetricsEvent(t *testing.T) {
+	defer quiet()()
+	defer cleanPluginValues()
+	assert := assert.New(t)
+	cleanPluginValues()
+	plugin.MetricHandlers = []string{"influxdb", "prometheus"}
+	event, err := newMetricsEvent(checkReport{
+		State:    sensu.CheckStateWarning,
+		Problems: []string{"Warning: Some GetMetricData results are incomplete"},
+		Queries:  outputTestQueries(),
+	}, "")
+	assert.NoError(err)
+	assert.Equal("cloudwatch-metrics", event.Check.Name)
+	// the executing check returns the state, the event for the agent entity is status-neutral
+	assert.Equal(uint32(sensu.CheckStateOK), event.Check.Status)
+	assert.Empty(event.Check.Handlers)
+	assert.Equal("Warning: Some GetMetricData results are incomplete\n4 points from 3 series", event.Check.Output)
+	assert.Equal([]string{"influxdb", "prometheus"}, event.Metrics.Handlers)
+	// the NaN value is left out
+	assert.Equal(4, len(event.Metrics.Points))
+	point := event.Metrics.Points[0]
+	assert.Equal("aws_alb_request_count_sum", point.Name)
+	assert.Equal(42.0, point.Value)
+	assert.Equal(int64(1651185600000), point.Timestamp)
+	assert.Equal([]*v2.MetricTag{
+		{Name: "TargetGroup", Value: "targetgroup/my tg/456"},
+		{Name: "LoadBalancer", Value: "app/my-lb/123"},
+		{Name: "aws_region", Value: "eu-west-1"},
+	}, point.Tags)
+
+	assert.Nil(event.Entity)
+	assert.Empty(event.Check.ProxyEntityName)
+
+	event, err = newMetricsEvent(checkReport{State: sensu.CheckStateWarning, Queries: outputTestQueries()}, "app_my-lb_123")
+	assert.NoError(err)
+	assert.Equal(uint32(sensu.CheckStateWarning), event.Check.Status)
+	assert.Equal("app_my-lb_123", event.Entity.Name)
+	assert.Equal("proxy", event.Entity.EntityClass)
+	assert.Equal("app_my-lb_123", event.Check.ProxyEntityName)
+
+	_, err = newMetricsEvent(checkReport{Queries: outputTestQueries()}, "app/my-lb")
+	assert.Error(err)
+
+	plugin.EventCheckName = ""
+	_, err = newMetricsEvent(checkReport{Queries: outputTestQueries()}, "")
+	assert.Error(err)
+}
+
+func TestMetricsEvents(t *testing.T) {
+	defer quiet()()
+	defer cleanPluginValues()
+	assert := assert.New(t)
+	cleanPluginValues()
+	queries := outputTestQueries()
+	critical, err := common.ParseThreshold(">40")
+	assert.NoError(err)
+	queries[0].Critical = critical
+	// a second load balancer without any breached threshold
+	other := queries[0]
+	other.Dimensions = []types.Dimension{{Name: aws.String("LoadBalancer"), Value: aws.String("app/other-lb/789")}}
+	other.Critical = nil
+	queries = append(queries, other)
+
+	events, err := metricsEvents(checkReport{State: sensu.CheckStateCritical, Queries: queries})
+	assert.NoError(err)
+	assert.Equal(1, len(events))
+	assert.Nil(events[0].Entity)
+	assert.Equal(uint32(sensu.CheckStateOK), events[0].Check.Status)
+
+	plugin.EntityDimension = "LoadBalancer"
+	events, err = metricsEvents(checkReport{State: sensu.CheckStateCritical, Queries: queries})
+	assert.NoError(err)
+	assert.Equal(3, len(events))
+	assert.Equal("app_my-lb_123", events[0].Entity.Name)
+	assert.Equal(uint32(sensu.CheckStateCritical), events[0].Check.Status)
+	assert.Contains(events[0].Check.Output, "Thresholds breached: 1 critical, 0 warning")
+	assert.Equal(2, len(events[0].Metrics.Points))
+	assert.Equal("app_other-lb_789", events[1].Entity.Name)
+	assert.Equal(uint32(sensu.CheckStateOK), events[1].Check.Status)
+	assert.Equal(2, len(events[1].Metrics.Points))
+	// the queries without the dimension stay on the agent entity
+	assert.Nil(events[2].Entity)
+	assert.Equal(uint32(sensu.CheckStateOK), events[2].Check.Status)
+	assert.Equal(2, len(events[2].Metrics.Points))
+
+	plugin.EntityNameTemplate = "aws-{region}-{ LoadBalancer }{account}"
+	events, err = metricsEvents(checkReport{Queries: queries[:1]})
+	assert.NoError(err)
+	assert.Equal(1, len(events))
+	assert.Equal("aws-eu-west-1-app_my-lb_123", events[0].Entity.Name)
+	assert.Equal("aws-eu-west-1-app_my-lb_123", events[0].Check.ProxyEntityName)
+}
+
+func TestEntityProblems(t *testing.T) {
+	defer cleanPluginValues()
+	assert := assert.New(t)
+	cleanPluginValues()
+	queries := outputTestQueries()
+	// a load balancer whose name is left empty once the characters not allowed are replaced
+	invalid := queries[0]
+	invalid.Dimensions = []types.Dimension{{Name: aws.String("LoadBalancer"), Value: aws.String("///")}}
+	queries = append(queries, invalid)
+	plugin.EntityDimension = "LoadBalancer"
+	assert.Empty(entityProblems(queries))
+
+	plugin.OutputFormat = eventOutputFormat
+	_, err := invalid.entityName()
+	assert.Error(err)
+	problems := entityProblems(queries)
+	assert.Equal(1, len(problems))
+	assert.Contains(problems[0], "Warning: aws_alb_request_count_sum LoadBalancer=\"///\"")
+	assert.Contains(problems[0], "entity name must not be empty")
+
+	// its points are submitted for the agent entity instead
+	events, err := metricsEvents(checkReport{Queries: queries})
+	assert.NoError(err)
+	assert.Equal(2, len(events))
+	assert.Equal("app_my-lb_123", events[0].Entity.Name)
+	assert.Nil(events[1].Entity)
+	assert.Equal(4, len(events[1].Metrics.Points))
+	assert.Contains(thresholdQueries(queries), invalid)
+}
+
+func TestThresholdQueries(t *testing.T) {
+	defer cleanPluginValues()
+	assert := assert.New(t)
+	cleanPluginValues()
+	queries := outputTestQueries()
+	assert.Equal(queries, thresholdQueries(queries))
+	plugin.EntityDimension = "LoadBalancer"
+	assert.Equal(queries, thresholdQueries(queries))
+	// the series of proxy entities alert on their own events
+	plugin.OutputFormat = eventOutputFormat
+	agentQueries := thresholdQueries(queries)
+	assert.Equal(len(queries)-1, len(agentQueries))
+	for _, q := range agentQueries {
+		assert.Empty(q.proxyEntityName())
+	}
+}
+
+func TestReportEvent(t *testing.T) {
+	defer quiet()()
+	defer cleanPluginValues()
+	assert := assert.New(t)
+	cleanPluginValues()
+	var received v2.Event
+	status := http.StatusCreated
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal("/events", r.URL.Path)
+		assert.Equal(http.MethodPost, r.Method)
+		assert.Equal("application/json", r.Header.Get("Content-Type"))
+		received = v2.Event{}
+		assert.NoError(json.Unmarshal(body, &received))
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	plugin.AgentAPIURL = server.URL + "/events"
+	plugin.EventCheckName = "aws-alb-metrics"
+	plugin.MetricHandlers = []string{"influxdb"}
+	var buf bytes.Buffer
+	assert.NoError(reportEvent(&buf, checkReport{Summary: []string{"Thresholds breached: 1 critical, 0 warning"}, Queries: outputTestQueries()}))
+	assert.Equal("# Thresholds breached: 1 critical, 0 warning\n# Submitted 4 points to "+plugin.AgentAPIURL+" as check aws-alb-metrics for the agent entity\n", buf.String())
+	assert.Nil(received.Entity)
+	assert.Equal("aws-alb-metrics", received.Check.Name)
+	assert.Equal([]string{"influxdb"}, received.Metrics.Handlers)
+	assert.Equal(4, len(received.Metrics.Points))
+	assert.Equal("aws_alb_target_response_time_p99_9", received.Metrics.Points[3].Name)
+	assert.Equal([]*v2.MetricTag{{Name: "Load,Balancer", Value: "a=b"}}, received.Metrics.Points[3].Tags)
+
+	plugin.EntityDimension = "LoadBalancer"
+	buf.Reset()
+	assert.NoError(reportEvent(&buf, checkReport{Queries: outputTestQueries()}))
+	assert.Equal("# Submitted 2 points to "+plugin.AgentAPIURL+" as check aws-alb-metrics for entity app_my-lb_123\n"+
+		"# Submitted 2 points to "+plugin.AgentAPIURL+" as check aws-alb-metrics for the agent entity\n", buf.String())
+	// the last event submitted holds the queries without the dimension
+	assert.Nil(received.Entity)
+	assert.Equal(2, len(received.Metrics.Points))
+
+	status = http.StatusBadRequest
+	buf.Reset()
+	err := reportEvent(&buf, checkReport{Queries: outputTestQueries()})
+	assert.Error(err)
+	assert.Contains(err.Error(), "400 Bad Request")
+	assert.Equal("", buf.String())
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/sensu/sensu-cloudwatch-check/presets"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// CloudWatch prices in us-east-1 at the time of writing, in USD, see https://aws.amazon.com/cloudwatch/pricing/
+const (
+	getMetricDataPricePerMetric = 0.01 / 1000
+	// ListMetrics is a standard API request, charged from the first request as the free tier is shared by the account
+	apiRequestPrice = 0.01 / 1000
+	secondsPerMonth = 30 * 24 * 60 * 60
+)
+
+// explainResult is the query plan of a single region, counted without calling GetMetricData
+type explainResult struct {
+	Region            string   `json:"region,omitempty"`
+	Problems          []string `json:"problems,omitempty"`
+	ListMetricsPages  int      `json:"list-metrics-pages"`
+	MetricsDiscovered int      `json:"metrics-discovered"`
+	Truncated         bool     `json:"truncated,omitempty"`
+	Queries           int      `json:"queries"`
+	MetricQueries     int      `json:"metric-queries"`
+	ExpressionQueries int      `json:"expression-queries"`
+	// SearchQueries and InsightsQueries are charged for every metric they match, which is only known when they run
+	SearchQueries   int `json:"search-queries"`
+	InsightsQueries int `json:"insights-queries"`
+	Batches         int `json:"batches"`
+	// Datapoints counts the datapoints of the queries returning data, a single datapoint per period
+	Datapoints int `json:"datapoints"`
+}
+
+// explainPlan adds up the query plans of every region into the API requests of a check run and their monthly cost
+type explainPlan struct {
+	Regions               []explainResult `json:"regions"`
+	IntervalSeconds       int             `json:"interval-seconds"`
+	RunsPerMonth          int             `json:"runs-per-month"`
+	ListMetricsRequests   int             `json:"list-metrics-requests-per-run"`
+	GetMetricDataRequests int             `json:"get-metric-data-requests-per-run"`
+	MetricsRequested      int             `json:"metrics-requested-per-run"`
+	Datapoints            int             `json:"datapoints-per-run"`
+	ListMetricsCost       float64         `json:"list-metrics-monthly-cost"`
+	GetMetricDataCost     float64         `json:"get-metric-data-monthly-cost"`
+	MonthlyCost           float64         `json:"estimated-monthly-cost"`
+}
+
+// explainQueries counts the data queries of a region and the GetMetricData batches they are packed into
+func explainQueries(queries []types.MetricDataQuery, periodMinutes int, result *explainResult) {
+	result.Queries = len(queries)
+	result.Batches = len(queryBatches(queries))
+	window := int32(periodMinutes * 60)
+	for _, q := range queries {
+		period := aws.ToInt32(q.Period)
+		switch {
+		case q.MetricStat != nil:
+			result.MetricQueries++
+			period = aws.ToInt32(q.MetricStat.Period)
+		case presets.IsInsightsQuery(aws.ToString(q.Expression)):
+			result.InsightsQueries++
+		default:
+			result.ExpressionQueries++
+			if strings.Contains(strings.ToUpper(aws.ToString(q.Expression)), "SEARCH(") {
+				result.SearchQueries++
+			}
+		}
+		if q.ReturnData != nil && !*q.ReturnData {
+			continue
+		}
+		points := 1
+		if period > 0 && window > period {
+			points = int(window / period)
+		}
+		result.Datapoints += points
+	}
+}
+
+// explainRegion discovers the metrics of the preset in a single region and counts the queries it would request
+func explainRegion(ctx context.Context, r regionClient, preset presets.PresetInterface) (explainResult, int) {
+	result := &regionResult{Region: r.Region}
+	client := newRateLimitedClient(r.Client, plugin.RequestsPerSecond)
+	metricDataQueries, periodMinutes, ok := regionQueries(ctx, client, preset, result)
+	explained := explainResult{
+		Region:            r.Region,
+		Problems:          result.Problems,
+		ListMetricsPages:  result.Discovery.Pages,
+		MetricsDiscovered: result.Discovery.Metrics,
+		Truncated:         result.Discovery.Truncated,
+	}
+	if ok {
+		explainQueries(metricDataQueries, periodMinutes, &explained)
+	}
+	return explained, result.State
+}
+
+// newExplainPlan adds up the region query plans for a check running every interval seconds
+func newExplainPlan(results []explainResult, interval int) explainPlan {
+	plan := explainPlan{Regions: results, IntervalSeconds: interval, RunsPerMonth: secondsPerMonth / interval}
+	for _, r := range results {
+		plan.ListMetricsRequests += r.ListMetricsPages
+		plan.GetMetricDataRequests += r.Batches
+		plan.MetricsRequested += r.MetricQueries
+		plan.Datapoints += r.Datapoints
+	}
+	plan.ListMetricsCost = float64(plan.RunsPerMonth*plan.ListMetricsRequests) * apiRequestPrice
+	plan.GetMetricDataCost = float64(plan.RunsPerMonth*plan.MetricsRequested) * getMetricDataPricePerMetric
+	plan.MonthlyCost = plan.ListMetricsCost + plan.GetMetricDataCost
+	return plan
+}
+
+// writeExplainPlan prints the query plan, as JSON for the json output format
+func writeExplainPlan(w io.Writer, plan explainPlan) error {
+	if plugin.OutputFormat == "json" {
+		output, err := json.MarshalIndent(plan, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(output))
+		return err
+	}
+	var b strings.Builder
+	b.WriteString("Query plan, GetMetricData was not called\n")
+	matched := 0
+	for _, r := range plan.Regions {
+		indent := ""
+		if len(r.Region) > 0 {
+			fmt.Fprintf(&b, "Region %v:\n", r.Region)
+			indent = "  "
+		}
+		for _, problem := range r.Problems {
+			fmt.Fprintf(&b, "%v%v\n", indent, problem)
+		}
+		truncated := ""
+		if r.Truncated {
+			truncated = ", truncated at --max-pages"
+		}
+		fmt.Fprintf(&b, "%vListMetrics pages:     %v (%v metrics discovered%v)\n", indent, r.ListMetricsPages, r.MetricsDiscovered, truncated)
+		fmt.Fprintf(&b, "%vMetricDataQueries:     %v (%v metrics, %v expressions, %v Metrics Insights queries)\n",
+			indent, r.Queries, r.MetricQueries, r.ExpressionQueries, r.InsightsQueries)
+		fmt.Fprintf(&b, "%vGetMetricData batches: %v\n", indent, r.Batches)
+		fmt.Fprintf(&b, "%vDatapoints requested:  %v\n", indent, r.Datapoints)
+		matched += r.SearchQueries + r.InsightsQueries
+	}
+	fmt.Fprintf(&b, "Per run: %v ListMetrics requests, %v GetMetricData requests, %v metrics requested, %v datapoints\n",
+		plan.ListMetricsRequests, plan.GetMetricDataRequests, plan.MetricsRequested, plan.Datapoints)
+	fmt.Fprintf(&b, "Estimated monthly cost at a %v second interval (%v runs): $%.2f\n", plan.IntervalSeconds, plan.RunsPerMonth, plan.MonthlyCost)
+	fmt.Fprintf(&b, "  GetMetricData: $%.2f ($0.01 per 1,000 metrics requested)\n", plan.GetMetricDataCost)
+	fmt.Fprintf(&b, "  ListMetrics:   $%.2f ($0.01 per 1,000 requests)\n", plan.ListMetricsCost)
+	if matched > 0 {
+		fmt.Fprintf(&b, "Note: %v SEARCH expressions and Metrics Insights queries are charged for the metrics they match, which are not included\n", matched)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// explainRegions runs discovery and builds the data queries for every region in parallel, printing the query plan
+// and its estimated cost instead of fetching the metric data
+func explainRegions(w io.Writer, regions []regionClient) (int, error) {
+	results := make([]explainResult, len(regions))
+	states := make([]int, len(regions))
+	var wg sync.WaitGroup
+	for k, r := range regions {
+		wg.Add(1)
+		go func(k int, r regionClient) {
+			defer wg.Done()
+			results[k], states[k] = explainRegion(context.TODO(), r, plugin.Preset.Clone())
+		}(k, r)
+	}
+	wg.Wait()
+	state := sensu.CheckStateOK
+	for _, s := range states {
+		if s > state {
+			state = s
+		}
+	}
+	if err := writeExplainPlan(w, newExplainPlan(results, plugin.ExplainInterval)); err != nil {
+		return sensu.CheckStateCritical, err
+	}
+	return state, nil
+}
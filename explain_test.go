@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/sensu/sensu-cloudwatch-check/presets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExplainQueries(t *testing.T) {
+	assert := assert.New(t)
+	metric := func(id string, returnData bool) types.MetricDataQuery {
+		return types.MetricDataQuery{
+			Id:         aws.String(id),
+			MetricStat: &types.MetricStat{Metric: &types.Metric{MetricName: aws.String("test")}, Period: aws.Int32(60), Stat: aws.String("Sum")},
+			ReturnData: aws.Bool(returnData),
+		}
+	}
+	queries := []types.MetricDataQuery{
+		metric("a", true),
+		metric("b", false),
+		{Id: aws.String("c"), Expression: aws.String("a + b"), Period: aws.Int32(60)},
+		{Id: aws.String("d"), Expression: aws.String(`SEARCH('{AWS/EC2,InstanceId} CPUUtilization', 'Average', 60)`), Period: aws.Int32(300)},
+		{Id: aws.String("e"), Expression: aws.String(`SELECT AVG(CPUUtilization) FROM SCHEMA("AWS/EC2", InstanceId)`), Period: aws.Int32(60)},
+	}
+	result := explainResult{}
+	explainQueries(queries, 5, &result)
+	assert.Equal(explainResult{Queries: 5, MetricQueries: 2, ExpressionQueries: 2, SearchQueries: 1, InsightsQueries: 1, Batches: 1, Datapoints: 16}, result)
+
+	for i := 0; i < 600; i++ {
+		queries = append(queries, metric(fmt.Sprintf("m%v", i), true))
+	}
+	result = explainResult{}
+	explainQueries(queries, 1, &result)
+	assert.Equal(2, result.Batches)
+	assert.Equal(602, result.MetricQueries)
+}
+
+func TestNewExplainPlan(t *testing.T) {
+	assert := assert.New(t)
+	plan := newExplainPlan([]explainResult{
+		{Region: "us-east-1", ListMetricsPages: 3, MetricQueries: 1000, Batches: 3, Datapoints: 900},
+		{Region: "eu-west-1", ListMetricsPages: 1, MetricQueries: 500, Batches: 1, Datapoints: 500},
+	}, 300)
+	assert.Equal(8640, plan.RunsPerMonth)
+	assert.Equal(4, plan.ListMetricsRequests)
+	assert.Equal(4, plan.GetMetricDataRequests)
+	assert.Equal(1500, plan.MetricsRequested)
+	assert.Equal(1400, plan.Datapoints)
+	assert.InDelta(0.3456, plan.ListMetricsCost, 1e-9)
+	assert.InDelta(129.6, plan.GetMetricDataCost, 1e-9)
+	assert.InDelta(129.9456, plan.MonthlyCost, 1e-9)
+}
+
+func TestExplainRegions(t *testing.T) {
+	defer quiet()()
+	defer cleanPluginValues()
+	assert := assert.New(t)
+	cleanPluginValues()
+	pages := [][]types.Metric{}
+	for p := 0; p < 3; p++ {
+		pages = append(pages, []types.Metric{
+			{MetricName: aws.String(fmt.Sprintf("metric_%v_0", p)), Namespace: aws.String("AWS/test")},
+			{MetricName: aws.String(fmt.Sprintf("metric_%v_1", p)), Namespace: aws.String("AWS/test")},
+		})
+	}
+	none := &presets.None{}
+	none.AddStats([]string{"Average", "Sum"})
+	plugin.Preset = none
+	plugin.PeriodMinutes = 1
+	plugin.Explain = true
+	getMetricDataBatches = []int{}
+
+	var buf bytes.Buffer
+	state, err := explainRegions(&buf, []regionClient{{Client: mockService{pages: pages}}})
+	assert.NoError(err)
+	assert.Equal(0, state)
+	assert.Empty(getMetricDataBatches)
+	assert.Equal(`Query plan, GetMetricData was not called
+ListMetrics pages:     3 (6 metrics discovered)
+MetricDataQueries:     12 (12 metrics, 0 expressions, 0 Metrics Insights queries)
+GetMetricData batches: 1
+Datapoints requested:  12
+Per run: 3 ListMetrics requests, 1 GetMetricData requests, 12 metrics requested, 12 datapoints
+Estimated monthly cost at a 60 second interval (43200 runs): $6.48
+  GetMetricData: $5.18 ($0.01 per 1,000 metrics requested)
+  ListMetrics:   $1.30 ($0.01 per 1,000 requests)
+`, buf.String())
+
+	plugin.OutputFormat = "json"
+	plugin.MaxPages = 2
+	buf.Reset()
+	state, err = explainRegions(&buf, []regionClient{{Region: "eu-west-1", Client: mockService{pages: pages}}, {Region: "us-east-1", Client: mockService{pages: pages}}})
+	assert.NoError(err)
+	assert.Equal(0, state)
+	plan := explainPlan{}
+	assert.NoError(json.Unmarshal(buf.Bytes(), &plan))
+	assert.Equal(2, len(plan.Regions))
+	assert.Equal("eu-west-1", plan.Regions[0].Region)
+	assert.True(plan.Regions[0].Truncated)
+	assert.Equal(8, plan.Regions[1].Queries)
+	assert.Equal(4, plan.ListMetricsRequests)
+	assert.Equal(16, plan.MetricsRequested)
+
+	// regions without queries report their problems
+	buf.Reset()
+	plugin.OutputFormat = "prometheus"
+	state, err = explainRegions(&buf, []regionClient{{Client: mockService{pages: [][]types.Metric{{}}}}})
+	assert.NoError(err)
+	assert.Equal(1, state)
+	assert.Contains(buf.String(), "Warning: No metricDataQueries to process\n")
+}
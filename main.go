@@ -1,13 +1,15 @@
 package main
 
 import (
-	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"reflect"
-	"strconv"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sensu/sensu-cloudwatch-check/common"
@@ -19,7 +21,6 @@ import (
 	sensuAWS "github.com/sensu/sensu-cloudwatch-check/aws"
 	v2 "github.com/sensu/sensu-go/api/core/v2"
 	"github.com/sensu/sensu-plugin-sdk/sensu"
-	"github.com/sensu/sensu-plugin-sdk/sensu/metric"
 )
 
 // Config represents the check plugin config.
@@ -35,17 +36,48 @@ type Config struct {
 	MetricName             string
 	DimensionFilterStrings []string
 	DimensionFilters       []types.DimensionFilter
+	EventStdin             bool
 	Verbose                bool
 	ErrorOnMissing         bool
 	DryRun                 bool
+	Explain                bool
+	ExplainInterval        int
 	RecentlyActive         bool
 	MaxPages               int
 	PeriodMinutes          int
+	StateFile              string
+	MaxLookbackMinutes     int
+	State                  *fetchState
 	StatsList              []string
 	PresetName             string
 	Preset                 presets.PresetInterface
 	OutputConfig           bool
 	ConfigString           string
+	ConfigFile             string
+	PresetDir              string
+	Warning                string
+	Critical               string
+	WarningThreshold       *common.Threshold
+	CriticalThreshold      *common.Threshold
+	Query                  string
+	QueryMeasurement       string
+	Concurrency            int
+	RequestsPerSecond      float64
+	Regions                []string
+	OutputFormat           string
+	GraphiteTemplate       string
+	OTLPEndpoint           string
+	OTLPHeaders            []string
+	AgentAPIURL            string
+	EventCheckName         string
+	MetricHandlers         []string
+	EntityDimension        string
+	EntityNameTemplate     string
+	ListenAddress          string
+	ScrapeInterval         int
+	ScrapePresets          []string
+	ScrapeTargets          []scrapeTarget
+	AccountIDErr           error
 }
 
 type MetricQueryMap struct {
@@ -53,9 +85,19 @@ type MetricQueryMap struct {
 	Label            string
 	Namespace        string
 	MetricName       string
+	Expression       string
+	Stat             string
 	Dimensions       []types.Dimension
 	Metric           *types.Metric
+	Insights         *presets.InsightsQuery
 	MetricDataResult types.MetricDataResult
+	Warning          *common.Threshold
+	Critical         *common.Threshold
+	AccountId        string
+	Region           string
+	Unit             string
+	// Period of the datapoints in seconds
+	Period int32
 }
 
 func (q MetricQueryMap) Points() ([]*v2.MetricPoint, error) {
@@ -64,6 +106,12 @@ func (q MetricQueryMap) Points() ([]*v2.MetricPoint, error) {
 	for _, d := range q.Dimensions {
 		metricTags = append(metricTags, &v2.MetricTag{Name: *d.Name, Value: *d.Value})
 	}
+	if len(q.AccountId) > 0 {
+		metricTags = append(metricTags, &v2.MetricTag{Name: "aws_account_id", Value: q.AccountId})
+	}
+	if len(q.Region) > 0 {
+		metricTags = append(metricTags, &v2.MetricTag{Name: "aws_region", Value: q.Region})
+	}
 
 	for i := range q.MetricDataResult.Timestamps {
 
@@ -77,13 +125,37 @@ func (q MetricQueryMap) Points() ([]*v2.MetricPoint, error) {
 	return points, nil
 }
 
+// FieldKey names the statistic of the query, for output formats keeping it apart from the measurement name.
+// Expressions have no statistic of their own and use "value".
+func (q MetricQueryMap) FieldKey() string {
+	if len(q.Stat) == 0 {
+		return "value"
+	}
+	return common.StatisticLabel(q.Stat)
+}
+
+// awsRegion returns the region of the query, or the region of the AWS config when checking a single region
+func (q MetricQueryMap) awsRegion() string {
+	if len(q.Region) > 0 || plugin.AWSConfig == nil {
+		return q.Region
+	}
+	return plugin.AWSConfig.Region
+}
+
 func (q MetricQueryMap) Output(includeHelp bool, includeType bool, includeData bool) ([]string, error) {
 	output := make([]string, 0)
 	baseLabel := getBaseLabel(q.Label)
+	region := q.awsRegion()
 	if includeHelp {
-		output = append(output,
-			fmt.Sprintf("# HELP %v Namespace:%v MetricName:%v Region:%v",
-				baseLabel, q.Namespace, q.MetricName, plugin.AWSConfig.Region))
+		if len(q.Expression) > 0 {
+			output = append(output,
+				fmt.Sprintf("# HELP %v Namespace:%v Expression:%v Region:%v",
+					baseLabel, q.Namespace, q.Expression, region))
+		} else {
+			output = append(output,
+				fmt.Sprintf("# HELP %v Namespace:%v MetricName:%v Region:%v",
+					baseLabel, q.Namespace, q.MetricName, region))
+		}
 	}
 	if includeType {
 		output = append(output,
@@ -100,6 +172,45 @@ func (q MetricQueryMap) Output(includeHelp bool, includeType bool, includeData b
 
 }
 
+// LatestValue returns the most recent datapoint of the result, independent of the result scan order
+func (q MetricQueryMap) LatestValue() (float64, bool) {
+	latest, ok := q.latestIndex()
+	if !ok {
+		return 0, false
+	}
+	return q.MetricDataResult.Values[latest], true
+}
+
+// latestIndex returns the index of the most recent datapoint of the result
+func (q MetricQueryMap) latestIndex() (int, bool) {
+	latest := -1
+	for i := range q.MetricDataResult.Timestamps {
+		if i >= len(q.MetricDataResult.Values) {
+			break
+		}
+		if latest < 0 || q.MetricDataResult.Timestamps[i].After(q.MetricDataResult.Timestamps[latest]) {
+			latest = i
+		}
+	}
+	return latest, latest >= 0
+}
+
+// Status evaluates the latest datapoint against the query thresholds, critical taking precedence over warning
+func (q MetricQueryMap) Status() (int, string) {
+	value, ok := q.LatestValue()
+	if !ok {
+		return sensu.CheckStateOK, ""
+	}
+	series := fmt.Sprintf("%v{%v}", q.Label, common.DimString(q.Dimensions))
+	if q.Critical.Breached(value) {
+		return sensu.CheckStateCritical, fmt.Sprintf("CRITICAL %v = %v (%v)", series, value, q.Critical)
+	}
+	if q.Warning.Breached(value) {
+		return sensu.CheckStateWarning, fmt.Sprintf("WARNING %v = %v (%v)", series, value, q.Warning)
+	}
+	return sensu.CheckStateOK, ""
+}
+
 func getBaseLabel(label string) string {
 	last := strings.LastIndex(label, "_")
 	if last > 0 {
@@ -128,6 +239,15 @@ var (
 			Usage:     "AWS Region to use, (or set envvar AWS_REGION)",
 			Value:     &plugin.AWSRegion,
 		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:      "regions",
+			Env:       "CLOUDWATCH_CHECK_REGIONS",
+			Argument:  "regions",
+			Shorthand: "",
+			Default:   []string{},
+			Usage:     `Comma separated list of AWS Regions to check in parallel, or "all-enabled" for every region enabled for the account`,
+			Value:     &plugin.Regions,
+		},
 		&sensu.PluginConfigOption[string]{
 			Path:      "profile",
 			Env:       "AWS_PROFILE",
@@ -158,6 +278,61 @@ var (
 			Secret:    false,
 			Value:     &plugin.AWSCredentialsFiles,
 		},
+		&sensu.PluginConfigOption[string]{
+			Path:      "endpoint-url",
+			Env:       "CLOUDWATCH_CHECK_ENDPOINT_URL",
+			Argument:  "endpoint-url",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Endpoint URL to use instead of the default CloudWatch and STS endpoints, Ex: http://localhost:4566",
+			Value:     &plugin.AWSEndpointURL,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:      "role-arn",
+			Env:       "AWS_ROLE_ARN",
+			Argument:  "role-arn",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "ARN of an IAM role to assume with STS, Ex: arn:aws:iam::123456789012:role/monitoring",
+			Value:     &plugin.AWSRoleArn,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:      "external-id",
+			Env:       "AWS_EXTERNAL_ID",
+			Argument:  "external-id",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "External ID required by the trust policy of the assumed role (for security use envvar AWS_EXTERNAL_ID)",
+			Secret:    true,
+			Value:     &plugin.AWSExternalID,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:      "role-session-name",
+			Env:       "AWS_ROLE_SESSION_NAME",
+			Argument:  "role-session-name",
+			Shorthand: "",
+			Default:   "sensu-cloudwatch-check",
+			Usage:     "Session name of the assumed role",
+			Value:     &plugin.AWSRoleSessionName,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:      "duration",
+			Env:       "AWS_ROLE_DURATION",
+			Argument:  "duration",
+			Shorthand: "",
+			Default:   900,
+			Usage:     "Duration in seconds of the assumed role session",
+			Value:     &plugin.AWSRoleDuration,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:      "web-identity-token-file",
+			Env:       "AWS_WEB_IDENTITY_TOKEN_FILE",
+			Argument:  "web-identity-token-file",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Web identity token file used to assume --role-arn, Ex: the EKS service account token",
+			Value:     &plugin.AWSWebIdentityTokenFile,
+		},
 		&sensu.PluginConfigOption[bool]{
 			Value:     &plugin.OutputConfig,
 			Path:      "output-config",
@@ -175,6 +350,24 @@ var (
 			Usage:     "The measurement configuration JSON string to use",
 			Value:     &plugin.ConfigString,
 		},
+		&sensu.PluginConfigOption[string]{
+			Path:      "config-file",
+			Argument:  "config-file",
+			Env:       "CLOUDWATCH_CHECK_CONFIG_FILE",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "The measurement configuration JSON or YAML file to use instead of --config",
+			Value:     &plugin.ConfigFile,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:      "preset-dir",
+			Argument:  "preset-dir",
+			Env:       "CLOUDWATCH_CHECK_PRESET_DIR",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Directory of measurement configuration JSON and YAML files to load as presets named after each file, Ex: rds.yaml as --preset rds",
+			Value:     &plugin.PresetDir,
+		},
 		&sensu.PluginConfigOption[bool]{
 			Path:     "recently-active",
 			Argument: "recently-active",
@@ -197,9 +390,18 @@ var (
 			Env:       "CLOUDWATCH_CHECK_DIMENSION_FILTERS",
 			Shorthand: "D",
 			Default:   []string{},
-			Usage:     `Comma separated list of AWS Cloudwatch Dimension Filters Ex: "Name, SecondName=SecondValue"`,
+			Usage:     `Comma separated list of AWS Cloudwatch Dimension Filters, values can be templates resolved against the Sensu event Ex: "Name, SecondName=SecondValue, InstanceId={{ .Entity.Labels.aws_instance_id }}"`,
 			Value:     &plugin.DimensionFilterStrings,
 		},
+		&sensu.PluginConfigOption[bool]{
+			Path:      "event-stdin",
+			Argument:  "event-stdin",
+			Env:       "CLOUDWATCH_CHECK_EVENT_STDIN",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Read the Sensu event from stdin to resolve dimension filter templates, requires stdin: true in the check definition",
+			Value:     &plugin.EventStdin,
+		},
 		&sensu.SlicePluginConfigOption[string]{
 			Path:      "stats",
 			Argument:  "stats",
@@ -218,6 +420,24 @@ var (
 			Usage:     "Cloudwatch Metric Filter, limit result to given Metric name",
 			Value:     &plugin.MetricName,
 		},
+		&sensu.PluginConfigOption[string]{
+			Path:      "query",
+			Argument:  "query",
+			Env:       "CLOUDWATCH_CHECK_QUERY",
+			Shorthand: "q",
+			Default:   "",
+			Usage:     `CloudWatch Metrics Insights query to run instead of a preset, Ex: "SELECT AVG(CPUUtilization) FROM SCHEMA(\"AWS/EC2\", InstanceId) GROUP BY InstanceId"`,
+			Value:     &plugin.Query,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:      "query-measurement",
+			Argument:  "query-measurement",
+			Env:       "CLOUDWATCH_CHECK_QUERY_MEASUREMENT",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Measurement name for --query results, defaults to a name built from the queried namespace, metric and function",
+			Value:     &plugin.QueryMeasurement,
+		},
 		&sensu.PluginConfigOption[string]{
 			Path:      "preset",
 			Argument:  "preset",
@@ -245,6 +465,42 @@ var (
 			Usage:     "Previous number of minutes to consider for metrics statistic calculation",
 			Value:     &plugin.PeriodMinutes,
 		},
+		&sensu.PluginConfigOption[string]{
+			Path:      "state-file",
+			Argument:  "state-file",
+			Env:       "CLOUDWATCH_CHECK_STATE_FILE",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "File recording the latest datapoint of every series, so each run fetches from the last datapoint and only outputs new ones",
+			Value:     &plugin.StateFile,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:      "max-lookback-minutes",
+			Argument:  "max-lookback-minutes",
+			Env:       "CLOUDWATCH_CHECK_MAX_LOOKBACK_MINUTES",
+			Shorthand: "",
+			Default:   60,
+			Usage:     "Maximum number of minutes to fetch from the last datapoint of the --state-file",
+			Value:     &plugin.MaxLookbackMinutes,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:      "concurrency",
+			Argument:  "concurrency",
+			Env:       "CLOUDWATCH_CHECK_CONCURRENCY",
+			Shorthand: "",
+			Default:   4,
+			Usage:     "Maximum number of GetMetricData batches of 500 queries to request concurrently",
+			Value:     &plugin.Concurrency,
+		},
+		&sensu.PluginConfigOption[float64]{
+			Path:      "requests-per-second",
+			Argument:  "requests-per-second",
+			Env:       "CLOUDWATCH_CHECK_REQUESTS_PER_SECOND",
+			Shorthand: "",
+			Default:   0,
+			Usage:     "Maximum number of CloudWatch API requests per second. A zero value will disable the limit",
+			Value:     &plugin.RequestsPerSecond,
+		},
 		&sensu.PluginConfigOption[bool]{
 			Path:      "verbose",
 			Argument:  "verbose",
@@ -262,6 +518,133 @@ var (
 			Usage:     "Error if requested metrics configuration is missing a known metric from the AWS service metric list",
 			Value:     &plugin.ErrorOnMissing,
 		},
+		&sensu.PluginConfigOption[string]{
+			Path:      "warning",
+			Argument:  "warning",
+			Env:       "CLOUDWATCH_CHECK_WARNING",
+			Shorthand: "w",
+			Default:   "",
+			Usage:     `Warning threshold applied to measurements without their own, Ex: ">80" or "<5"`,
+			Value:     &plugin.Warning,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:      "critical",
+			Argument:  "critical",
+			Env:       "CLOUDWATCH_CHECK_CRITICAL",
+			Shorthand: "C",
+			Default:   "",
+			Usage:     `Critical threshold applied to measurements without their own, Ex: ">95" or "<1"`,
+			Value:     &plugin.Critical,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:      "output-format",
+			Argument:  "output-format",
+			Env:       "CLOUDWATCH_CHECK_OUTPUT_FORMAT",
+			Shorthand: "",
+			Default:   "prometheus",
+			Usage:     "Metrics output format, one of: " + strings.Join(outputFormatNames(), ", "),
+			Value:     &plugin.OutputFormat,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:      "graphite-template",
+			Argument:  "graphite-template",
+			Env:       "CLOUDWATCH_CHECK_GRAPHITE_TEMPLATE",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Graphite path template for --output-format graphite, overriding the preset template, Ex: aws.{region}.alb.{LoadBalancer}.{metric}.{stat}",
+			Value:     &plugin.GraphiteTemplate,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:      "otlp-endpoint",
+			Argument:  "otlp-endpoint",
+			Env:       "CLOUDWATCH_CHECK_OTLP_ENDPOINT",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "OTLP/HTTP metrics endpoint to POST --output-format otlp metrics to instead of printing them, Ex: http://localhost:4318/v1/metrics",
+			Value:     &plugin.OTLPEndpoint,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:      "otlp-headers",
+			Argument:  "otlp-headers",
+			Env:       "CLOUDWATCH_CHECK_OTLP_HEADERS",
+			Shorthand: "",
+			Default:   []string{},
+			Usage:     "Comma separated list of key=value headers to send to the --otlp-endpoint",
+			Value:     &plugin.OTLPHeaders,
+			Secret:    true,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:      "agent-api-url",
+			Argument:  "agent-api-url",
+			Env:       "CLOUDWATCH_CHECK_AGENT_API_URL",
+			Shorthand: "",
+			Default:   "http://127.0.0.1:3031/events",
+			Usage:     "Sensu agent events API URL to submit --output-format event metrics to",
+			Value:     &plugin.AgentAPIURL,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:      "event-check-name",
+			Argument:  "event-check-name",
+			Env:       "CLOUDWATCH_CHECK_EVENT_CHECK_NAME",
+			Shorthand: "",
+			Default:   "cloudwatch-metrics",
+			Usage:     "Check name of the events submitted with --output-format event",
+			Value:     &plugin.EventCheckName,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:      "metric-handlers",
+			Argument:  "metric-handlers",
+			Env:       "CLOUDWATCH_CHECK_METRIC_HANDLERS",
+			Shorthand: "",
+			Default:   []string{},
+			Usage:     "Comma separated list of metric handlers of the events submitted with --output-format event",
+			Value:     &plugin.MetricHandlers,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:      "entity-dimension",
+			Argument:  "entity-dimension",
+			Env:       "CLOUDWATCH_CHECK_ENTITY_DIMENSION",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Dimension to group --output-format event results by into an event per proxy entity, Ex: LoadBalancer or InstanceId",
+			Value:     &plugin.EntityDimension,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:      "entity-name-template",
+			Argument:  "entity-name-template",
+			Env:       "CLOUDWATCH_CHECK_ENTITY_NAME_TEMPLATE",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Proxy entity name template over {region}, {account} and dimension names, defaults to the --entity-dimension value, Ex: aws-{region}-{LoadBalancer}",
+			Value:     &plugin.EntityNameTemplate,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:      "listen-address",
+			Argument:  "listen-address",
+			Env:       "CLOUDWATCH_CHECK_LISTEN_ADDRESS",
+			Shorthand: "",
+			Default:   ":9106",
+			Usage:     "Address the serve subcommand listens on for /metrics and /healthz requests",
+			Value:     &plugin.ListenAddress,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:      "scrape-interval",
+			Argument:  "scrape-interval",
+			Env:       "CLOUDWATCH_CHECK_SCRAPE_INTERVAL",
+			Shorthand: "",
+			Default:   60,
+			Usage:     "Seconds between the CloudWatch requests of each preset served by the serve subcommand",
+			Value:     &plugin.ScrapeInterval,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:      "scrape-presets",
+			Argument:  "scrape-presets",
+			Env:       "CLOUDWATCH_CHECK_SCRAPE_PRESETS",
+			Shorthand: "",
+			Default:   []string{},
+			Usage:     "Comma separated list of presets served by the serve subcommand instead of --preset, each with an optional scrape interval in seconds, Ex: ALB=300,EC2",
+			Value:     &plugin.ScrapePresets,
+		},
 		&sensu.PluginConfigOption[bool]{
 			Path:      "dry-run",
 			Argument:  "dry-run",
@@ -270,6 +653,23 @@ var (
 			Usage:     "Dryrun only list metrics, do not get metrics data",
 			Value:     &plugin.DryRun,
 		},
+		&sensu.PluginConfigOption[bool]{
+			Path:      "explain",
+			Argument:  "explain",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "List metrics and print the GetMetricData query plan with an API cost estimate, do not get metrics data",
+			Value:     &plugin.Explain,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:      "explain-interval",
+			Argument:  "explain-interval",
+			Env:       "CLOUDWATCH_CHECK_EXPLAIN_INTERVAL",
+			Shorthand: "",
+			Default:   60,
+			Usage:     "Check interval in seconds the --explain monthly cost estimate is computed for",
+			Value:     &plugin.ExplainInterval,
+		},
 	}
 )
 
@@ -277,35 +677,184 @@ func init() {
 }
 
 func main() {
+	// the validate and presets subcommands work on measurement configs without running the check
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validateCommand(os.Stdin, os.Stdout, os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "presets" {
+		os.Exit(presetsCommand(os.Stdout, os.Args[2:]))
+	}
+	// the serve subcommand takes the options of the check, and runs until interrupted
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		serveMode = true
+	}
 	check := sensu.NewGoCheck(&plugin.PluginConfig, options, checkArgs, executeCheck, false)
 	check.Execute()
 }
 
-func checkArgs(_ *v2.Event) (int, error) {
+// readEvent reads the Sensu event the agent passes to checks with stdin: true, only with --event-stdin so the
+// check does not read from the stdin of cron jobs, CI or remote shells
+func readEvent(r io.Reader) (*v2.Event, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("--event-stdin: %v", err)
+	}
+	event := &v2.Event{}
+	if err := json.Unmarshal(data, event); err != nil {
+		return nil, fmt.Errorf("--event-stdin: invalid Sensu event: %v", err)
+	}
+	if err := event.Validate(); err != nil {
+		return nil, fmt.Errorf("--event-stdin: invalid Sensu event: %v", err)
+	}
+	return event, nil
+}
+
+func checkArgs(event *v2.Event) (int, error) {
 
 	// Specific Argument Checking for this command
 	if plugin.Verbose {
 		fmt.Println("Checking Arguments")
 	}
+	if plugin.EventStdin {
+		if serveMode {
+			return sensu.CheckStateWarning, fmt.Errorf("--event-stdin can not be combined with the serve command")
+		}
+		if event == nil {
+			stdinEvent, err := readEvent(os.Stdin)
+			if err != nil {
+				return sensu.CheckStateWarning, err
+			}
+			event = stdinEvent
+		}
+	}
 	if len(plugin.DimensionFilterStrings) > 0 {
-		dimensionFilters, err := common.BuildDimensionFilters(plugin.DimensionFilterStrings)
+		filterStrings, err := common.ExpandDimensionFilterTemplates(plugin.DimensionFilterStrings, event)
+		if err != nil {
+			return sensu.CheckStateWarning, err
+		}
+		dimensionFilters, err := common.BuildDimensionFilters(filterStrings)
 		if err != nil {
 			return sensu.CheckStateWarning, err
 		}
 		plugin.DimensionFilters = dimensionFilters
 	}
+	warning, err := common.ParseThreshold(plugin.Warning)
+	if err != nil {
+		return sensu.CheckStateWarning, err
+	}
+	plugin.WarningThreshold = warning
+	critical, err := common.ParseThreshold(plugin.Critical)
+	if err != nil {
+		return sensu.CheckStateWarning, err
+	}
+	plugin.CriticalThreshold = critical
+	if plugin.Concurrency < 1 {
+		return sensu.CheckStateWarning, fmt.Errorf("--concurrency must be at least 1")
+	}
+	if plugin.RequestsPerSecond < 0 {
+		return sensu.CheckStateWarning, fmt.Errorf("--requests-per-second can not be negative")
+	}
+	if plugin.Explain && plugin.ExplainInterval < 1 {
+		return sensu.CheckStateWarning, fmt.Errorf("--explain-interval must be at least 1 second")
+	}
+	if !validOutputFormat(plugin.OutputFormat) {
+		return sensu.CheckStateWarning, fmt.Errorf("unknown --output-format %q, choose from: %v", plugin.OutputFormat, strings.Join(outputFormatNames(), ", "))
+	}
+	if len(plugin.GraphiteTemplate) > 0 {
+		if err := common.CheckGraphiteTemplate(plugin.GraphiteTemplate); err != nil {
+			return sensu.CheckStateWarning, err
+		}
+	}
+	if len(plugin.OTLPEndpoint) > 0 {
+		if plugin.OutputFormat != otlpOutputFormat {
+			return sensu.CheckStateWarning, fmt.Errorf("--otlp-endpoint requires --output-format %v", otlpOutputFormat)
+		}
+		if err := common.CheckHTTPURL(plugin.OTLPEndpoint); err != nil {
+			return sensu.CheckStateWarning, err
+		}
+	}
+	for _, header := range plugin.OTLPHeaders {
+		if !strings.Contains(header, "=") {
+			return sensu.CheckStateWarning, fmt.Errorf("invalid --otlp-headers %q, must be key=value", header)
+		}
+	}
+	if plugin.OutputFormat == eventOutputFormat {
+		if err := common.CheckHTTPURL(plugin.AgentAPIURL); err != nil {
+			return sensu.CheckStateWarning, fmt.Errorf("--agent-api-url: %v", err)
+		}
+		if err := v2.ValidateName(plugin.EventCheckName); err != nil {
+			return sensu.CheckStateWarning, fmt.Errorf("--event-check-name %v", err)
+		}
+		for _, handler := range plugin.MetricHandlers {
+			if err := v2.ValidateName(handler); err != nil {
+				return sensu.CheckStateWarning, fmt.Errorf("--metric-handlers %q %v", handler, err)
+			}
+		}
+		if len(plugin.EntityNameTemplate) > 0 && len(plugin.EntityDimension) == 0 {
+			return sensu.CheckStateWarning, fmt.Errorf("--entity-name-template requires --entity-dimension")
+		}
+		if err := common.CheckPlaceholders(plugin.EntityNameTemplate); err != nil {
+			return sensu.CheckStateWarning, fmt.Errorf("--entity-name-template %v", err)
+		}
+	} else if len(plugin.EntityDimension) > 0 || len(plugin.EntityNameTemplate) > 0 {
+		return sensu.CheckStateWarning, fmt.Errorf("--entity-dimension and --entity-name-template require --output-format %v", eventOutputFormat)
+	}
+	regions := []string{}
+	seenRegions := map[string]bool{}
+	for _, region := range plugin.Regions {
+		region = strings.TrimSpace(region)
+		if len(region) > 0 && !seenRegions[region] {
+			seenRegions[region] = true
+			regions = append(regions, region)
+		}
+	}
+	if seenRegions[allEnabledRegions] && len(regions) > 1 {
+		return sensu.CheckStateWarning, fmt.Errorf("--regions %v can not be combined with other regions", allEnabledRegions)
+	}
+	plugin.Regions = regions
+	for _, stat := range plugin.StatsList {
+		if !common.ValidStatistic(strings.TrimSpace(stat)) {
+			return sensu.CheckStateWarning, fmt.Errorf("invalid statistic %q, see https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/Statistics-definitions.html", stat)
+		}
+	}
+
+	if len(plugin.PresetDir) > 0 {
+		names, err := presets.LoadPresetDir(plugin.PresetDir, event)
+		if err != nil {
+			return sensu.CheckStateWarning, fmt.Errorf("--preset-dir %v", err)
+		}
+		if plugin.Verbose {
+			fmt.Println("Loaded presets:", strings.Join(names, ", "))
+		}
+	}
+	// the measurement config of --config, or read from --config-file, leaving the options as given
+	measurementConfig := plugin.ConfigString
+	if len(plugin.ConfigFile) > 0 {
+		if len(plugin.ConfigString) > 0 {
+			return sensu.CheckStateWarning, fmt.Errorf("--config and --config-file can not be combined")
+		}
+		config, err := presets.ReadMeasurementFile(plugin.ConfigFile)
+		if err != nil {
+			return sensu.CheckStateWarning, fmt.Errorf("--config-file %v", err)
+		}
+		measurementConfig = config
+	} else if len(plugin.ConfigString) > 0 {
+		if err := presets.ValidateMeasurementConfig("--config", []byte(plugin.ConfigString)); err != nil {
+			return sensu.CheckStateWarning, err
+		}
+	}
 
 	if len(strings.TrimSpace(plugin.PresetName)) > 0 {
 		if p, ok := presets.Presets[strings.TrimSpace(plugin.PresetName)]; ok {
 			plugin.Preset = p
 		} else {
-			keys := reflect.ValueOf(presets.Presets).MapKeys()
 			strArr := make([]string, 0)
-			for _, key := range keys {
-				str := fmt.Sprintf(" %v : %v\n", key.String(), presets.Presets[key.String()].GetDescription())
+			for _, name := range presets.PresetNames() {
+				str := fmt.Sprintf(" %v : %v\n", name, presets.Presets[name].GetDescription())
 				strArr = append(strArr, str)
 			}
-			err := fmt.Errorf("Preset %v not defined\nChoose from:\n%v", plugin.PresetName, strings.Join(strArr, ""))
+			err := fmt.Errorf("Preset %v not defined, see the presets list command\nChoose from:\n%v", plugin.PresetName, strings.Join(strArr, ""))
 			return sensu.CheckStateWarning, err
 		}
 	} else {
@@ -316,12 +865,16 @@ func checkArgs(_ *v2.Event) (int, error) {
 		err := fmt.Errorf("no preset selected")
 		return sensu.CheckStateWarning, err
 	}
-	if len(plugin.ConfigString) > 0 {
+	if len(measurementConfig) > 0 {
 		if plugin.PresetName == "None" {
 			plugin.PresetName = "Custom"
 			p := presets.Preset{Description: "Custom Config"}
-
-			err := p.SetMeasurementString(plugin.ConfigString)
+			err := p.SetEvent(event)
+			if err != nil {
+				fmt.Println("Preset SetEvent error")
+				return sensu.CheckStateCritical, nil
+			}
+			err = p.SetMeasurementString(measurementConfig)
 			if err != nil {
 				fmt.Println("Preset SetMeasurementString error")
 				return sensu.CheckStateCritical, nil
@@ -329,7 +882,7 @@ func checkArgs(_ *v2.Event) (int, error) {
 			plugin.Preset = &p
 			err = plugin.Preset.BuildMeasurementConfig()
 			if err != nil {
-				fmt.Println("Preset BuildMeasurementConfig error")
+				fmt.Printf("Preset BuildMeasurementConfig error: %v\n", err)
 				return sensu.CheckStateCritical, nil
 			}
 
@@ -340,8 +893,8 @@ func checkArgs(_ *v2.Event) (int, error) {
 
 	if len(plugin.PresetName) == 0 || plugin.PresetName == "None" {
 		// If haven't selected a cloudwatch filter argument switch to dryrun to avoid pulling data for all metrics
-		if len(plugin.ConfigString) == 0 && len(plugin.Namespace) == 0 && len(plugin.MetricName) == 0 && !plugin.DryRun {
-			return sensu.CheckStateWarning, fmt.Errorf("must select at least one of: --config, --namespace, --metric, or --dry-run")
+		if len(measurementConfig) == 0 && len(plugin.Namespace) == 0 && len(plugin.MetricName) == 0 && len(plugin.Query) == 0 && !plugin.DryRun && !plugin.Explain && !(serveMode && len(plugin.ScrapePresets) > 0) {
+			return sensu.CheckStateWarning, fmt.Errorf("must select at least one of: --config, --config-file, --namespace, --metric, --query, --dry-run or --explain")
 		}
 	}
 	if plugin.PresetName == "None" {
@@ -368,24 +921,71 @@ func checkArgs(_ *v2.Event) (int, error) {
 		}
 		none.Namespace = plugin.Namespace
 		none.AddStats(plugin.StatsList)
-		if len(plugin.ConfigString) > 0 {
-			err = none.SetMeasurementString(plugin.ConfigString)
+		if len(measurementConfig) > 0 {
+			err = none.SetEvent(event)
+			if err != nil {
+				fmt.Println("Preset SetEvent error")
+				return sensu.CheckStateCritical, nil
+			}
+			err = none.SetMeasurementString(measurementConfig)
 			if err != nil {
 				fmt.Println("Preset SetMeasurementString error")
 				return sensu.CheckStateCritical, nil
 			}
 			err = none.BuildMeasurementConfig()
 			if err != nil {
-				fmt.Println("Preset BuildMeasurementConfig error")
+				fmt.Printf("Preset BuildMeasurementConfig error: %v\n", err)
 				return sensu.CheckStateCritical, nil
 			}
 		}
 		plugin.Preset = none
 	}
+	if len(plugin.Query) > 0 {
+		if plugin.PresetName != "None" {
+			return sensu.CheckStateWarning, fmt.Errorf("--query can not be combined with --config or --preset")
+		}
+		insights := &presets.Insights{Query: plugin.Query, Measurement: plugin.QueryMeasurement}
+		if err := insights.SetVerbose(plugin.Verbose); err != nil {
+			fmt.Println("Preset SetVerbose error")
+			return sensu.CheckStateCritical, nil
+		}
+		if err := insights.Ready(); err != nil {
+			return sensu.CheckStateWarning, err
+		}
+		plugin.PresetName = "Insights"
+		plugin.Preset = insights
+	}
 	// Use preset aws region if defined
 	if region := plugin.Preset.GetRegion(); len(region) > 0 {
 		plugin.AWSRegion = region
 	}
+	// Use preset endpoint url unless set on the commandline
+	if endpointURL := plugin.Preset.GetEndpointURL(); len(endpointURL) > 0 && len(plugin.AWSEndpointURL) == 0 {
+		plugin.AWSEndpointURL = endpointURL
+	}
+	if serveMode {
+		targets, err := scrapeTargets()
+		if err != nil {
+			return sensu.CheckStateWarning, err
+		}
+		plugin.ScrapeTargets = targets
+	}
+	if len(plugin.StateFile) > 0 {
+		if serveMode {
+			return sensu.CheckStateWarning, fmt.Errorf("--state-file can not be combined with the serve command")
+		}
+		if plugin.MaxLookbackMinutes < 1 {
+			return sensu.CheckStateWarning, fmt.Errorf("--max-lookback-minutes must be at least 1")
+		}
+		state, err := loadState(plugin.StateFile)
+		if errors.Is(err, errStateLocked) {
+			return sensu.CheckStateWarning, fmt.Errorf("--state-file %v is locked by another run", plugin.StateFile)
+		}
+		if err != nil {
+			return sensu.CheckStateWarning, fmt.Errorf("could not lock --state-file %v: %v", plugin.StateFile, err)
+		}
+		plugin.State = state
+	}
 	// Check for valid AWS credentials
 	if plugin.Verbose {
 		fmt.Println("Checking AWS Creds")
@@ -396,16 +996,48 @@ func checkArgs(_ *v2.Event) (int, error) {
 	return sensu.CheckStateOK, nil
 }
 
+// needsAccountID tells whether the account id of the credentials is used: to tag the points of an assumed role, or
+// by an {account} placeholder of the Graphite path template or the --entity-name-template
+func needsAccountID() bool {
+	if len(plugin.AWSRoleArn) > 0 {
+		return true
+	}
+	if plugin.OutputFormat == "graphite" && strings.Contains(graphiteTemplate(), "{account}") {
+		return true
+	}
+	return plugin.OutputFormat == eventOutputFormat && strings.Contains(plugin.EntityNameTemplate, "{account}")
+}
+
 func executeCheck(_ *v2.Event) (int, error) {
 	//Make sure plugin.CheckAwsCreds() worked as expected
 	if plugin.AWSConfig == nil {
 		return sensu.CheckStateCritical, fmt.Errorf("AWS Config undefined, something went wrong in processing AWS configuration information")
 	}
-	//Start AWS Service specific client
-	client := cloudwatch.NewFromConfig(*plugin.AWSConfig)
-	//Run business logic for check
-	state, err := checkFunction(client)
-	return state, err
+	if needsAccountID() {
+		// the points are left untagged rather than failing the check, CloudWatch may be reachable without STS
+		plugin.AccountIDErr = plugin.ResolveAccountID(context.TODO())
+	}
+	if serveMode {
+		return serveExporter()
+	}
+	if len(plugin.Regions) == 0 {
+		//Start AWS Service specific client
+		client := plugin.CloudWatchClient(*plugin.AWSConfig)
+		//Run business logic for check
+		state, err := checkFunction(client)
+		return state, err
+	}
+	regions, err := resolveRegions(context.TODO(), plugin.Preset, plugin.Regions)
+	if err != nil {
+		return sensu.CheckStateCritical, fmt.Errorf("could not list enabled regions: %v", err)
+	}
+	clients := []regionClient{}
+	for _, region := range regions {
+		cfg := plugin.AWSConfig.Copy()
+		cfg.Region = region
+		clients = append(clients, regionClient{Region: region, Client: plugin.CloudWatchClient(cfg)})
+	}
+	return checkRegions(clients)
 }
 
 // ServiceAPI creates a service interface to help with mock testing
@@ -448,200 +1080,276 @@ func buildGetMetricDataInput(metricDataQueries []types.MetricDataQuery, periodMi
 	input := &cloudwatch.GetMetricDataInput{}
 	input.EndTime = aws.Time(time.Unix(time.Now().Unix(), 0))
 	input.StartTime = aws.Time(time.Unix(time.Now().Add(time.Duration(-periodMinutes)*time.Minute).Unix(), 0))
-	input.MetricDataQueries = metricDataQueries
+	input.MetricDataQueries = make([]types.MetricDataQuery, len(metricDataQueries))
+	for i, q := range metricDataQueries {
+		// grouped Metrics Insights series are labeled with their GROUP BY values, the measurement name is kept
+		// by the query map
+		if q.Expression != nil && presets.IsInsightsQuery(*q.Expression) {
+			q.Label = nil
+			if parsed, err := presets.ParseInsightsQuery(*q.Expression); err == nil && len(parsed.GroupBy) > 0 {
+				q.Label = aws.String(parsed.GroupLabel())
+			}
+		}
+		input.MetricDataQueries[i] = q
+	}
 	return input, nil
 }
 
-func getData(client ServiceAPI, metricDataQueries []types.MetricDataQuery, periodMinutes int) (int, error) {
+// newMetricQueryMap maps a data query back to the metric it measures, expression queries take the metric
+// namespace and dimensions of the first measurement they reference
+func newMetricQueryMap(d types.MetricDataQuery, queriesById map[string]types.MetricDataQuery) MetricQueryMap {
+	qMap := MetricQueryMap{
+		Id:        *d.Id,
+		Label:     *d.Label,
+		Warning:   plugin.WarningThreshold,
+		Critical:  plugin.CriticalThreshold,
+		AccountId: plugin.AWSAccountID,
+		Period:    aws.ToInt32(d.Period),
+	}
+	if d.Expression != nil {
+		qMap.Expression = *d.Expression
+		if presets.IsInsightsQuery(*d.Expression) {
+			if parsed, err := presets.ParseInsightsQuery(*d.Expression); err == nil {
+				qMap.Insights = &parsed
+				qMap.Namespace = parsed.Namespace
+				qMap.Stat = parsed.Statistic()
+			}
+			return qMap
+		}
+	}
+	seen := map[string]bool{}
+	for d.MetricStat == nil && d.Expression != nil {
+		seen[*d.Id] = true
+		next, found := types.MetricDataQuery{}, false
+		for _, ref := range common.ExpressionReferences(*d.Expression) {
+			if q, ok := queriesById[ref]; ok && !seen[ref] {
+				next, found = q, true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+		d = next
+	}
+	if d.MetricStat != nil && d.MetricStat.Metric != nil {
+		qMap.Namespace = aws.ToString(d.MetricStat.Metric.Namespace)
+		qMap.Dimensions = d.MetricStat.Metric.Dimensions
+		if qMap.Period == 0 {
+			qMap.Period = aws.ToInt32(d.MetricStat.Period)
+		}
+		if len(qMap.Expression) == 0 {
+			qMap.Metric = d.MetricStat.Metric
+			qMap.MetricName = aws.ToString(d.MetricStat.Metric.MetricName)
+			qMap.Stat = aws.ToString(d.MetricStat.Stat)
+		}
+	}
+	return qMap
+}
+
+// queryBatchEnd returns the end of the batch starting at start holding at most size queries,
+// without separating an expression from the queries it references
+func queryBatchEnd(queries []types.MetricDataQuery, start int, size int) int {
+	end := start + size
+	if end >= len(queries) {
+		return len(queries)
+	}
+	index := make(map[string]int)
+	for k, q := range queries {
+		index[*q.Id] = k
+	}
+	// earliest[k] is the lowest query index referenced by any query at or after k
+	earliest := make([]int, len(queries)+1)
+	earliest[len(queries)] = len(queries)
+	for k := len(queries) - 1; k >= 0; k-- {
+		earliest[k] = k
+		if queries[k].Expression != nil {
+			for _, ref := range common.ExpressionReferences(*queries[k].Expression) {
+				if r, ok := index[ref]; ok && r < earliest[k] {
+					earliest[k] = r
+				}
+			}
+		}
+		if earliest[k+1] < earliest[k] {
+			earliest[k] = earliest[k+1]
+		}
+	}
+	for cut := end; cut > start; cut-- {
+		if earliest[cut] >= cut {
+			return cut
+		}
+	}
+	// the referenced queries can not fit in a single batch
+	return end
+}
+
+// maxQueriesPerBatch is the most queries a GetMetricData call takes
+const maxQueriesPerBatch = 500
+
+// queryBatches packs the queries into batches of up to maxQueriesPerBatch queries, one per GetMetricData call
+func queryBatches(queries []types.MetricDataQuery) [][]types.MetricDataQuery {
+	var batches [][]types.MetricDataQuery
+	i := 0
+	for i < len(queries) {
+		j := queryBatchEnd(queries, i, maxQueriesPerBatch)
+		batches = append(batches, queries[i:j])
+		i = j
+	}
+	return batches
+}
+
+// getData fetches the metric data of the queries in batches of up to 500 queries, collecting the results into the region result
+func getData(client ServiceAPI, preset presets.PresetInterface, metricDataQueries []types.MetricDataQuery, periodMinutes int, result *regionResult) {
 	metricQueryMap := make(map[string]MetricQueryMap)
 	unusedQueryMap := make(map[string]MetricQueryMap)
-	dataMessages := make([]types.MessageData, 0)
-	numResults := 0
+	result.NumQueries = len(metricDataQueries)
 
+	queriesById := make(map[string]types.MetricDataQuery)
+	for _, d := range metricDataQueries {
+		queriesById[*d.Id] = d
+	}
 	for _, d := range metricDataQueries {
+		if d.ReturnData != nil && !*d.ReturnData {
+			continue
+		}
 		idString := *d.Id
-		qMap := MetricQueryMap{
-			Id:         *d.Id,
-			Label:      *d.Label,
-			Metric:     d.MetricStat.Metric,
-			MetricName: *d.MetricStat.Metric.MetricName,
-			Namespace:  *d.MetricStat.Metric.Namespace,
-			Dimensions: d.MetricStat.Metric.Dimensions,
+		qMap := newMetricQueryMap(d, queriesById)
+		qMap.Region = result.Region
+		if config, ok := preset.GetStatConfig(qMap.MetricName, qMap.Label); ok {
+			qMap.Unit = config.Unit
+			if t, err := common.ParseThreshold(config.Warning); err == nil && t != nil {
+				qMap.Warning = t
+			}
+			if t, err := common.ParseThreshold(config.Critical); err == nil && t != nil {
+				qMap.Critical = t
+			}
 		}
 		metricQueryMap[idString] = qMap
 		unusedQueryMap[idString] = qMap
 	}
-	var results []*v2.MetricPoint
-	//Prepare the GetMetricData loop
-	i := 0
-	for i < len(metricDataQueries) {
-		//Pack up to 500 data queries into GetMetricData call
-		j := i + 500
-		if j > len(metricDataQueries) {
-			j = len(metricDataQueries)
+	defer func() {
+		for _, d := range metricDataQueries {
+			if q, ok := unusedQueryMap[*d.Id]; ok {
+				result.Unused = append(result.Unused, q)
+			}
 		}
-		dataQuerySlice := metricDataQueries[i:j]
+	}()
+	batches := queryBatches(metricDataQueries)
+	var inputs []*cloudwatch.GetMetricDataInput
+	for _, dataQuerySlice := range batches {
 		getMetricDataInput, err := buildGetMetricDataInput(dataQuerySlice, periodMinutes)
 		if err != nil {
-			fmt.Println("Could not build GetMetricsDataInput")
-			return sensu.CheckStateCritical, nil
+			result.fail(sensu.CheckStateCritical, "Could not build GetMetricsDataInput")
+			return
+		}
+		if plugin.State != nil {
+			plugin.State.extendWindow(getMetricDataInput, metricQueryMap, time.Duration(plugin.MaxLookbackMinutes)*time.Minute)
 		}
-		i = j + 1
+		inputs = append(inputs, getMetricDataInput)
+	}
 
-		if plugin.DryRun {
+	if plugin.DryRun {
+		for _, dataQuerySlice := range batches {
 			for _, d := range dataQuerySlice {
-				q, ok := metricQueryMap[*d.Id]
-				if !ok {
-					fmt.Printf("Could not look up MetricQuery: %v\n", *d.Id)
-					return sensu.CheckStateCritical, nil
+				if d.ReturnData != nil && !*d.ReturnData {
+					continue
 				}
-				delete(unusedQueryMap, *d.Id)
-				metricPoints, err := q.Points()
-				if err == nil {
-					results = append(results, metricPoints...)
+				if _, ok := metricQueryMap[*d.Id]; !ok {
+					result.fail(sensu.CheckStateCritical, fmt.Sprintf("Could not look up MetricQuery: %v", *d.Id))
+					return
 				}
-
+				delete(unusedQueryMap, *d.Id)
 			}
-		} else {
-			dataResult, err := GetMetricData(context.TODO(), client, getMetricDataInput)
-			if err != nil {
-				fmt.Printf("Could not get metrics: %v\n", err)
-				return sensu.CheckStateCritical, nil
+		}
+		return
+	}
+	for _, fetched := range fetchBatches(context.TODO(), client, inputs, plugin.Concurrency) {
+		if fetched.Err != nil {
+			result.fail(sensu.CheckStateCritical, fmt.Sprintf("Could not get metrics: %v", fetched.Err))
+			return
+		}
+		// data messages are reported with the problems, the output formats keep stdout machine-readable
+		result.DataMessages = append(result.DataMessages, fetched.Messages...)
+		for _, d := range fetched.Results {
+			result.NumResults++
+			q, ok := metricQueryMap[*d.Id]
+			q.MetricDataResult = d
+			if !ok {
+				result.fail(sensu.CheckStateCritical, fmt.Sprintf("Could not look up MetricQuery: %v", *d.Id))
+				return
 			}
-			if dataResult.NextToken != nil {
-				fmt.Printf("GetMetricData result too long")
-				return sensu.CheckStateCritical, nil
+			if q.Insights != nil {
+				q.Dimensions = q.Insights.GroupDimensions(aws.ToString(d.Label))
 			}
-			if len(dataResult.Messages) > 0 {
-				fmt.Printf("GetMetricData has DataMessage: %v\n", dataResult.Messages)
-				dataMessages = append(dataMessages, dataResult.Messages...)
+			if warning := resultStatusWarning(q); len(warning) > 0 {
+				result.StatusWarnings = append(result.StatusWarnings, warning)
 			}
-			for _, d := range dataResult.MetricDataResults {
-				numResults++
-				q, ok := metricQueryMap[*d.Id]
-				q.MetricDataResult = d
-				if !ok {
-					fmt.Printf("Could not look up MetricQuery: %v\n", *d.Id)
-					return sensu.CheckStateCritical, nil
-				}
-				if len(d.Timestamps) > 0 {
-					delete(unusedQueryMap, *d.Id)
-					metricPoints, err := q.Points()
-					if err == nil {
-						results = append(results, metricPoints...)
-					}
-				}
+			if len(d.Timestamps) > 0 {
+				delete(unusedQueryMap, *d.Id)
+				result.Evaluated = append(result.Evaluated, q)
 			}
-		}
-
-	}
-	if plugin.Verbose {
-		fmt.Println("\nExecution Summary:")
-		fmt.Printf("  MetricDataQueries: %v\n", len(metricDataQueries))
-		fmt.Printf("  Number of MetricDataResults: %v\n", numResults)
-		if len(unusedQueryMap) > 0 {
-			fmt.Printf("  MetricDataQueries with no results:\n")
-
-			for _, q := range unusedQueryMap {
-				fmt.Printf("    Label: %v\n      Namespace:%v MetricName:%v Region:%v Dimensions:%v\n",
-					q.Label, q.Namespace, q.MetricName, plugin.AWSConfig.Region, common.DimString(q.Dimensions))
+			if plugin.State != nil {
+				// datapoints emitted by previous runs are left out of the output only
+				q.MetricDataResult = plugin.State.newDatapoints(q)
+			}
+			if len(q.MetricDataResult.Timestamps) > 0 {
+				result.Queries = append(result.Queries, q)
 			}
 		}
-		fmt.Println("")
-		fmt.Println("Normal Output:")
-	}
-	warnFlag := false
-	if len(dataMessages) > 0 {
-		fmt.Println("# Warning: Some calls to GetMetricData resulted in error messages")
-		for _, m := range dataMessages {
-			fmt.Printf("# GetMetricData:: Code: %v Message: %v\n", *m.Code, *m.Value)
-		}
-		warnFlag = true
 	}
+}
 
-	if warnFlag {
-		return sensu.CheckStateWarning, nil
-	}
-	if len(results) > 0 {
-		writer := bufio.NewWriter(os.Stdout)
-		err := metric.Points(results).ToProm(writer)
-		if err != nil {
-			return sensu.CheckStateCritical, err
+// evaluateThresholds returns the worst state across all series along with a human readable summary
+// naming every breaching series, sorted so the most severe breaches are listed first
+func evaluateThresholds(queries []MetricQueryMap) (int, []string) {
+	state := sensu.CheckStateOK
+	critical := []string{}
+	warning := []string{}
+	for _, q := range queries {
+		s, line := q.Status()
+		switch s {
+		case sensu.CheckStateCritical:
+			critical = append(critical, line)
+		case sensu.CheckStateWarning:
+			warning = append(warning, line)
+		}
+		if s > state {
+			state = s
 		}
-		writer.Flush()
 	}
-	return sensu.CheckStateOK, nil
-
+	if state == sensu.CheckStateOK {
+		return state, nil
+	}
+	sort.Strings(critical)
+	sort.Strings(warning)
+	summary := []string{fmt.Sprintf("Thresholds breached: %v critical, %v warning", len(critical), len(warning))}
+	summary = append(summary, critical...)
+	summary = append(summary, warning...)
+	return state, summary
 }
 
+// checkFunction runs the check with a single CloudWatch client for the region of the AWS config
 func checkFunction(client ServiceAPI) (int, error) {
-	var err error
-	var metricDataQueries []types.MetricDataQuery
-	numMetrics := 0
-	numPages := 0
-	err = plugin.Preset.AddDimensionFilters(plugin.DimensionFilters)
-	if err != nil {
-		fmt.Println("Preset AddDimensionFilters error")
-		return sensu.CheckStateCritical, nil
-	}
-	err = plugin.Preset.SetMetricFilter(plugin.MetricName)
-	if err != nil {
-		fmt.Println("Preset SetMetricFilter error")
-		return sensu.CheckStateCritical, nil
-	}
-	err = plugin.Preset.SetVerbose(plugin.Verbose)
-	if err != nil {
-		fmt.Println("Preset SetVerbose error")
-		return sensu.CheckStateCritical, nil
-	}
-	err = plugin.Preset.SetErrorOnMissing(plugin.ErrorOnMissing)
-	if err != nil {
-		fmt.Println("Preset SetErrorOnMissing error")
-		return sensu.CheckStateCritical, nil
-	}
-	err = plugin.Preset.Ready()
-	if err != nil {
-		fmt.Println("Preset Ready error")
-		return sensu.CheckStateCritical, nil
-	}
-	//List Metrics result page loop
-
-	for getList := true; getList && (plugin.MaxPages == 0 || numPages < plugin.MaxPages); {
-		getList = false
-		input, err := buildListMetricsInput(plugin.Preset)
-		if err != nil {
-			fmt.Println("Could not create ListMetricsInput")
-			return sensu.CheckStateCritical, nil
-		}
-		listResult, err := GetMetricsList(context.TODO(), client, input)
-
-		if err != nil {
-			fmt.Println("Could not get metrics list")
-			return sensu.CheckStateCritical, nil
-		}
-		if listResult.NextToken != nil {
-			getList = true
-			numPages++
-			input.NextToken = listResult.NextToken
-		}
-
-		err = plugin.Preset.AddMetrics(listResult.Metrics)
-		if err != nil {
-			fmt.Println("Preset AddMetrics error")
-			return sensu.CheckStateCritical, nil
-		}
-
-		numMetrics += len(listResult.Metrics)
+	return checkRegions([]regionClient{{Client: client}})
+}
 
-	}
-	numPages++
-	if plugin.Verbose {
-		fmt.Println("Found " + strconv.Itoa(numMetrics) + " metrics")
-		fmt.Println("Result Pages " + strconv.Itoa(numPages))
-		fmt.Println("")
+// checkRegions runs discovery and GetMetricData for every region in parallel, each region with its own
+// copy of the preset, and reports the results of all regions as a single check result
+func checkRegions(regions []regionClient) (int, error) {
+	if err := preparePreset(plugin.Preset); err != nil {
+		fmt.Println(err)
+		return sensu.CheckStateCritical, nil
 	}
 	if plugin.OutputConfig {
-		if output, err := plugin.Preset.GetMeasurementString(true); err != nil {
+		preset := plugin.Preset.Clone()
+		if preset.UsesListMetrics() {
+			client := newRateLimitedClient(regions[0].Client, plugin.RequestsPerSecond)
+			if _, err := discoverMetrics(context.TODO(), client, preset, plugin.MaxPages); err != nil {
+				fmt.Println(err)
+				return sensu.CheckStateCritical, nil
+			}
+		}
+		if output, err := preset.GetMeasurementString(true); err != nil {
 			return sensu.CheckStateCritical, nil
 		} else {
 			if plugin.Verbose {
@@ -649,30 +1357,66 @@ func checkFunction(client ServiceAPI) (int, error) {
 			}
 			fmt.Println(output)
 		}
-	} else {
-		periodMinutes := plugin.PeriodMinutes
-		if p := plugin.Preset.GetPeriodMinutes(); p > 0 {
-			periodMinutes = p
-		}
-		metricDataQueries, err = plugin.Preset.BuildMetricDataQueries(int32(periodMinutes))
-		if err != nil {
-			fmt.Println("Could not build DataQuery")
-			return sensu.CheckStateCritical, nil
-		}
-		if len(metricDataQueries) == 0 {
-			fmt.Println("No metricDataQueries to process")
-			return sensu.CheckStateWarning, nil
-		}
-		if state, err := getData(client, metricDataQueries, periodMinutes); state != sensu.CheckStateOK {
-			return state, err
-		}
-		// Outputting Metrics
-		if plugin.MaxPages > 0 && numPages > plugin.MaxPages {
-			fmt.Printf("\n# Warning: max allowed ListMetrics result pages (%v) exceeded, either filter via --namespace or --metric option or increase --max-pages value\n",
-				plugin.MaxPages)
-			return sensu.CheckStateWarning, nil
+		return sensu.CheckStateOK, nil
+	}
+	if plugin.Explain {
+		return explainRegions(os.Stdout, regions)
+	}
+	results := collectRegions(context.TODO(), regions, plugin.Preset)
+	if plugin.State == nil || plugin.DryRun {
+		return reportRegions(results)
+	}
+	defer plugin.State.unlock()
+	staged := stageState(plugin.State, results)
+	state, err := reportRegions(results)
+	if len(staged) == 0 {
+		return state, err
+	}
+	// the state only moves past the datapoints once they were reported
+	if err != nil {
+		os.Remove(staged)
+		return state, err
+	}
+	if err := plugin.State.commit(staged); err != nil {
+		if state < sensu.CheckStateWarning {
+			state = sensu.CheckStateWarning
 		}
+		return state, fmt.Errorf("could not save state file: %v", err)
+	}
+	return state, nil
+}
 
+// preparePreset applies the filters and options of the command line to the preset and readies it for discovery
+func preparePreset(preset presets.PresetInterface) error {
+	if err := preset.AddDimensionFilters(plugin.DimensionFilters); err != nil {
+		return fmt.Errorf("Preset AddDimensionFilters error")
 	}
-	return sensu.CheckStateOK, nil
+	if err := preset.SetMetricFilter(plugin.MetricName); err != nil {
+		return fmt.Errorf("Preset SetMetricFilter error")
+	}
+	if err := preset.SetVerbose(plugin.Verbose); err != nil {
+		return fmt.Errorf("Preset SetVerbose error")
+	}
+	if err := preset.SetErrorOnMissing(plugin.ErrorOnMissing); err != nil {
+		return fmt.Errorf("Preset SetErrorOnMissing error")
+	}
+	if err := preset.Ready(); err != nil {
+		return fmt.Errorf("Preset Ready error")
+	}
+	return nil
+}
+
+// collectRegions collects the metrics of every region in parallel, each region with its own copy of the preset
+func collectRegions(ctx context.Context, regions []regionClient, preset presets.PresetInterface) []*regionResult {
+	results := make([]*regionResult, len(regions))
+	var wg sync.WaitGroup
+	for k, r := range regions {
+		wg.Add(1)
+		go func(k int, r regionClient) {
+			defer wg.Done()
+			results[k] = collectRegion(ctx, r, preset.Clone())
+		}(k, r)
+	}
+	wg.Wait()
+	return results
 }
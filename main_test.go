@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -14,26 +19,59 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 	"github.com/sensu/sensu-cloudwatch-check/common"
 	"github.com/sensu/sensu-cloudwatch-check/presets"
+	v2 "github.com/sensu/sensu-go/api/core/v2"
 	"github.com/stretchr/testify/assert"
 )
 
 // Create mockService Object to use in testing.
 // FIXME: replace s3 specific items with correct AWS service items
 var (
-	nextToken   = false
-	enableQuiet = false
+	nextToken        = false
+	enableQuiet      = false
+	listMetricsCalls = 0
+	// NextToken of every ListMetrics call made against a paged mockService
+	listMetricsTokens = []string{}
+	// number of queries in every GetMetricData call
+	getMetricDataBatches = []int{}
+	// GetMetricData calls running concurrently, and the most seen at once
+	getMetricDataInFlight    = 0
+	getMetricDataMaxInFlight = 0
+	mockLock                 sync.Mutex
 )
 
 type mockService struct {
 	statusCode      types.StatusCode
 	dataResultId    string
 	includeMessages bool
+	// pages of ListMetrics results, chained with "page-N" tokens
+	pages [][]types.Metric
+	// number of GetMetricData result pages, chained with "data-N" tokens, one datapoint per series on each page
+	dataPages int
+	// time each GetMetricData call takes
+	delay time.Duration
+	// error returned by every GetMetricData call
+	dataErr error
 }
 
 // Create mockService Functions that match functions defined in ServiceAPI interface in main.go
 func (m mockService) ListMetrics(ctx context.Context,
 	params *cloudwatch.ListMetricsInput,
 	optFns ...func(*cloudwatch.Options)) (*cloudwatch.ListMetricsOutput, error) {
+	mockLock.Lock()
+	defer mockLock.Unlock()
+	listMetricsCalls++
+	if len(m.pages) > 0 {
+		listMetricsTokens = append(listMetricsTokens, aws.ToString(params.NextToken))
+		page := 0
+		if params.NextToken != nil {
+			page, _ = strconv.Atoi(strings.TrimPrefix(*params.NextToken, "page-"))
+		}
+		output := &cloudwatch.ListMetricsOutput{Metrics: m.pages[page]}
+		if page+1 < len(m.pages) {
+			output.NextToken = aws.String("page-" + strconv.Itoa(page+1))
+		}
+		return output, nil
+	}
 	name := "test"
 	namespace := "AWS/test"
 	// Create a list of two dummy metrics
@@ -63,7 +101,65 @@ func (m mockService) GetMetricData(ctx context.Context,
 	params *cloudwatch.GetMetricDataInput,
 	optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error) {
 	results := []types.MetricDataResult{}
+	mockLock.Lock()
+	if params.NextToken == nil {
+		getMetricDataBatches = append(getMetricDataBatches, len(params.MetricDataQueries))
+	}
+	getMetricDataInFlight++
+	if getMetricDataInFlight > getMetricDataMaxInFlight {
+		getMetricDataMaxInFlight = getMetricDataInFlight
+	}
+	mockLock.Unlock()
+	defer func() {
+		mockLock.Lock()
+		getMetricDataInFlight--
+		mockLock.Unlock()
+	}()
+	time.Sleep(m.delay)
+	if m.dataErr != nil {
+		return nil, m.dataErr
+	}
+	if m.dataPages > 0 {
+		page := 0
+		if params.NextToken != nil {
+			page, _ = strconv.Atoi(strings.TrimPrefix(*params.NextToken, "data-"))
+		}
+		output := &cloudwatch.GetMetricDataOutput{}
+		for _, d := range params.MetricDataQueries {
+			result := types.MetricDataResult{
+				Id:         d.Id,
+				Label:      d.Label,
+				StatusCode: types.StatusCodePartialData,
+				Timestamps: []time.Time{time.Now().Add(time.Duration(-page) * time.Minute)},
+				Values:     []float64{float64(page)},
+			}
+			if page+1 == m.dataPages {
+				result.StatusCode = m.statusCode
+			}
+			output.MetricDataResults = append(output.MetricDataResults, result)
+		}
+		if page+1 < m.dataPages {
+			output.NextToken = aws.String("data-" + strconv.Itoa(page+1))
+		}
+		return output, nil
+	}
 	for _, d := range params.MetricDataQueries {
+		if d.ReturnData != nil && !*d.ReturnData {
+			continue
+		}
+		// Metrics Insights queries return one series per GROUP BY value
+		if d.Expression != nil && presets.IsInsightsQuery(*d.Expression) {
+			for _, label := range []string{"i-aaa", "i-bbb"} {
+				results = append(results, types.MetricDataResult{
+					Id:         d.Id,
+					Label:      aws.String(label),
+					StatusCode: m.statusCode,
+					Timestamps: []time.Time{time.Now()},
+					Values:     []float64{0.0},
+				})
+			}
+			continue
+		}
 		// Create a list of two dummy metrics
 		result := types.MetricDataResult{
 			Id:         d.Id,
@@ -120,12 +216,49 @@ func cleanPluginValues() {
 	plugin.Verbose = false
 	plugin.RecentlyActive = false
 	plugin.DryRun = false
+	plugin.EventStdin = false
+	plugin.Explain = false
+	plugin.ExplainInterval = 60
 	plugin.ConfigString = ""
 	plugin.MetricName = ""
 	plugin.Namespace = ""
 	plugin.MaxPages = 0
 	plugin.PeriodMinutes = 0
+	plugin.StateFile = ""
+	plugin.MaxLookbackMinutes = 60
+	if plugin.State != nil {
+		plugin.State.unlock()
+	}
+	plugin.State = nil
 	plugin.PresetName = ""
+	plugin.Warning = ""
+	plugin.Critical = ""
+	plugin.Query = ""
+	plugin.QueryMeasurement = ""
+	plugin.Concurrency = 4
+	plugin.RequestsPerSecond = 0
+	plugin.WarningThreshold = nil
+	plugin.CriticalThreshold = nil
+	plugin.AWSAccountID = ""
+	plugin.AWSRoleArn = ""
+	plugin.AccountIDErr = nil
+	plugin.Regions = []string{}
+	plugin.AWSEndpointURL = ""
+	plugin.OutputFormat = "prometheus"
+	plugin.GraphiteTemplate = ""
+	plugin.OTLPEndpoint = ""
+	plugin.OTLPHeaders = []string{}
+	plugin.AgentAPIURL = "http://127.0.0.1:3031/events"
+	plugin.EventCheckName = "cloudwatch-metrics"
+	plugin.MetricHandlers = []string{}
+	plugin.EntityDimension = ""
+	plugin.EntityNameTemplate = ""
+	plugin.ConfigFile = ""
+	plugin.PresetDir = ""
+	plugin.ListenAddress = ":9106"
+	plugin.ScrapeInterval = 60
+	plugin.ScrapePresets = []string{}
+	plugin.ScrapeTargets = nil
 	plugin.AWSConfig = &config
 }
 
@@ -170,6 +303,61 @@ func TestQueryMapOutput(t *testing.T) {
 	}
 	cleanPluginValues()
 }
+func TestQueryMapPoints(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	cleanPluginValues()
+	d := types.MetricDataQuery{
+		Id:    aws.String("m1"),
+		Label: aws.String("aws_ec2_cpu_utilization_average"),
+		MetricStat: &types.MetricStat{
+			Metric: &types.Metric{
+				Namespace:  aws.String("AWS/EC2"),
+				MetricName: aws.String("CPUUtilization"),
+				Dimensions: []types.Dimension{{Name: aws.String("InstanceId"), Value: aws.String("i-aaa")}},
+			},
+		},
+	}
+	result := types.MetricDataResult{Timestamps: []time.Time{time.Now()}, Values: []float64{1}}
+	q := newMetricQueryMap(d, nil)
+	q.MetricDataResult = result
+	points, err := q.Points()
+	assert.NoError(err)
+	assert.Equal(1, len(points))
+	assert.Equal(1, len(points[0].Tags))
+
+	plugin.AWSAccountID = "123456789012"
+	q = newMetricQueryMap(d, nil)
+	q.MetricDataResult = result
+	points, err = q.Points()
+	assert.NoError(err)
+	assert.Equal(2, len(points[0].Tags))
+	assert.Equal("aws_account_id", points[0].Tags[1].Name)
+	assert.Equal("123456789012", points[0].Tags[1].Value)
+	cleanPluginValues()
+}
+
+func TestNeedsAccountID(t *testing.T) {
+	defer cleanPluginValues()
+	assert := assert.New(t)
+	cleanPluginValues()
+	assert.False(needsAccountID())
+	plugin.AWSRoleArn = "arn:aws:iam::123456789012:role/monitoring"
+	assert.True(needsAccountID())
+	plugin.AWSRoleArn = ""
+
+	plugin.GraphiteTemplate = "aws.{account}.{region}.{metric}"
+	assert.False(needsAccountID())
+	plugin.OutputFormat = "graphite"
+	assert.True(needsAccountID())
+
+	plugin.OutputFormat = eventOutputFormat
+	plugin.EntityDimension = "LoadBalancer"
+	assert.False(needsAccountID())
+	plugin.EntityNameTemplate = "aws-{account}-{LoadBalancer}"
+	assert.True(needsAccountID())
+}
+
 func TestGetMetricData(t *testing.T) {
 	defer quiet()()
 	cleanPluginValues()
@@ -225,6 +413,433 @@ func TestGetMetricData(t *testing.T) {
 	cleanPluginValues()
 }
 
+func TestEvaluateThresholds(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	warning, _ := common.ParseThreshold(">80")
+	critical, _ := common.ParseThreshold(">95")
+	now := time.Now()
+	series := func(lb string, values ...float64) MetricQueryMap {
+		q := MetricQueryMap{
+			Label: "aws_alb_cpu",
+			Dimensions: []types.Dimension{
+				{Name: aws.String("LoadBalancer"), Value: aws.String(lb)},
+			},
+			Warning:  warning,
+			Critical: critical,
+		}
+		for i, v := range values {
+			q.MetricDataResult.Timestamps = append(q.MetricDataResult.Timestamps, now.Add(time.Duration(-i)*time.Minute))
+			q.MetricDataResult.Values = append(q.MetricDataResult.Values, v)
+		}
+		return q
+	}
+	state, summary := evaluateThresholds([]MetricQueryMap{series("a", 10), series("b", 50, 99)})
+	assert.Equal(0, state)
+	assert.Empty(summary)
+	state, summary = evaluateThresholds([]MetricQueryMap{series("a", 85), series("b", 10)})
+	assert.Equal(1, state)
+	assert.Equal(2, len(summary))
+	assert.Contains(summary[1], `LoadBalancer="a"`)
+	state, summary = evaluateThresholds([]MetricQueryMap{series("a", 85), series("b", 99), series("c")})
+	assert.Equal(2, state)
+	assert.Equal(3, len(summary))
+	assert.Contains(summary[1], "CRITICAL")
+	assert.Contains(summary[2], "WARNING")
+}
+
+func TestQueryBatchEnd(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	queries := []types.MetricDataQuery{}
+	for i := 0; i < 6; i++ {
+		queries = append(queries, types.MetricDataQuery{Id: aws.String("m" + strconv.Itoa(i))})
+	}
+	assert.Equal(4, queryBatchEnd(queries, 0, 4))
+	assert.Equal(6, queryBatchEnd(queries, 4, 4))
+	// an expression referencing m2 and m3 must stay in the same batch
+	queries[4].Expression = aws.String("m2 / m3")
+	assert.Equal(2, queryBatchEnd(queries, 0, 4))
+	assert.Equal(6, queryBatchEnd(queries, 2, 4))
+	// a dependency chain larger than the batch size can not be kept together
+	queries[4].Expression = aws.String("m0 / m3")
+	assert.Equal(4, queryBatchEnd(queries, 0, 4))
+}
+
+func TestNewMetricQueryMap(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	cleanPluginValues()
+	dims := []types.Dimension{{Name: aws.String("LoadBalancer"), Value: aws.String("app/a/1")}}
+	errors := types.MetricDataQuery{
+		Id:    aws.String("errors_g0"),
+		Label: aws.String("errors"),
+		MetricStat: &types.MetricStat{
+			Metric: &types.Metric{Namespace: aws.String("AWS/ApplicationELB"), MetricName: aws.String("HTTPCode_Target_5XX_Count"), Dimensions: dims},
+			Period: aws.Int32(300),
+		},
+		ReturnData: aws.Bool(false),
+	}
+	ratio := types.MetricDataQuery{
+		Id:         aws.String("ratio_g0"),
+		Label:      aws.String("ratio"),
+		Expression: aws.String("100 * errors_g0"),
+	}
+	percent := types.MetricDataQuery{
+		Id:         aws.String("percent_g0"),
+		Label:      aws.String("percent"),
+		Expression: aws.String("ratio_g0 / 100"),
+	}
+	queriesById := map[string]types.MetricDataQuery{"errors_g0": errors, "ratio_g0": ratio, "percent_g0": percent}
+	q := newMetricQueryMap(errors, queriesById)
+	assert.Equal("HTTPCode_Target_5XX_Count", q.MetricName)
+	assert.Empty(q.Expression)
+	assert.Equal(int32(300), q.Period)
+	for _, d := range []types.MetricDataQuery{ratio, percent} {
+		q = newMetricQueryMap(d, queriesById)
+		assert.Equal(*d.Expression, q.Expression)
+		assert.Equal(int32(300), q.Period)
+		assert.Empty(q.MetricName)
+		assert.Equal("AWS/ApplicationELB", q.Namespace)
+		assert.Equal(dims, q.Dimensions)
+	}
+	cleanPluginValues()
+}
+
+func TestCheckFunctionExpressions(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	cleanPluginValues()
+	preset := &presets.Preset{}
+	err := preset.SetMeasurementString(`{
+  "namespace": "AWS/test",
+  "measurements": [
+    {"metric": "test", "config": [{"stat": "Sum", "measurement": "aws.test.sum", "id": "total", "return-data": false}]},
+    {"expression": "total * 2", "config": [{"measurement": "aws.test.double", "critical": "<1"}]}
+  ]
+}`)
+	assert.NoError(err)
+	assert.NoError(preset.BuildMeasurementConfig())
+	plugin.Preset = preset
+	plugin.MaxPages = 1
+	nextToken = false
+	state, err := checkFunction(mockService{})
+	assert.NoError(err)
+	assert.Equal(2, state)
+	cleanPluginValues()
+}
+
+func TestCheckFunctionInsights(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	cleanPluginValues()
+	plugin.PresetName = "None"
+	plugin.Query = `SELECT AVG(CPUUtilization) FROM SCHEMA("AWS/EC2", InstanceId) GROUP BY InstanceId`
+	plugin.AWSCredentialsFiles = []string{"./testingdata/credentials"}
+	state, err := checkArgs(nil)
+	assert.NoError(err)
+	assert.Equal(0, state)
+	assert.Equal("Insights", plugin.PresetName)
+	plugin.CriticalThreshold, _ = common.ParseThreshold("<1")
+	listMetricsCalls = 0
+	state, err = checkFunction(mockService{})
+	assert.NoError(err)
+	assert.Equal(2, state)
+	assert.Equal(0, listMetricsCalls)
+
+	queries, err := plugin.Preset.BuildMetricDataQueries(1)
+	assert.NoError(err)
+	insights := newMetricQueryMap(queries[0], map[string]types.MetricDataQuery{})
+	assert.NotNil(insights.Insights)
+	assert.Equal("AWS/EC2", insights.Namespace)
+	input, err := buildGetMetricDataInput(queries, 1)
+	assert.NoError(err)
+	assert.Equal("${PROP('Dim.InstanceId')}", *input.MetricDataQueries[0].Label)
+	assert.Equal("aws_ec2_cpu_utilization_average", *queries[0].Label)
+
+	plugin.PresetName = "EC2"
+	_, err = checkArgs(nil)
+	assert.Error(err)
+	cleanPluginValues()
+}
+
+func TestDiscoverMetrics(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	cleanPluginValues()
+	pages := [][]types.Metric{}
+	for p := 0; p < 3; p++ {
+		page := []types.Metric{}
+		for i := 0; i < 2; i++ {
+			page = append(page, types.Metric{
+				MetricName: aws.String(fmt.Sprintf("metric_%v_%v", p, i)),
+				Namespace:  aws.String("AWS/test"),
+			})
+		}
+		pages = append(pages, page)
+	}
+	client := mockService{pages: pages}
+	cases := []struct {
+		maxPages          int
+		expectedPages     int
+		expectedMetrics   int
+		expectedTruncated bool
+		expectedTokens    []string
+	}{
+		{maxPages: 0, expectedPages: 3, expectedMetrics: 6, expectedTruncated: false, expectedTokens: []string{"", "page-1", "page-2"}},
+		{maxPages: 3, expectedPages: 3, expectedMetrics: 6, expectedTruncated: false, expectedTokens: []string{"", "page-1", "page-2"}},
+		{maxPages: 2, expectedPages: 2, expectedMetrics: 4, expectedTruncated: true, expectedTokens: []string{"", "page-1"}},
+		{maxPages: 1, expectedPages: 1, expectedMetrics: 2, expectedTruncated: true, expectedTokens: []string{""}},
+	}
+	for i, tt := range cases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			listMetricsTokens = []string{}
+			none := &presets.None{}
+			result, err := discoverMetrics(context.TODO(), client, none, tt.maxPages)
+			assert.NoError(err)
+			assert.Equal(tt.expectedPages, result.Pages)
+			assert.Equal(tt.expectedMetrics, result.Metrics)
+			assert.Equal(tt.expectedTruncated, result.Truncated)
+			assert.Equal(tt.expectedTokens, listMetricsTokens)
+			assert.Equal(tt.expectedMetrics, len(none.Metrics))
+			names := map[string]bool{}
+			for _, m := range none.Metrics {
+				names[*m.MetricName] = true
+			}
+			assert.Equal(tt.expectedMetrics, len(names))
+		})
+	}
+	cleanPluginValues()
+}
+
+func TestFetchMetricData(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	queries := []types.MetricDataQuery{
+		{Id: aws.String("a"), Label: aws.String("a")},
+		{Id: aws.String("b"), Label: aws.String("b")},
+	}
+	input, err := buildGetMetricDataInput(queries, 1)
+	assert.NoError(err)
+	results, messages, err := fetchMetricData(context.TODO(), mockService{dataPages: 3, statusCode: types.StatusCodeComplete}, input)
+	assert.NoError(err)
+	assert.Empty(messages)
+	assert.Equal(2, len(results))
+	for _, r := range results {
+		assert.Equal(3, len(r.Timestamps))
+		assert.Equal([]float64{0, 1, 2}, r.Values)
+		assert.Equal(types.StatusCodeComplete, r.StatusCode)
+	}
+	results, _, err = fetchMetricData(context.TODO(), mockService{dataPages: 2, statusCode: types.StatusCodeInternalError}, input)
+	assert.NoError(err)
+	assert.Equal(types.StatusCodeInternalError, results[0].StatusCode)
+}
+
+func TestGetDataBatches(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	cleanPluginValues()
+	queries := []types.MetricDataQuery{}
+	for i := 0; i < 1001; i++ {
+		queries = append(queries, types.MetricDataQuery{
+			Id:    aws.String(fmt.Sprintf("m%v", i)),
+			Label: aws.String("test"),
+			MetricStat: &types.MetricStat{
+				Metric: &types.Metric{Namespace: aws.String("AWS/test"), MetricName: aws.String("test")},
+				Period: aws.Int32(60),
+				Stat:   aws.String("Sum"),
+			},
+		})
+	}
+	cases := []struct {
+		client        mockService
+		expectedState int
+	}{
+		{client: mockService{}, expectedState: 0},
+		{client: mockService{dataPages: 2, statusCode: types.StatusCodeComplete}, expectedState: 0},
+		{client: mockService{dataPages: 2, statusCode: types.StatusCodeInternalError}, expectedState: 1},
+		{client: mockService{dataPages: 2, statusCode: types.StatusCodePartialData}, expectedState: 1},
+	}
+	for i, tt := range cases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			getMetricDataBatches = []int{}
+			result := &regionResult{}
+			getData(tt.client, &presets.Preset{}, queries, 1, result)
+			assert.Equal(1001, len(result.Queries))
+			assert.Empty(result.Unused)
+			state, err := reportRegions([]*regionResult{result})
+			assert.NoError(err)
+			assert.Equal(tt.expectedState, state)
+			assert.ElementsMatch([]int{500, 500, 1}, getMetricDataBatches)
+		})
+	}
+	cleanPluginValues()
+}
+
+func TestCheckRegions(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	cleanPluginValues()
+	plugin.PresetName = "None"
+	plugin.MetricName = "test"
+	plugin.Namespace = "test"
+	plugin.StatsList = []string{"Average"}
+	none := &presets.None{}
+	none.AddStats(plugin.StatsList)
+	plugin.Preset = none
+
+	regions := []regionClient{{Region: "us-east-1", Client: mockService{}}, {Region: "eu-west-1", Client: mockService{}}}
+	state, err := checkRegions(regions)
+	assert.NoError(err)
+	assert.Equal(0, state)
+	// every region discovers metrics with its own copy of the preset
+	assert.Empty(none.Metrics)
+
+	// a failed account id lookup leaves the points untagged with a warning
+	plugin.AccountIDErr = fmt.Errorf("access denied")
+	state, err = checkRegions(regions)
+	assert.NoError(err)
+	assert.Equal(1, state)
+	plugin.AccountIDErr = nil
+
+	regions[1].Client = mockService{dataErr: fmt.Errorf("throttled")}
+	state, err = checkRegions(regions)
+	assert.NoError(err)
+	assert.Equal(2, state)
+
+	result := collectRegion(context.TODO(), regions[0], none.Clone())
+	assert.Equal(0, result.State)
+	points, err := queryPoints(result.Queries)
+	assert.NoError(err)
+	assert.NotEmpty(points)
+	for _, p := range points {
+		assert.Equal("aws_region", p.Tags[len(p.Tags)-1].Name)
+		assert.Equal("us-east-1", p.Tags[len(p.Tags)-1].Value)
+	}
+	result = collectRegion(context.TODO(), regions[1], none.Clone())
+	assert.Equal(2, result.State)
+	assert.Equal([]string{"Error: region eu-west-1: Could not get metrics: throttled"}, result.Problems)
+	result = collectRegion(context.TODO(), regionClient{Client: mockService{}}, none.Clone())
+	points, err = queryPoints(result.Queries)
+	assert.NoError(err)
+	assert.NotEmpty(points)
+	for _, p := range points {
+		for _, tag := range p.Tags {
+			assert.NotEqual("aws_region", tag.Name)
+		}
+	}
+	cleanPluginValues()
+}
+
+func TestResolveRegions(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	cleanPluginValues()
+	defer func(f func(context.Context, aws.Config) ([]string, error)) { enabledRegions = f }(enabledRegions)
+	enabledRegions = func(context.Context, aws.Config) ([]string, error) {
+		return []string{"eu-west-1", "us-east-1"}, nil
+	}
+	alb := presets.Presets["ALB"]
+	regions, err := resolveRegions(context.TODO(), alb, []string{"us-west-2", "ap-southeast-2"})
+	assert.NoError(err)
+	assert.Equal([]string{"us-west-2", "ap-southeast-2"}, regions)
+	regions, err = resolveRegions(context.TODO(), alb, []string{allEnabledRegions})
+	assert.NoError(err)
+	assert.Equal([]string{"eu-west-1", "us-east-1"}, regions)
+	// presets with a required region only run in that region
+	for _, list := range [][]string{{"us-west-2", "ap-southeast-2"}, {allEnabledRegions}} {
+		regions, err = resolveRegions(context.TODO(), presets.Presets["CloudFront"], list)
+		assert.NoError(err)
+		assert.Equal([]string{"us-east-1"}, regions)
+	}
+	cleanPluginValues()
+}
+
+// barrierService holds every GetMetricData call until want calls are in flight, so the peak concurrency reaches
+// the limit whatever the goroutine scheduling. Calls go on after a second, failing the test rather than hanging it.
+type barrierService struct {
+	mockService
+	want     int
+	mu       sync.Mutex
+	inFlight int
+	peak     int
+	reached  chan struct{}
+}
+
+func newBarrierService(want int) *barrierService {
+	return &barrierService{want: want, reached: make(chan struct{})}
+}
+
+func (b *barrierService) GetMetricData(ctx context.Context,
+	params *cloudwatch.GetMetricDataInput,
+	optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error) {
+	b.mu.Lock()
+	b.inFlight++
+	if b.inFlight > b.peak {
+		b.peak = b.inFlight
+		if b.peak == b.want {
+			close(b.reached)
+		}
+	}
+	b.mu.Unlock()
+	select {
+	case <-b.reached:
+	case <-time.After(time.Second):
+	}
+	defer func() {
+		b.mu.Lock()
+		b.inFlight--
+		b.mu.Unlock()
+	}()
+	return b.mockService.GetMetricData(ctx, params, optFns...)
+}
+
+func TestFetchBatches(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	inputs := []*cloudwatch.GetMetricDataInput{}
+	for k := 0; k < 10; k++ {
+		input, err := buildGetMetricDataInput([]types.MetricDataQuery{{Id: aws.String(fmt.Sprintf("b%v", k)), Label: aws.String("test")}}, 1)
+		assert.NoError(err)
+		inputs = append(inputs, input)
+	}
+	for _, concurrency := range []int{0, 1, 3, 20} {
+		limit := concurrency
+		if limit < 1 {
+			limit = 1
+		}
+		if limit > len(inputs) {
+			limit = len(inputs)
+		}
+		client := newBarrierService(limit)
+		fetched := fetchBatches(context.TODO(), client, inputs, concurrency)
+		assert.Equal(len(inputs), len(fetched))
+		for k, f := range fetched {
+			assert.NoError(f.Err)
+			assert.Equal(fmt.Sprintf("b%v", k), *f.Results[0].Id)
+		}
+		// the batches are requested concurrently up to the limit, and never beyond it
+		assert.Equal(limit, client.peak, "concurrency %v", concurrency)
+	}
+}
+
+func TestRateLimitedClient(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	client := mockService{}
+	assert.Equal(client, newRateLimitedClient(client, 0))
+	limited := newRateLimitedClient(client, 200)
+	start := time.Now()
+	for k := 0; k < 3; k++ {
+		_, err := limited.GetMetricData(context.TODO(), &cloudwatch.GetMetricDataInput{})
+		assert.NoError(err)
+		_, err = limited.ListMetrics(context.TODO(), &cloudwatch.ListMetricsInput{})
+		assert.NoError(err)
+	}
+	// six requests spaced 5ms apart
+	assert.True(time.Since(start) >= 25*time.Millisecond)
+}
+
 /* TODO: setup json config
 func TestBuildMetricConfig(t *testing.T) {
 	assert := assert.New(t)
@@ -250,6 +865,8 @@ func TestToSnakeCase(t *testing.T) {
 		{"BatteryLifeValue", "battery_life_value"},
 		{"Id0Value", "id0_value"},
 		{"ID0Value", "id0_value"},
+		{"_Leading", "__leading"},
+		{"Trailing_", "trailing_"},
 	}
 	for _, test := range tests {
 		have := common.ToSnakeCase(test.input)
@@ -258,6 +875,22 @@ func TestToSnakeCase(t *testing.T) {
 		}
 	}
 }
+func TestReadEvent(t *testing.T) {
+	assert := assert.New(t)
+	data, err := json.Marshal(v2.FixtureEvent("webserver01", "cloudwatch"))
+	assert.NoError(err)
+	event, err := readEvent(bytes.NewReader(data))
+	assert.NoError(err)
+	assert.Equal("webserver01", event.Entity.Name)
+
+	for _, input := range []string{"", "not an event", "{}"} {
+		_, err = readEvent(strings.NewReader(input))
+		if assert.Error(err, input) {
+			assert.True(strings.HasPrefix(err.Error(), "--event-stdin: invalid Sensu event: "), err.Error())
+		}
+	}
+}
+
 func TestCheckArgs(t *testing.T) {
 	defer quiet()()
 	assert := assert.New(t)
@@ -300,6 +933,177 @@ func TestCheckArgs(t *testing.T) {
 		assert.Error(err)
 		assert.Equal(state, 1)
 	})
+	plugin.DimensionFilterStrings = []string{"InstanceId={{ .Entity.Labels.aws_instance_id }}"}
+	t.Run("CheckArgs", func(t *testing.T) {
+		state, err := checkArgs(nil)
+		assert.Error(err)
+		assert.Equal(state, 1)
+	})
+	event := v2.FixtureEvent("webserver01", "cloudwatch")
+	event.Entity.Labels = map[string]string{"aws_instance_id": "i-0123456789abcdef0"}
+	t.Run("CheckArgs", func(t *testing.T) {
+		state, err := checkArgs(event)
+		assert.NoError(err)
+		assert.Equal(state, 0)
+		assert.Equal(1, len(plugin.DimensionFilters))
+		assert.Equal("i-0123456789abcdef0", aws.ToString(plugin.DimensionFilters[0].Value))
+	})
+	plugin.DimensionFilterStrings = []string{}
+	plugin.Critical = ">ninety"
+	t.Run("CheckArgs", func(t *testing.T) {
+		state, err := checkArgs(nil)
+		assert.Error(err)
+		assert.Equal(state, 1)
+	})
+	plugin.Critical = ""
+	plugin.StatsList = []string{"Average", "p99.9", "Avg"}
+	t.Run("CheckArgs", func(t *testing.T) {
+		state, err := checkArgs(nil)
+		assert.Error(err)
+		assert.Equal(state, 1)
+	})
+	plugin.StatsList = []string{}
+	plugin.Regions = []string{" us-east-1", "eu-west-1", "us-east-1 ", ""}
+	t.Run("CheckArgs", func(t *testing.T) {
+		state, err := checkArgs(nil)
+		assert.NoError(err)
+		assert.Equal(state, 0)
+		assert.Equal([]string{"us-east-1", "eu-west-1"}, plugin.Regions)
+	})
+	plugin.Regions = []string{"all-enabled", "eu-west-1"}
+	t.Run("CheckArgs", func(t *testing.T) {
+		state, err := checkArgs(nil)
+		assert.Error(err)
+		assert.Equal(state, 1)
+	})
+	plugin.Regions = []string{}
+	plugin.OutputFormat = "xml"
+	t.Run("CheckArgs", func(t *testing.T) {
+		state, err := checkArgs(nil)
+		assert.Error(err)
+		assert.Equal(state, 1)
+	})
+	plugin.OutputFormat = "graphite"
+	plugin.GraphiteTemplate = "aws.{region.{metric}"
+	t.Run("CheckArgs", func(t *testing.T) {
+		state, err := checkArgs(nil)
+		assert.Error(err)
+		assert.Equal(state, 1)
+	})
+	plugin.GraphiteTemplate = ""
+	plugin.OTLPEndpoint = "http://localhost:4318/v1/metrics"
+	t.Run("CheckArgs", func(t *testing.T) {
+		state, err := checkArgs(nil)
+		assert.Error(err)
+		assert.Equal(state, 1)
+	})
+	plugin.OutputFormat = "otlp"
+	plugin.OTLPHeaders = []string{"Authorization"}
+	t.Run("CheckArgs", func(t *testing.T) {
+		state, err := checkArgs(nil)
+		assert.Error(err)
+		assert.Equal(state, 1)
+	})
+	plugin.OTLPEndpoint = ""
+	plugin.OTLPHeaders = []string{}
+	plugin.OutputFormat = "event"
+	plugin.EventCheckName = "cloudwatch metrics"
+	t.Run("CheckArgs", func(t *testing.T) {
+		state, err := checkArgs(nil)
+		assert.Error(err)
+		assert.Equal(state, 1)
+	})
+	plugin.EventCheckName = "cloudwatch-metrics"
+	plugin.AgentAPIURL = "127.0.0.1:3031"
+	t.Run("CheckArgs", func(t *testing.T) {
+		state, err := checkArgs(nil)
+		assert.Error(err)
+		assert.Equal(state, 1)
+	})
+	plugin.AgentAPIURL = "http://127.0.0.1:3031/events"
+	plugin.EntityNameTemplate = "aws-{region}-{LoadBalancer"
+	plugin.EntityDimension = "LoadBalancer"
+	t.Run("CheckArgs", func(t *testing.T) {
+		state, err := checkArgs(nil)
+		assert.Error(err)
+		assert.Equal(state, 1)
+	})
+	plugin.EntityDimension = ""
+	plugin.EntityNameTemplate = "aws-{region}-{LoadBalancer}"
+	t.Run("CheckArgs", func(t *testing.T) {
+		state, err := checkArgs(nil)
+		assert.Error(err)
+		assert.Equal(state, 1)
+	})
+	plugin.OutputFormat = "influx"
+	plugin.EntityDimension = "LoadBalancer"
+	t.Run("CheckArgs", func(t *testing.T) {
+		state, err := checkArgs(nil)
+		assert.Error(err)
+		assert.Equal(state, 1)
+	})
+	plugin.EntityDimension = ""
+	plugin.EntityNameTemplate = ""
+	plugin.AWSEndpointURL = "localhost:4566"
+	t.Run("CheckArgs", func(t *testing.T) {
+		state, err := checkArgs(nil)
+		assert.Error(err)
+		assert.Equal(state, 2)
+	})
+	plugin.AWSEndpointURL = ""
+	plugin.PresetName = "None"
+	plugin.ConfigString = `{"namespace": "AWS/EC2", "endpoint-url": "http://localhost:4566", "measurements": [{"metric": "CPUUtilization", "config": [{"stat": "Average", "measurement": "cpu"}]}]}`
+	t.Run("CheckArgs", func(t *testing.T) {
+		state, err := checkArgs(nil)
+		assert.NoError(err)
+		assert.Equal(state, 0)
+		assert.Equal("http://localhost:4566", plugin.AWSEndpointURL)
+	})
+	plugin.PresetName = "None"
+	plugin.ConfigString = `{"namespace": "AWS/EC2", "measurements": [{"metric": "CPUUtilization", "config": [{"stat": "Avg", "measurement": "cpu"}]}]}`
+	t.Run("CheckArgs", func(t *testing.T) {
+		state, err := checkArgs(nil)
+		assert.EqualError(err, `--config:1:92: measurements[0].config[0].stat: invalid statistic "Avg", see https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/Statistics-definitions.html`)
+		assert.Equal(state, 1)
+	})
+	cleanPluginValues()
+	plugin.AWSCredentialsFiles = []string{"./testingdata/credentials"}
+	dir := t.TempDir()
+	config := "namespace: AWS/RDS\nmeasurements:\n  - metric: CPUUtilization\n    config:\n      - stat: Average\n        measurement: aws.rds.cpu_utilization.average\n"
+	assert.NoError(os.WriteFile(filepath.Join(dir, "rds.yaml"), []byte(config), 0644))
+	plugin.PresetName = "None"
+	plugin.ConfigFile = filepath.Join(dir, "rds.yaml")
+	t.Run("CheckArgs", func(t *testing.T) {
+		state, err := checkArgs(nil)
+		assert.NoError(err)
+		assert.Equal(state, 0)
+		assert.Equal("AWS/RDS", plugin.Preset.GetNamespace())
+		// the config file is not read into the --config option
+		assert.Empty(plugin.ConfigString)
+	})
+	plugin.PresetName = "None"
+	plugin.ConfigFile = filepath.Join(dir, "missing.yaml")
+	t.Run("CheckArgs", func(t *testing.T) {
+		state, err := checkArgs(nil)
+		assert.Error(err)
+		assert.Equal(state, 1)
+	})
+	plugin.ConfigFile = ""
+	plugin.PresetDir = dir
+	plugin.PresetName = "rds"
+	t.Run("CheckArgs", func(t *testing.T) {
+		defer delete(presets.Presets, "rds")
+		state, err := checkArgs(nil)
+		assert.NoError(err)
+		assert.Equal(state, 0)
+		assert.IsType(&presets.File{}, plugin.Preset)
+	})
+	plugin.PresetDir = filepath.Join(dir, "missing")
+	t.Run("CheckArgs", func(t *testing.T) {
+		state, err := checkArgs(nil)
+		assert.Error(err)
+		assert.Equal(state, 1)
+	})
 	cleanPluginValues()
 }
 
@@ -322,6 +1126,8 @@ func TestCheckFunction(t *testing.T) {
 		nextToken       bool
 		maxPages        int
 		includeMessages bool
+		warning         string
+		critical        string
 		expectedId      string
 	}{ //start of array
 		{ //start of struct
@@ -348,6 +1154,25 @@ func TestCheckFunction(t *testing.T) {
 			includeMessages: true,
 			expectedId:      "test",
 		},
+		{ //start of struct
+			client:          mockService{},
+			maxPages:        2,
+			nextToken:       true,
+			expectedState:   2,
+			includeMessages: false,
+			critical:        "<1",
+			expectedId:      "test",
+		},
+		{ //start of struct
+			client:          mockService{},
+			maxPages:        2,
+			nextToken:       true,
+			expectedState:   1,
+			includeMessages: false,
+			warning:         "==0",
+			critical:        "<0",
+			expectedId:      "test",
+		},
 	}
 	for i, tt := range cases {
 		t.Run("CheckFunction Run: "+strconv.Itoa(i), func(t *testing.T) {
@@ -356,6 +1181,8 @@ func TestCheckFunction(t *testing.T) {
 			client.dataResultId = tt.expectedId
 			nextToken = tt.nextToken
 			plugin.MaxPages = tt.maxPages
+			plugin.WarningThreshold, _ = common.ParseThreshold(tt.warning)
+			plugin.CriticalThreshold, _ = common.ParseThreshold(tt.critical)
 			fmt.Printf("plugin:: %+v\n", plugin)
 			state, err := checkFunction(client)
 			if err != nil {
@@ -370,6 +1197,34 @@ func TestCheckFunction(t *testing.T) {
 	cleanPluginValues()
 }
 
+func TestDataMessagesOutput(t *testing.T) {
+	defer cleanPluginValues()
+	assert := assert.New(t)
+	cleanPluginValues()
+	none := presets.None{}
+	none.AddStats([]string{"Average"})
+	plugin.Preset = &none
+	plugin.MetricName = "test"
+	plugin.Namespace = "test"
+	plugin.MaxPages = 2
+	plugin.OutputFormat = "json"
+	nextToken = true
+
+	// the data messages are problems of the report, stdout only holds the JSON document
+	r, w, err := os.Pipe()
+	assert.NoError(err)
+	stdout := os.Stdout
+	os.Stdout = w
+	state, err := checkFunction(mockService{includeMessages: true, dataResultId: "test"})
+	os.Stdout = stdout
+	w.Close()
+	assert.NoError(err)
+	assert.Equal(1, state)
+	doc := jsonReport{}
+	assert.NoError(json.NewDecoder(r).Decode(&doc))
+	assert.Contains(doc.Problems, "GetMetricData:: Code: 400 Message: test message")
+}
+
 func TestCheckFunctionDryRun(t *testing.T) {
 	defer quiet()()
 	cleanPluginValues()
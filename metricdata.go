@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/sensu/sensu-cloudwatch-check/common"
+)
+
+// fetchMetricData follows the GetMetricData NextToken through every result page, merging the partial
+// results of each series. Series are keyed by Id and Label, as Metrics Insights queries return several
+// series for a single query Id.
+func fetchMetricData(ctx context.Context, client ServiceAPI, input *cloudwatch.GetMetricDataInput) ([]types.MetricDataResult, []types.MessageData, error) {
+	results := []types.MetricDataResult{}
+	messages := []types.MessageData{}
+	index := make(map[string]int)
+	paginator := cloudwatch.NewGetMetricDataPaginator(client, input, func(o *cloudwatch.GetMetricDataPaginatorOptions) {
+		o.StopOnDuplicateToken = true
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		messages = append(messages, page.Messages...)
+		for _, d := range page.MetricDataResults {
+			key := aws.ToString(d.Id) + "\x00" + aws.ToString(d.Label)
+			i, ok := index[key]
+			if !ok {
+				index[key] = len(results)
+				results = append(results, d)
+				continue
+			}
+			merged := &results[i]
+			merged.Timestamps = append(merged.Timestamps, d.Timestamps...)
+			merged.Values = append(merged.Values, d.Values...)
+			merged.Messages = append(merged.Messages, d.Messages...)
+			// an internal error on any page taints the whole series
+			if merged.StatusCode != types.StatusCodeInternalError {
+				merged.StatusCode = d.StatusCode
+			}
+		}
+	}
+	return results, messages, nil
+}
+
+// resultStatusWarning describes a series CloudWatch could not return completely, if any
+func resultStatusWarning(q MetricQueryMap) string {
+	switch q.MetricDataResult.StatusCode {
+	case types.StatusCodeInternalError:
+		return fmt.Sprintf("GetMetricData:: Status: %v for %v{%v}", q.MetricDataResult.StatusCode, q.Label, common.DimString(q.Dimensions))
+	case types.StatusCodePartialData:
+		return fmt.Sprintf("GetMetricData:: Status: %v for %v{%v}, not all datapoints were returned", q.MetricDataResult.StatusCode, q.Label, common.DimString(q.Dimensions))
+	}
+	return ""
+}
+
+// batchResult holds the merged GetMetricData results of a single batch of data queries
+type batchResult struct {
+	Results  []types.MetricDataResult
+	Messages []types.MessageData
+	Err      error
+}
+
+// fetchBatches runs fetchMetricData for every batch input on a pool of at most concurrency workers.
+// The results are returned in input order so the output does not depend on the concurrency.
+func fetchBatches(ctx context.Context, client ServiceAPI, inputs []*cloudwatch.GetMetricDataInput, concurrency int) []batchResult {
+	fetched := make([]batchResult, len(inputs))
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > len(inputs) {
+		concurrency = len(inputs)
+	}
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range work {
+				results, messages, err := fetchMetricData(ctx, client, inputs[k])
+				fetched[k] = batchResult{Results: results, Messages: messages, Err: err}
+			}
+		}()
+	}
+	for k := range inputs {
+		work <- k
+	}
+	close(work)
+	wg.Wait()
+	return fetched
+}
+
+// rateLimitedClient waits on the rate limiter before every CloudWatch API request, including each result page
+type rateLimitedClient struct {
+	ServiceAPI
+	limiter *common.RateLimiter
+}
+
+// newRateLimitedClient wraps the client to make at most perSecond requests per second, a zero value disables the limit
+func newRateLimitedClient(client ServiceAPI, perSecond float64) ServiceAPI {
+	limiter := common.NewRateLimiter(perSecond)
+	if limiter == nil {
+		return client
+	}
+	return rateLimitedClient{ServiceAPI: client, limiter: limiter}
+}
+
+func (c rateLimitedClient) ListMetrics(ctx context.Context,
+	params *cloudwatch.ListMetricsInput,
+	optFns ...func(*cloudwatch.Options)) (*cloudwatch.ListMetricsOutput, error) {
+	if err := c.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.ServiceAPI.ListMetrics(ctx, params, optFns...)
+}
+
+func (c rateLimitedClient) GetMetricData(ctx context.Context,
+	params *cloudwatch.GetMetricDataInput,
+	optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error) {
+	if err := c.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.ServiceAPI.GetMetricData(ctx, params, optFns...)
+}
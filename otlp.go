@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// otlpOutputFormat converts the results to OTLP metrics JSON, printed or POSTed to the --otlp-endpoint
+const otlpOutputFormat = "otlp"
+
+// OTLP units for CloudWatch units, following the UCUM case sensitive codes OpenTelemetry uses
+var otlpUnits = map[string]string{
+	"Seconds":          "s",
+	"Milliseconds":     "ms",
+	"Microseconds":     "us",
+	"Bytes":            "By",
+	"Kilobytes":        "kBy",
+	"Megabytes":        "MBy",
+	"Gigabytes":        "GBy",
+	"Terabytes":        "TBy",
+	"Bits":             "bit",
+	"Kilobits":         "kbit",
+	"Megabits":         "Mbit",
+	"Gigabits":         "Gbit",
+	"Terabits":         "Tbit",
+	"Percent":          "%",
+	"Count":            "1",
+	"Bytes/Second":     "By/s",
+	"Kilobytes/Second": "kBy/s",
+	"Megabytes/Second": "MBy/s",
+	"Gigabytes/Second": "GBy/s",
+	"Terabytes/Second": "TBy/s",
+	"Bits/Second":      "bit/s",
+	"Kilobits/Second":  "kbit/s",
+	"Megabits/Second":  "Mbit/s",
+	"Gigabits/Second":  "Gbit/s",
+	"Terabits/Second":  "Tbit/s",
+	"Count/Second":     "1/s",
+}
+
+// OTLP metrics JSON, see:
+//  https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/metrics/v1/metrics.proto
+type otlpMetricsData struct {
+	ResourceMetrics []*otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope     `json:"scope"`
+	Metrics []*otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpMetric struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Unit        string    `json:"unit,omitempty"`
+	Gauge       otlpGauge `json:"gauge"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+	// 64 bit integers are strings in the protobuf JSON mapping
+	TimeUnixNano string  `json:"timeUnixNano"`
+	AsDouble     float64 `json:"asDouble"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func otlpAttribute(key string, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: value}}
+}
+
+// otlpResourceAttributes describes the cloud account and region the CloudWatch metrics of the query come from
+func (q MetricQueryMap) otlpResourceAttributes() []otlpKeyValue {
+	attributes := []otlpKeyValue{otlpAttribute("cloud.provider", "aws")}
+	if region := q.awsRegion(); len(region) > 0 {
+		attributes = append(attributes, otlpAttribute("cloud.region", region))
+	}
+	if len(q.AccountId) > 0 {
+		attributes = append(attributes, otlpAttribute("cloud.account.id", q.AccountId))
+	}
+	return attributes
+}
+
+// newOTLPMetrics converts the queries to gauges, with one resource per region and account. Queries sharing
+// a measurement name become the data points of a single gauge, told apart by their dimension attributes.
+// It returns the number of data points, NaN and infinite values are left out.
+func newOTLPMetrics(queries []MetricQueryMap) (otlpMetricsData, int) {
+	data := otlpMetricsData{ResourceMetrics: []*otlpResourceMetrics{}}
+	resources := make(map[string]*otlpResourceMetrics)
+	metrics := make(map[string]*otlpMetric)
+	count := 0
+	for _, q := range queries {
+		resourceKey := q.awsRegion() + "\x00" + q.AccountId
+		resource, ok := resources[resourceKey]
+		if !ok {
+			resource = &otlpResourceMetrics{
+				Resource:     otlpResource{Attributes: q.otlpResourceAttributes()},
+				ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: plugin.Name}, Metrics: []*otlpMetric{}}},
+			}
+			resources[resourceKey] = resource
+			data.ResourceMetrics = append(data.ResourceMetrics, resource)
+		}
+		metricKey := resourceKey + "\x00" + q.Label
+		m, ok := metrics[metricKey]
+		if !ok {
+			m = &otlpMetric{Name: q.Label, Unit: otlpUnits[q.Unit], Gauge: otlpGauge{DataPoints: []otlpNumberDataPoint{}}}
+			if len(q.Expression) > 0 {
+				m.Description = fmt.Sprintf("Namespace:%v Expression:%v", q.Namespace, q.Expression)
+			} else {
+				m.Description = fmt.Sprintf("Namespace:%v MetricName:%v", q.Namespace, q.MetricName)
+			}
+			metrics[metricKey] = m
+			resource.ScopeMetrics[0].Metrics = append(resource.ScopeMetrics[0].Metrics, m)
+		}
+		attributes := []otlpKeyValue{}
+		for _, d := range q.Dimensions {
+			attributes = append(attributes, otlpAttribute(aws.ToString(d.Name), aws.ToString(d.Value)))
+		}
+		for i, ts := range q.MetricDataResult.Timestamps {
+			if i >= len(q.MetricDataResult.Values) {
+				break
+			}
+			value := q.MetricDataResult.Values[i]
+			// JSON has no representation for NaN and infinite values
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+			m.Gauge.DataPoints = append(m.Gauge.DataPoints, otlpNumberDataPoint{
+				Attributes:   attributes,
+				TimeUnixNano: strconv.FormatInt(ts.UnixNano(), 10),
+				AsDouble:     value,
+			})
+			count++
+		}
+	}
+	return data, count
+}
+
+// reportOTLP prints the results as a single OTLP metrics JSON document. With an --otlp-endpoint the metrics
+// are POSTed instead, and the check output keeps the comment lines describing the problems found.
+func reportOTLP(w io.Writer, report checkReport) error {
+	data, count := newOTLPMetrics(report.Queries)
+	if len(plugin.OTLPEndpoint) == 0 {
+		return json.NewEncoder(w).Encode(data)
+	}
+	if err := postJSON(context.Background(), plugin.OTLPEndpoint, plugin.OTLPHeaders, data); err != nil {
+		return fmt.Errorf("OTLP export failed: %v", err)
+	}
+	for _, line := range append(report.Problems, report.Summary...) {
+		if _, err := fmt.Fprintf(w, "# %v\n", line); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "# Exported %v datapoints to %v\n", count, plugin.OTLPEndpoint)
+	return err
+}
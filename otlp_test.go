@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewOTLPMetrics(t *testing.T) {
+	defer quiet()()
+	defer cleanPluginValues()
+	assert := assert.New(t)
+	plugin.AWSConfig.Region = "us-east-1"
+	queries := outputTestQueries()
+	queries[0].Unit = "Count"
+	queries[0].AccountId = "123456789012"
+	queries[0].Namespace = "AWS/ApplicationELB"
+	queries[0].MetricName = "RequestCount"
+	queries[2].Unit = "Seconds"
+	// a second series of the same measurement in the same region and account
+	other := queries[0]
+	other.Dimensions = other.Dimensions[1:]
+	queries = append(queries, other)
+
+	data, count := newOTLPMetrics(queries)
+	assert.Equal(6, count)
+	assert.Equal(2, len(data.ResourceMetrics))
+
+	resource := data.ResourceMetrics[0]
+	assert.Equal([]otlpKeyValue{
+		otlpAttribute("cloud.provider", "aws"),
+		otlpAttribute("cloud.region", "eu-west-1"),
+		otlpAttribute("cloud.account.id", "123456789012"),
+	}, resource.Resource.Attributes)
+	assert.Equal(1, len(resource.ScopeMetrics))
+	assert.Equal("sensu-cloudwatch-check", resource.ScopeMetrics[0].Scope.Name)
+	metrics := resource.ScopeMetrics[0].Metrics
+	assert.Equal(1, len(metrics))
+	assert.Equal("aws_alb_request_count_sum", metrics[0].Name)
+	assert.Equal("Namespace:AWS/ApplicationELB MetricName:RequestCount", metrics[0].Description)
+	assert.Equal("1", metrics[0].Unit)
+	points := metrics[0].Gauge.DataPoints
+	assert.Equal(4, len(points))
+	assert.Equal("1651185600000000000", points[0].TimeUnixNano)
+	assert.Equal(42.0, points[0].AsDouble)
+	assert.Equal([]otlpKeyValue{
+		otlpAttribute("TargetGroup", "targetgroup/my tg/456"),
+		otlpAttribute("LoadBalancer", "app/my-lb/123"),
+	}, points[0].Attributes)
+	assert.Equal("1651185540000000000", points[1].TimeUnixNano)
+	assert.Equal([]otlpKeyValue{otlpAttribute("LoadBalancer", "app/my-lb/123")}, points[2].Attributes)
+
+	// the region of the AWS config is used for queries without one, NaN values are left out
+	resource = data.ResourceMetrics[1]
+	assert.Equal([]otlpKeyValue{
+		otlpAttribute("cloud.provider", "aws"),
+		otlpAttribute("cloud.region", "us-east-1"),
+	}, resource.Resource.Attributes)
+	metrics = resource.ScopeMetrics[0].Metrics
+	assert.Equal(2, len(metrics))
+	assert.Equal("aws_alb_target_5xx_ratio", metrics[0].Name)
+	assert.Equal("Namespace: Expression:100 * errors / requests", metrics[0].Description)
+	assert.Equal(1, len(metrics[0].Gauge.DataPoints))
+	assert.Empty(metrics[0].Gauge.DataPoints[0].Attributes)
+	assert.Equal("s", metrics[1].Unit)
+}
+
+func TestReportOTLP(t *testing.T) {
+	defer quiet()()
+	defer cleanPluginValues()
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	assert.NoError(reportOTLP(&buf, checkReport{Problems: []string{"Warning: something"}, Queries: outputTestQueries()}))
+	assert.Equal(1, strings.Count(buf.String(), "\n"))
+	assert.NotContains(buf.String(), "Warning: something")
+	var data otlpMetricsData
+	assert.NoError(json.Unmarshal(buf.Bytes(), &data))
+	assert.Equal(2, len(data.ResourceMetrics))
+
+	var received otlpMetricsData
+	var headers http.Header
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal("/v1/metrics", r.URL.Path)
+		assert.Equal(http.MethodPost, r.Method)
+		assert.NoError(json.Unmarshal(body, &received))
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	plugin.OTLPEndpoint = server.URL + "/v1/metrics"
+	plugin.OTLPHeaders = []string{"Authorization=Bearer token", "X-Scope-OrgID = team-a"}
+	buf.Reset()
+	assert.NoError(reportOTLP(&buf, checkReport{Problems: []string{"Warning: something"}, Summary: []string{"Thresholds breached: 1 critical, 0 warning"}, Queries: outputTestQueries()}))
+	assert.Equal("application/json", headers.Get("Content-Type"))
+	assert.Equal("Bearer token", headers.Get("Authorization"))
+	assert.Equal("team-a", headers.Get("X-Scope-OrgID"))
+	assert.Equal(data, received)
+	assert.Equal("# Warning: something\n# Thresholds breached: 1 critical, 0 warning\n# Exported 4 datapoints to "+plugin.OTLPEndpoint+"\n", buf.String())
+
+	status = http.StatusBadRequest
+	buf.Reset()
+	err := reportOTLP(&buf, checkReport{Queries: outputTestQueries()})
+	assert.Error(err)
+	assert.Contains(err.Error(), "400 Bad Request")
+	assert.Equal("", buf.String())
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/sensu/sensu-cloudwatch-check/common"
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/sensu/sensu-plugin-sdk/sensu/metric"
+)
+
+// outputWriter writes the datapoints of the result queries in a specific metrics format
+type outputWriter func(w io.Writer, queries []MetricQueryMap) error
+
+// outputFormats maps the --output-format values to their writers
+var outputFormats = map[string]outputWriter{
+	"prometheus": writePrometheus,
+	"influx":     writeInflux,
+	"graphite":   writeGraphite,
+}
+
+// postTimeout limits the time taken by POSTs of output formats sending the results to an endpoint
+var postTimeout = 10 * time.Second
+
+// checkReport is the whole check result, for output formats replacing the comment lines of the check output
+type checkReport struct {
+	State int
+	// Summary is the threshold summary, the first line counts the breaching series and the next lines name them
+	Summary  []string
+	Problems []string
+	Queries  []MetricQueryMap
+}
+
+// reportWriter writes the whole check result in a specific output format
+type reportWriter func(w io.Writer, report checkReport) error
+
+// reportFormats maps the --output-format values printing the whole check result to their writers
+var reportFormats = map[string]reportWriter{
+	"nagios": reportNagios,
+	"json":   reportJSON,
+	"otlp":   reportOTLP,
+	"event":  reportEvent,
+}
+
+// defaultGraphiteTemplate is used when neither --graphite-template nor the preset set a Graphite path template
+const defaultGraphiteTemplate = "{namespace}.{dimensions}.{metric}.{stat}"
+
+var (
+	// Nagios units of measurement for CloudWatch units, units without a Nagios equivalent such as Count have none
+	nagiosUnits = map[string]string{
+		"Seconds":      "s",
+		"Milliseconds": "ms",
+		"Microseconds": "us",
+		"Percent":      "%",
+		"Bytes":        "B",
+		"Kilobytes":    "KB",
+		"Megabytes":    "MB",
+		"Gigabytes":    "GB",
+		"Terabytes":    "TB",
+	}
+	nagiosStates = map[int]string{
+		sensu.CheckStateOK:       "OK",
+		sensu.CheckStateWarning:  "WARNING",
+		sensu.CheckStateCritical: "CRITICAL",
+		sensu.CheckStateUnknown:  "UNKNOWN",
+	}
+	// Escape special characters of InfluxDB line protocol measurements, and of tag keys, tag values and field keys
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxKeyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+func outputFormatNames() []string {
+	names := []string{}
+	for name := range outputFormats {
+		names = append(names, name)
+	}
+	for name := range reportFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func validOutputFormat(name string) bool {
+	_, metrics := outputFormats[name]
+	_, report := reportFormats[name]
+	return metrics || report
+}
+
+// queryPoints returns the metric points of all queries, in query order
+func queryPoints(queries []MetricQueryMap) ([]*v2.MetricPoint, error) {
+	points := []*v2.MetricPoint{}
+	for _, q := range queries {
+		p, err := q.Points()
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, p...)
+	}
+	return points, nil
+}
+
+func writePrometheus(w io.Writer, queries []MetricQueryMap) error {
+	points, err := queryPoints(queries)
+	if err != nil {
+		return err
+	}
+	return metric.Points(points).ToProm(w)
+}
+
+// writeInflux writes InfluxDB line protocol, using the measurement name as the measurement, the dimensions
+// as tags and the statistic as the field key, Ex:
+//  aws_alb_request_count_sum,LoadBalancer=app/my-lb/123 sum=42 1651185600000000000
+// Timestamps are converted to nanoseconds, the default line protocol precision.
+func writeInflux(w io.Writer, queries []MetricQueryMap) error {
+	for _, q := range queries {
+		points, err := q.Points()
+		if err != nil {
+			return err
+		}
+		for _, p := range points {
+			// line protocol has no representation for NaN and infinite values
+			if math.IsNaN(p.Value) || math.IsInf(p.Value, 0) {
+				continue
+			}
+			tags := make([]*v2.MetricTag, len(p.Tags))
+			copy(tags, p.Tags)
+			sort.SliceStable(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+			var line strings.Builder
+			line.WriteString(influxMeasurementEscaper.Replace(p.Name))
+			for _, t := range tags {
+				if len(t.Name) == 0 || len(t.Value) == 0 {
+					continue
+				}
+				fmt.Fprintf(&line, ",%v=%v", influxKeyEscaper.Replace(t.Name), influxKeyEscaper.Replace(t.Value))
+			}
+			fmt.Fprintf(&line, " %v=%v %v", influxKeyEscaper.Replace(q.FieldKey()),
+				strconv.FormatFloat(p.Value, 'f', -1, 64), p.Timestamp*int64(time.Millisecond))
+			if _, err := fmt.Fprintln(w, line.String()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// graphiteTemplate returns the Graphite path template set on the commandline, by the preset or the default
+func graphiteTemplate() string {
+	if len(plugin.GraphiteTemplate) > 0 {
+		return plugin.GraphiteTemplate
+	}
+	if plugin.Preset != nil {
+		if template := plugin.Preset.GetGraphiteTemplate(); len(template) > 0 {
+			return template
+		}
+	}
+	return defaultGraphiteTemplate
+}
+
+// graphiteValues looks up the values of the Graphite path template placeholders of a query:
+//  {namespace} {metric} {stat} {measurement} {region} {account} {dimensions} and any dimension name
+func (q MetricQueryMap) graphiteValues(name string) []string {
+	switch name {
+	case "namespace":
+		parts := strings.Split(q.Namespace, "/")
+		for i := range parts {
+			parts[i] = common.ToSnakeCase(parts[i])
+		}
+		return parts
+	case "metric":
+		if len(q.MetricName) > 0 {
+			return []string{common.ToSnakeCase(q.MetricName)}
+		}
+		if q.Insights != nil {
+			return []string{common.ToSnakeCase(q.Insights.MetricName)}
+		}
+		return []string{q.Label}
+	case "stat":
+		return []string{q.FieldKey()}
+	case "measurement":
+		return []string{q.Label}
+	case "region":
+		return []string{q.awsRegion()}
+	case "account":
+		return []string{q.AccountId}
+	case "dimensions":
+		values := []string{}
+		for _, d := range q.Dimensions {
+			values = append(values, aws.ToString(d.Value))
+		}
+		return values
+	}
+	for _, d := range q.Dimensions {
+		if aws.ToString(d.Name) == name {
+			return []string{aws.ToString(d.Value)}
+		}
+	}
+	return nil
+}
+
+// writeGraphite writes the Graphite plaintext protocol, building the path of each query from the Graphite
+// path template, Ex:
+//  aws.us-east-1.alb.app_my-lb_123.request_count.sum 42 1651185600
+// Timestamps are converted to seconds.
+func writeGraphite(w io.Writer, queries []MetricQueryMap) error {
+	template := graphiteTemplate()
+	for _, q := range queries {
+		points, err := q.Points()
+		if err != nil {
+			return err
+		}
+		path := common.ExpandGraphiteTemplate(template, q.graphiteValues)
+		for _, p := range points {
+			// the plaintext protocol has no representation for NaN and infinite values
+			if math.IsNaN(p.Value) || math.IsInf(p.Value, 0) {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "%v %v %v\n", path, strconv.FormatFloat(p.Value, 'f', -1, 64), p.Timestamp/int64(time.Second/time.Millisecond)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// nagiosRange converts a threshold to a Nagios threshold range alerting on the same values, > and >= both alert
+// above the value as do < and <= below it, as Nagios ranges always include their bounds
+func nagiosRange(t *common.Threshold) string {
+	if t == nil {
+		return ""
+	}
+	value := strconv.FormatFloat(t.Value, 'f', -1, 64)
+	switch t.Operator {
+	case ">", ">=":
+		return "~:" + value
+	case "<", "<=":
+		return value + ":"
+	case "==":
+		return "@" + value + ":" + value
+	case "!=":
+		return value + ":" + value
+	}
+	return ""
+}
+
+// nagiosLabel names a series in the perfdata, joining the measurement with its dimension values and region, Ex:
+//  aws_alb_request_count_sum:app/my-lb/123
+func (q MetricQueryMap) nagiosLabel() string {
+	parts := []string{q.Label}
+	for _, d := range q.Dimensions {
+		parts = append(parts, aws.ToString(d.Value))
+	}
+	if len(q.Region) > 0 {
+		parts = append(parts, q.Region)
+	}
+	// equals signs and single quotes are not allowed in perfdata labels
+	label := strings.NewReplacer("=", "_", "'", "_").Replace(strings.Join(parts, ":"))
+	if strings.ContainsAny(label, " \t") {
+		return "'" + label + "'"
+	}
+	return label
+}
+
+// nagiosPerfdata formats the latest value of the query as label=value[UOM];warn;crit;min;max
+func (q MetricQueryMap) nagiosPerfdata() (string, bool) {
+	value, ok := q.LatestValue()
+	if !ok || math.IsNaN(value) || math.IsInf(value, 0) {
+		return "", false
+	}
+	unit := nagiosUnits[q.Unit]
+	min, max := "", ""
+	if unit == "%" {
+		min, max = "0", "100"
+	}
+	fields := []string{
+		q.nagiosLabel() + "=" + strconv.FormatFloat(value, 'f', -1, 64) + unit,
+		nagiosRange(q.Warning), nagiosRange(q.Critical), min, max,
+	}
+	return strings.TrimRight(strings.Join(fields, ";"), ";"), true
+}
+
+// writeNagiosPerfdata writes the perfdata of every query with a datapoint on a single line
+func writeNagiosPerfdata(w io.Writer, queries []MetricQueryMap) error {
+	perfdata := []string{}
+	for _, q := range queries {
+		if p, ok := q.nagiosPerfdata(); ok {
+			perfdata = append(perfdata, p)
+		}
+	}
+	if len(perfdata) == 0 {
+		return nil
+	}
+	_, err := fmt.Fprintln(w, strings.Join(perfdata, " "))
+	return err
+}
+
+// reportNagios prints a Nagios plugin output, a status line naming the breaching series followed by the
+// perfdata of every series, with the problems found as long output on the following lines
+func reportNagios(w io.Writer, report checkReport) error {
+	var perfdata bytes.Buffer
+	if err := writeNagiosPerfdata(&perfdata, report.Queries); err != nil {
+		return err
+	}
+	status := nagiosSummary(report.State, report.Summary, report.Problems, len(report.Queries))
+	if perfdata.Len() > 0 {
+		status += " | " + perfdata.String()
+	}
+	if _, err := fmt.Fprintln(w, strings.TrimRight(status, "\n")); err != nil {
+		return err
+	}
+	for _, line := range report.Problems {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nagiosSummary builds the Nagios status line, naming the breaching series or else the first problem found
+func nagiosSummary(state int, summary []string, problems []string, numSeries int) string {
+	text := fmt.Sprintf("%v series checked", numSeries)
+	if len(summary) > 0 {
+		text = summary[0] + ": " + strings.Join(summary[1:], ", ")
+	} else if state != sensu.CheckStateOK && len(problems) > 0 {
+		text = problems[0]
+	}
+	// a pipe would start the perfdata
+	return fmt.Sprintf("CLOUDWATCH %v - %v", nagiosStates[state], strings.ReplaceAll(text, "|", "/"))
+}
+
+// jsonSeries is a single series of the json output format, holding everything known about its query
+type jsonSeries struct {
+	Id         string            `json:"id"`
+	Label      string            `json:"label"`
+	Namespace  string            `json:"namespace,omitempty"`
+	MetricName string            `json:"metric,omitempty"`
+	Expression string            `json:"expression,omitempty"`
+	Dimensions map[string]string `json:"dimensions"`
+	Stat       string            `json:"stat,omitempty"`
+	Period     int32             `json:"period,omitempty"`
+	Region     string            `json:"region,omitempty"`
+	AccountId  string            `json:"account-id,omitempty"`
+	Unit       string            `json:"unit,omitempty"`
+	Warning    string            `json:"warning,omitempty"`
+	Critical   string            `json:"critical,omitempty"`
+	State      int               `json:"state"`
+	StatusCode string            `json:"status-code"`
+	Messages   []string          `json:"messages,omitempty"`
+	Timestamps []time.Time       `json:"timestamps"`
+	// Values are null for NaN and infinite values, which JSON can not represent
+	Values []*float64 `json:"values"`
+}
+
+// jsonReport is the document of the json output format
+type jsonReport struct {
+	State    int          `json:"state"`
+	Summary  []string     `json:"summary,omitempty"`
+	Problems []string     `json:"problems,omitempty"`
+	Series   []jsonSeries `json:"series"`
+}
+
+func newJSONSeries(q MetricQueryMap) jsonSeries {
+	series := jsonSeries{
+		Id:         q.Id,
+		Label:      q.Label,
+		Namespace:  q.Namespace,
+		MetricName: q.MetricName,
+		Expression: q.Expression,
+		Dimensions: make(map[string]string, len(q.Dimensions)),
+		Stat:       q.Stat,
+		Period:     q.Period,
+		Region:     q.awsRegion(),
+		AccountId:  q.AccountId,
+		Unit:       q.Unit,
+		Warning:    q.Warning.String(),
+		Critical:   q.Critical.String(),
+		StatusCode: string(q.MetricDataResult.StatusCode),
+		Timestamps: q.MetricDataResult.Timestamps,
+		Values:     make([]*float64, len(q.MetricDataResult.Values)),
+	}
+	series.State, _ = q.Status()
+	for _, d := range q.Dimensions {
+		series.Dimensions[aws.ToString(d.Name)] = aws.ToString(d.Value)
+	}
+	for _, m := range q.MetricDataResult.Messages {
+		series.Messages = append(series.Messages, fmt.Sprintf("Code: %v Message: %v", aws.ToString(m.Code), aws.ToString(m.Value)))
+	}
+	for i := range q.MetricDataResult.Values {
+		if v := q.MetricDataResult.Values[i]; !math.IsNaN(v) && !math.IsInf(v, 0) {
+			series.Values[i] = &v
+		}
+	}
+	if series.Timestamps == nil {
+		series.Timestamps = []time.Time{}
+	}
+	return series
+}
+
+// reportJSON writes the check result as a single JSON document with the full metadata and datapoints of every series
+func reportJSON(w io.Writer, report checkReport) error {
+	doc := jsonReport{
+		State:    report.State,
+		Summary:  report.Summary,
+		Problems: report.Problems,
+		Series:   make([]jsonSeries, 0, len(report.Queries)),
+	}
+	for _, q := range report.Queries {
+		doc.Series = append(doc.Series, newJSONSeries(q))
+	}
+	return json.NewEncoder(w).Encode(doc)
+}
+
+// postJSON POSTs the value as JSON, with the headers given as key=value strings, and fails on any non 2xx response
+func postJSON(ctx context.Context, url string, headers []string, value interface{}) error {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, postTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for _, header := range headers {
+		if key, value, ok := strings.Cut(header, "="); ok {
+			req.Header.Set(strings.TrimSpace(key), strings.TrimSpace(value))
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("POST %v: %v %v", url, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/sensu/sensu-cloudwatch-check/common"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/stretchr/testify/assert"
+)
+
+func outputTestQueries() []MetricQueryMap {
+	ts := time.UnixMilli(1651185600000)
+	return []MetricQueryMap{
+		{
+			Label: "aws_alb_request_count_sum",
+			Stat:  "Sum",
+			Dimensions: []types.Dimension{
+				{Name: aws.String("TargetGroup"), Value: aws.String("targetgroup/my tg/456")},
+				{Name: aws.String("LoadBalancer"), Value: aws.String("app/my-lb/123")},
+			},
+			MetricDataResult: types.MetricDataResult{Timestamps: []time.Time{ts, ts.Add(-time.Minute)}, Values: []float64{42, 0.5}},
+			Region:           "eu-west-1",
+		},
+		{
+			Label:            "aws_alb_target_5xx_ratio",
+			Expression:       "100 * errors / requests",
+			MetricDataResult: types.MetricDataResult{Timestamps: []time.Time{ts, ts}, Values: []float64{1.25, math.NaN()}},
+		},
+		{
+			Label:            "aws_alb_target_response_time_p99_9",
+			Stat:             "p99.9",
+			Dimensions:       []types.Dimension{{Name: aws.String("Load,Balancer"), Value: aws.String("a=b")}},
+			MetricDataResult: types.MetricDataResult{Timestamps: []time.Time{ts}, Values: []float64{0.003}},
+		},
+	}
+}
+
+func TestFieldKey(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("sum", MetricQueryMap{Stat: "Sum"}.FieldKey())
+	assert.Equal("sample_count", MetricQueryMap{Stat: "SampleCount"}.FieldKey())
+	assert.Equal("p99_9", MetricQueryMap{Stat: "p99.9"}.FieldKey())
+	assert.Equal("value", MetricQueryMap{Expression: "m1 * 2"}.FieldKey())
+}
+
+func TestWriteInflux(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	assert.NoError(writeInflux(&buf, outputTestQueries()))
+	assert.Equal([]string{
+		`aws_alb_request_count_sum,LoadBalancer=app/my-lb/123,TargetGroup=targetgroup/my\ tg/456,aws_region=eu-west-1 sum=42 1651185600000000000`,
+		`aws_alb_request_count_sum,LoadBalancer=app/my-lb/123,TargetGroup=targetgroup/my\ tg/456,aws_region=eu-west-1 sum=0.5 1651185540000000000`,
+		`aws_alb_target_5xx_ratio value=1.25 1651185600000000000`,
+		`aws_alb_target_response_time_p99_9,Load\,Balancer=a\=b p99_9=0.003 1651185600000000000`,
+	}, strings.Split(strings.TrimSpace(buf.String()), "\n"))
+}
+
+func TestWritePrometheus(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	assert.NoError(writePrometheus(&buf, outputTestQueries()[:1]))
+	// the Prometheus label order is not stable
+	for _, expected := range []string{`LoadBalancer="app/my-lb/123"`, `TargetGroup="targetgroup/my tg/456"`, `aws_region="eu-west-1"`, `} 42 1651185600000`, `} 0.5 1651185540000`} {
+		assert.Contains(buf.String(), expected)
+	}
+}
+
+func TestWriteGraphite(t *testing.T) {
+	defer quiet()()
+	defer cleanPluginValues()
+	assert := assert.New(t)
+	plugin.Preset = nil
+	queries := outputTestQueries()
+	for i := range queries {
+		queries[i].Namespace = "AWS/ApplicationELB"
+	}
+	queries[0].MetricName = "RequestCount"
+	queries[2].MetricName = "TargetResponseTime"
+	var buf bytes.Buffer
+	assert.NoError(writeGraphite(&buf, queries))
+	assert.Equal([]string{
+		`aws.application_elb.targetgroup_my_tg_456.app_my-lb_123.request_count.sum 42 1651185600`,
+		`aws.application_elb.targetgroup_my_tg_456.app_my-lb_123.request_count.sum 0.5 1651185540`,
+		`aws.application_elb.aws_alb_target_5xx_ratio.value 1.25 1651185600`,
+		`aws.application_elb.a_b.target_response_time.p99_9 0.003 1651185600`,
+	}, strings.Split(strings.TrimSpace(buf.String()), "\n"))
+
+	plugin.GraphiteTemplate = "aws.{region}.alb.{LoadBalancer}.{metric}.{stat}"
+	buf.Reset()
+	assert.NoError(writeGraphite(&buf, queries[:1]))
+	assert.Equal([]string{
+		`aws.eu-west-1.alb.app_my-lb_123.request_count.sum 42 1651185600`,
+		`aws.eu-west-1.alb.app_my-lb_123.request_count.sum 0.5 1651185540`,
+	}, strings.Split(strings.TrimSpace(buf.String()), "\n"))
+}
+
+func TestNagiosRange(t *testing.T) {
+	assert := assert.New(t)
+	cases := map[string]string{
+		"":     "",
+		">80":  "~:80",
+		">=80": "~:80",
+		"<5":   "5:",
+		"<=5":  "5:",
+		"==1":  "@1:1",
+		"!=0":  "0:0",
+		"0.5":  "~:0.5",
+	}
+	for input, expected := range cases {
+		threshold, err := common.ParseThreshold(input)
+		assert.NoError(err)
+		assert.Equal(expected, nagiosRange(threshold), input)
+	}
+}
+
+func TestWriteNagiosPerfdata(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	queries := outputTestQueries()
+	queries[0].Warning = &common.Threshold{Operator: ">", Value: 40}
+	queries[0].Critical = &common.Threshold{Operator: ">", Value: 50}
+	queries[1].Unit = "Percent"
+	queries[2].Unit = "Seconds"
+	var buf bytes.Buffer
+	assert.NoError(writeNagiosPerfdata(&buf, queries))
+	assert.Equal(`'aws_alb_request_count_sum:targetgroup/my tg/456:app/my-lb/123:eu-west-1'=42;~:40;~:50 `+
+		`aws_alb_target_5xx_ratio=1.25%;;;0;100 aws_alb_target_response_time_p99_9:a_b=0.003s`+"\n", buf.String())
+	buf.Reset()
+	assert.NoError(writeNagiosPerfdata(&buf, []MetricQueryMap{}))
+	assert.Equal("", buf.String())
+}
+
+func TestReportNagios(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	queries := outputTestQueries()[1:]
+	queries[0].Critical = &common.Threshold{Operator: ">", Value: 1}
+	state, summary := evaluateThresholds(queries)
+	assert.Equal(sensu.CheckStateCritical, state)
+	var buf bytes.Buffer
+	assert.NoError(reportNagios(&buf, checkReport{State: state, Summary: summary, Problems: []string{"Warning: region eu-west-1: No metricDataQueries to process"}, Queries: queries}))
+	assert.Equal([]string{
+		`CLOUDWATCH CRITICAL - Thresholds breached: 1 critical, 0 warning: CRITICAL aws_alb_target_5xx_ratio{} = 1.25 (>1) | ` +
+			`aws_alb_target_5xx_ratio=1.25;;~:1 aws_alb_target_response_time_p99_9:a_b=0.003`,
+		`Warning: region eu-west-1: No metricDataQueries to process`,
+	}, strings.Split(strings.TrimSpace(buf.String()), "\n"))
+
+	buf.Reset()
+	assert.NoError(reportNagios(&buf, checkReport{State: sensu.CheckStateWarning, Problems: []string{"Warning: No metricDataQueries to process"}}))
+	assert.Equal("CLOUDWATCH WARNING - Warning: No metricDataQueries to process\nWarning: No metricDataQueries to process\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(reportNagios(&buf, checkReport{Queries: queries[1:]}))
+	assert.Equal("CLOUDWATCH OK - 1 series checked | aws_alb_target_response_time_p99_9:a_b=0.003\n", buf.String())
+}
+
+func TestReportJSON(t *testing.T) {
+	defer quiet()()
+	defer cleanPluginValues()
+	assert := assert.New(t)
+	plugin.AWSConfig.Region = "us-east-1"
+	queries := outputTestQueries()
+	queries[0].Id = "m1"
+	queries[0].Namespace = "AWS/ApplicationELB"
+	queries[0].MetricName = "RequestCount"
+	queries[0].Period = 60
+	queries[0].Unit = "Count"
+	queries[0].AccountId = "123456789012"
+	queries[0].Critical = &common.Threshold{Operator: ">", Value: 40}
+	queries[0].MetricDataResult.StatusCode = types.StatusCodePartialData
+	queries[0].MetricDataResult.Messages = []types.MessageData{{Code: aws.String("MaxDatapoints"), Value: aws.String("Too many datapoints")}}
+	state, summary := evaluateThresholds(queries)
+	var buf bytes.Buffer
+	assert.NoError(reportJSON(&buf, checkReport{State: state, Summary: summary, Problems: []string{"Warning: something"}, Queries: queries}))
+	assert.Equal(1, strings.Count(buf.String(), "\n"))
+
+	var doc jsonReport
+	assert.NoError(json.Unmarshal(buf.Bytes(), &doc))
+	assert.Equal(sensu.CheckStateCritical, doc.State)
+	assert.Equal(summary, doc.Summary)
+	assert.Equal([]string{"Warning: something"}, doc.Problems)
+	assert.Equal(3, len(doc.Series))
+
+	series := doc.Series[0]
+	assert.Equal("m1", series.Id)
+	assert.Equal("aws_alb_request_count_sum", series.Label)
+	assert.Equal("AWS/ApplicationELB", series.Namespace)
+	assert.Equal("RequestCount", series.MetricName)
+	assert.Equal(map[string]string{"LoadBalancer": "app/my-lb/123", "TargetGroup": "targetgroup/my tg/456"}, series.Dimensions)
+	assert.Equal("Sum", series.Stat)
+	assert.Equal(int32(60), series.Period)
+	assert.Equal("eu-west-1", series.Region)
+	assert.Equal("123456789012", series.AccountId)
+	assert.Equal("Count", series.Unit)
+	assert.Equal(">40", series.Critical)
+	assert.Equal(sensu.CheckStateCritical, series.State)
+	assert.Equal("PartialData", series.StatusCode)
+	assert.Equal([]string{"Code: MaxDatapoints Message: Too many datapoints"}, series.Messages)
+	assert.Equal(2, len(series.Timestamps))
+	assert.True(series.Timestamps[0].Equal(time.UnixMilli(1651185600000)))
+	assert.Equal(42.0, *series.Values[0])
+	assert.Equal(0.5, *series.Values[1])
+
+	// NaN values are null, the region defaults to the region of the AWS config
+	series = doc.Series[1]
+	assert.Equal("100 * errors / requests", series.Expression)
+	assert.Equal("us-east-1", series.Region)
+	assert.Equal(map[string]string{}, series.Dimensions)
+	assert.Equal(1.25, *series.Values[0])
+	assert.Nil(series.Values[1])
+	assert.Contains(buf.String(), `"values":[1.25,null]`)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/sensu/sensu-cloudwatch-check/presets"
+)
+
+// presetsCommand lists the presets, or shows the measurement config of one, without AWS credentials or API calls.
+// Presets of the --preset-dir, or the CLOUDWATCH_CHECK_PRESET_DIR envvar, are included. It returns the exit status:
+// 0 on success, 1 for errors and 2 for usage errors.
+func presetsCommand(w io.Writer, args []string) int {
+	flags := flag.NewFlagSet("presets", flag.ContinueOnError)
+	flags.SetOutput(w)
+	format := flags.String("format", "table", "Output format, table or json")
+	presetDir := flags.String("preset-dir", os.Getenv("CLOUDWATCH_CHECK_PRESET_DIR"), "Directory of measurement configuration JSON and YAML files to load as presets")
+	flags.Usage = func() {
+		fmt.Fprintln(w, "Usage: sensu-cloudwatch-check presets list [--format table|json] [--preset-dir DIR]")
+		fmt.Fprintln(w, "       sensu-cloudwatch-check presets show NAME [--format table|json] [--preset-dir DIR]")
+		flags.PrintDefaults()
+	}
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if *format != "table" && *format != "json" {
+		fmt.Fprintf(w, "invalid --format %v, must be table or json\n", *format)
+		return 2
+	}
+	if len(positional) == 0 || (positional[0] == "list" && len(positional) != 1) || (positional[0] == "show" && len(positional) != 2) {
+		flags.Usage()
+		return 2
+	}
+	if len(*presetDir) > 0 {
+		if _, err := presets.LoadPresetDir(*presetDir, nil); err != nil {
+			fmt.Fprintf(w, "--preset-dir %v\n", err)
+			return 1
+		}
+	}
+	switch positional[0] {
+	case "list":
+		err = listPresets(w, *format)
+	case "show":
+		err = showPreset(w, positional[1], *format)
+	default:
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+	return 0
+}
+
+// parseInterspersed parses flags placed before, between or after the positional arguments
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+func listPresets(w io.Writer, format string) error {
+	summaries, err := presets.ListPresets()
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return writeIndentedJSON(w, summaries)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tNAMESPACE\tREQUIRED REGION\tMETRICS\tMEASUREMENTS\tSOURCE\tDESCRIPTION")
+	for _, s := range summaries {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", s.Name, dashIfEmpty(s.Namespace), dashIfEmpty(s.RequiredRegion), s.Metrics, s.Measurements, s.Source, s.Description)
+	}
+	return tw.Flush()
+}
+
+// showPreset prints the measurement config of a preset. The json format is the measurement config itself, which
+// can be edited and passed to --config-file, the table format adds a table of the measurements ahead of it.
+func showPreset(w io.Writer, name string, format string) error {
+	if _, ok := presets.Presets[name]; !ok {
+		return fmt.Errorf("preset %v not defined, choose from: %v", name, strings.Join(presets.PresetNames(), ", "))
+	}
+	config, err := presets.PresetConfig(name)
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return writeIndentedJSON(w, config)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, field := range [][2]string{
+		{"Name", config.Name},
+		{"Description", config.Description},
+		{"Namespace", config.Namespace},
+		{"Required region", config.RequiredRegion},
+		{"Reference", config.Reference},
+		{"Date", config.Date},
+		{"Notes", config.Notes},
+	} {
+		if len(field[1]) > 0 {
+			fmt.Fprintf(tw, "%v:\t%v\n", field[0], field[1])
+		}
+	}
+	if len(config.Measurements) > 0 {
+		fmt.Fprintln(tw)
+		// expressions are shown in the metric column, after an equal sign
+		fmt.Fprintln(tw, "METRIC\tSTAT\tMEASUREMENT\tUNIT\tWARNING\tCRITICAL\tID")
+		for _, m := range config.Measurements {
+			metric := m.MetricName
+			if len(m.Expression) > 0 {
+				metric = "= " + m.Expression
+			}
+			for _, c := range m.Config {
+				fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", metric, dashIfEmpty(c.Stat), strings.ReplaceAll(c.Measurement, ".", "_"),
+					dashIfEmpty(c.Unit), dashIfEmpty(c.Warning), dashIfEmpty(c.Critical), dashIfEmpty(c.Id))
+			}
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(config.Measurements) == 0 {
+		return nil
+	}
+	fmt.Fprintln(w)
+	return writeIndentedJSON(w, config)
+}
+
+func writeIndentedJSON(w io.Writer, value interface{}) error {
+	output, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(output))
+	return err
+}
+
+func dashIfEmpty(str string) string {
+	if len(str) == 0 {
+		return "-"
+	}
+	return str
+}
@@ -11,12 +11,13 @@ import (
 func TestALBReady(t *testing.T) {
 	defer quiet()()
 	assert := assert.New(t)
-	elb := &ALB{}
+	elb := builtinPreset("ALB")
 	err := elb.SetVerbose(true)
 	assert.NoError(err)
 	err = elb.Ready()
 	assert.NoError(err)
 	assert.Equal("AWS/ApplicationELB", elb.Namespace)
+	assert.Equal("aws.{region}.alb.{dimensions}.{metric}.{stat}", elb.GetGraphiteTemplate())
 	assert.Equal(0, len(elb.DimensionFilters))
 	allowed := []string{"LoadBalancerName", "AvailabilityZone"}
 	for _, d := range elb.DimensionFilters {
@@ -28,7 +29,7 @@ func TestALBReady(t *testing.T) {
 func TestALBAddMetrics(t *testing.T) {
 	defer quiet()()
 	assert := assert.New(t)
-	elb := &ALB{}
+	elb := builtinPreset("ALB")
 	err := elb.SetVerbose(true)
 	assert.NoError(err)
         err = elb.SetErrorOnMissing(true)
@@ -71,7 +72,7 @@ func TestALBAddMetrics(t *testing.T) {
 func TestALBBuildMetricDataQueries(t *testing.T) {
 	defer quiet()()
 	assert := assert.New(t)
-	elb := &ALB{}
+	elb := builtinPreset("ALB")
 	err := elb.SetVerbose(true)
 	assert.NoError(err)
 	err = elb.Ready()
@@ -102,7 +103,7 @@ func TestALBBuildMetricDataQueries(t *testing.T) {
 func TestALBGetMeasurementString(t *testing.T) {
 	defer quiet()()
 	assert := assert.New(t)
-	elb := &ALB{}
+	elb := builtinPreset("ALB")
 	err := elb.SetVerbose(true)
 	assert.NoError(err)
 	err = elb.Ready()
@@ -0,0 +1,29 @@
+package presets
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// builtinData holds the measurement configs of the built-in presets, developed from the AWS CloudWatch
+// documentation referenced by each file
+//
+//go:embed data/*.json
+var builtinData embed.FS
+
+// registerBuiltinPresets registers the presets of the embedded data files
+func registerBuiltinPresets() error {
+	data, err := fs.Sub(builtinData, "data")
+	if err != nil {
+		return err
+	}
+	loaded, err := loadPresetFS(data, "data", nil)
+	if err != nil {
+		return err
+	}
+	for _, p := range loaded {
+		p.builtin = true
+	}
+	_, err = registerPresets(loaded)
+	return err
+}
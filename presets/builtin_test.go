@@ -0,0 +1,74 @@
+package presets
+
+import (
+	"encoding/json"
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// builtinPreset returns a copy of a built-in preset, so tests do not change the registered one
+func builtinPreset(name string) *File {
+	return Presets[name].Clone().(*File)
+}
+
+func TestBuiltinPresets(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	files, err := fs.Glob(builtinData, "data/*.json")
+	assert.NoError(err)
+	assert.Equal(4, len(files))
+	for _, path := range files {
+		data, err := builtinData.ReadFile(path)
+		assert.NoError(err)
+		measurementConfig := MeasurementJSON{}
+		assert.NoError(json.Unmarshal(data, &measurementConfig), path)
+		metadata := measurementConfig.PresetMetadata
+		assert.NotEmpty(metadata.Name, path)
+		assert.NotEmpty(metadata.Description, path)
+		assert.Regexp(`^https://docs\.aws\.amazon\.com/`, metadata.Reference, path)
+		assert.Regexp(`^\d{4}-\d{2}-\d{2}$`, metadata.Date, path)
+
+		preset := builtinPreset(metadata.Name)
+		assert.Equal(path, preset.Path)
+		assert.Equal(metadata, preset.Metadata)
+		assert.Equal(metadata.Description, preset.GetDescription())
+		assert.NoError(preset.Ready(), path)
+		assert.NotEmpty(preset.GetNamespace(), path)
+		assert.NotEmpty(preset.GetGraphiteTemplate(), path)
+
+		// measurement names are the names of the series in every output format, so they must be unique
+		measurements := make(map[string]string)
+		for metricName, configs := range preset.configMap {
+			for _, config := range configs {
+				other, ok := measurements[config.Measurement]
+				assert.False(ok, "%v: measurement %v of %v already used by %v", path, config.Measurement, metricName, other)
+				measurements[config.Measurement] = metricName
+			}
+		}
+		for _, expression := range preset.expressions {
+			for _, config := range expression.Config {
+				other, ok := measurements[config.Measurement]
+				assert.False(ok, "%v: measurement %v of %v already used by %v", path, config.Measurement, expression.Expression, other)
+				measurements[config.Measurement] = expression.Expression
+			}
+		}
+		assert.NotEmpty(measurements, path)
+	}
+}
+
+func TestBuiltinPresetRequiredRegion(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	preset := builtinPreset("CloudFront")
+	assert.Equal("us-east-1", preset.Metadata.RequiredRegion)
+	assert.Equal("us-east-1", preset.GetRegion())
+	assert.NoError(preset.SetRegion("eu-west-1"))
+	assert.Equal("eu-west-1", preset.GetRegion())
+	assert.Empty(builtinPreset("ALB").GetRegion())
+	assert.Equal("us-east-1", RequiredRegion(preset))
+	assert.Equal("us-east-1", RequiredRegion(preset.Clone()))
+	assert.Empty(RequiredRegion(builtinPreset("ALB")))
+	assert.Empty(RequiredRegion(&None{}))
+}
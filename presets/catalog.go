@@ -0,0 +1,99 @@
+package presets
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// PresetSummary describes a registered preset for the presets list command
+type PresetSummary struct {
+	Name           string `json:"name"`
+	Description    string `json:"description"`
+	Namespace      string `json:"namespace,omitempty"`
+	RequiredRegion string `json:"required-region,omitempty"`
+	// Metrics counts the CloudWatch metrics of the measurement config, Measurements the statistics and expressions
+	// measured from them
+	Metrics      int `json:"metrics"`
+	Measurements int `json:"measurements"`
+	// Source is built-in, or the path of the file the preset was loaded from
+	Source string `json:"source"`
+}
+
+// PresetNames returns the names of the registered presets, sorted
+func PresetNames() []string {
+	names := make([]string, 0, len(Presets))
+	for name := range Presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// measurementConfig returns the measurement config the preset was set up with, which is empty for presets
+// built from the command line options
+func (p *Preset) measurementConfig() (MeasurementJSON, error) {
+	measurementConfig := MeasurementJSON{}
+	if len(p.measurementString) == 0 {
+		return measurementConfig, nil
+	}
+	err := json.Unmarshal([]byte(p.measurementString), &measurementConfig)
+	return measurementConfig, err
+}
+
+// PresetConfig returns the measurement config of a registered preset along with its metadata, without building the
+// preset or discovering metrics, so presets can be described without AWS credentials
+func PresetConfig(name string) (MeasurementJSON, error) {
+	preset, ok := Presets[name]
+	if !ok {
+		return MeasurementJSON{}, fmt.Errorf("preset %v not defined", name)
+	}
+	configured, ok := preset.(interface {
+		measurementConfig() (MeasurementJSON, error)
+	})
+	if !ok {
+		return MeasurementJSON{}, fmt.Errorf("preset %v has no measurement config", name)
+	}
+	config, err := configured.measurementConfig()
+	if err != nil {
+		return MeasurementJSON{}, fmt.Errorf("preset %v: %v", name, err)
+	}
+	config.Name = name
+	config.Description = preset.GetDescription()
+	if len(config.Namespace) == 0 {
+		config.Namespace = preset.GetNamespace()
+	}
+	if config.Measurements == nil {
+		config.Measurements = []MeasurementConfig{}
+	}
+	return config, nil
+}
+
+// ListPresets summarizes the registered presets, sorted by name
+func ListPresets() ([]PresetSummary, error) {
+	summaries := []PresetSummary{}
+	for _, name := range PresetNames() {
+		config, err := PresetConfig(name)
+		if err != nil {
+			return nil, err
+		}
+		summary := PresetSummary{
+			Name:           name,
+			Description:    config.Description,
+			Namespace:      config.Namespace,
+			RequiredRegion: config.RequiredRegion,
+			Source:         "built-in",
+		}
+		if p, ok := Presets[name].(*File); ok && !p.builtin {
+			summary.Source = p.Path
+		}
+		for _, m := range config.Measurements {
+			if len(m.MetricName) > 0 {
+				summary.Metrics++
+			}
+			summary.Measurements += len(m.Config)
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
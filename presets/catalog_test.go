@@ -0,0 +1,50 @@
+package presets
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPresetNames(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal([]string{"ALB", "CLB", "CloudFront", "EC2", "None"}, PresetNames())
+}
+
+func TestPresetConfig(t *testing.T) {
+	assert := assert.New(t)
+	config, err := PresetConfig("CloudFront")
+	assert.NoError(err)
+	assert.Equal("CloudFront", config.Name)
+	assert.Equal("AWS/CloudFront", config.Namespace)
+	assert.Equal("us-east-1", config.RequiredRegion)
+	assert.Equal("OriginLatency", config.Measurements[0].MetricName)
+	assert.Equal("p50", config.Measurements[0].Config[0].Stat)
+
+	// presets set up from the command line options have no measurement config
+	config, err = PresetConfig("None")
+	assert.NoError(err)
+	assert.Empty(config.Namespace)
+	assert.Equal([]MeasurementConfig{}, config.Measurements)
+
+	_, err = PresetConfig("Missing")
+	assert.Error(err)
+}
+
+func TestListPresets(t *testing.T) {
+	assert := assert.New(t)
+	dir := writePresetFiles(t, map[string]string{"rds.yaml": testPresetYAML})
+	_, err := LoadPresetDir(dir, nil)
+	assert.NoError(err)
+	defer delete(Presets, "rds")
+
+	summaries, err := ListPresets()
+	assert.NoError(err)
+	assert.Equal(6, len(summaries))
+	assert.Equal("ALB", summaries[0].Name)
+	assert.Equal("built-in", summaries[0].Source)
+	assert.Equal(PresetSummary{Name: "CloudFront", Description: "Preset Metrics for AWS CloudFront, published in us-east-1 only",
+		Namespace: "AWS/CloudFront", RequiredRegion: "us-east-1", Metrics: 19, Measurements: 23, Source: "built-in"}, summaries[2])
+	assert.Equal(PresetSummary{Name: "rds", Description: "Preset loaded from " + dir + "/rds.yaml", Namespace: "AWS/RDS",
+		Metrics: 1, Measurements: 1, Source: dir + "/rds.yaml"}, summaries[5])
+}
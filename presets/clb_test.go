@@ -11,7 +11,7 @@ import (
 func TestCLBReady(t *testing.T) {
 	defer quiet()()
 	assert := assert.New(t)
-	preset := &CLB{}
+	preset := builtinPreset("CLB")
 	err := preset.SetVerbose(true)
 	assert.NoError(err)
 	err = preset.Ready()
@@ -28,7 +28,7 @@ func TestCLBReady(t *testing.T) {
 func TestCLBAddMetrics(t *testing.T) {
 	defer quiet()()
 	assert := assert.New(t)
-	preset := &CLB{}
+	preset := builtinPreset("CLB")
 	err := preset.SetVerbose(true)
 	assert.NoError(err)
         err = preset.SetErrorOnMissing(true)
@@ -80,7 +80,7 @@ func TestCLBAddMetrics(t *testing.T) {
 func TestCLBBuildMetricDataQueries(t *testing.T) {
 	defer quiet()()
 	assert := assert.New(t)
-	preset := &CLB{}
+	preset := builtinPreset("CLB")
 	err := preset.SetVerbose(true)
 	assert.NoError(err)
 	err = preset.Ready()
@@ -120,7 +120,7 @@ func TestCLBBuildMetricDataQueries(t *testing.T) {
 func TestCLBGetMeasurementString(t *testing.T) {
 	defer quiet()()
 	assert := assert.New(t)
-	preset := &CLB{}
+	preset := builtinPreset("CLB")
 	err := preset.SetVerbose(true)
 	assert.NoError(err)
 	err = preset.Ready()
@@ -11,7 +11,7 @@ import (
 func TestCloudFrontReady(t *testing.T) {
 	defer quiet()()
 	assert := assert.New(t)
-	preset := &CloudFront{}
+	preset := builtinPreset("CloudFront")
 	err := preset.SetVerbose(true)
 	assert.NoError(err)
 	err = preset.Ready()
@@ -28,7 +28,7 @@ func TestCloudFrontReady(t *testing.T) {
 func TestCloudFrontAddMetrics(t *testing.T) {
 	defer quiet()()
 	assert := assert.New(t)
-	preset := &CloudFront{}
+	preset := builtinPreset("CloudFront")
 	err := preset.SetVerbose(true)
 	assert.NoError(err)
         err = preset.SetErrorOnMissing(true)
@@ -64,7 +64,7 @@ func TestCloudFrontAddMetrics(t *testing.T) {
 func TestCloudFrontBuildMetricDataQueries(t *testing.T) {
 	defer quiet()()
 	assert := assert.New(t)
-	preset := &CloudFront{}
+	preset := builtinPreset("CloudFront")
 	err := preset.SetVerbose(true)
 	assert.NoError(err)
 	err = preset.Ready()
@@ -88,7 +88,7 @@ func TestCloudFrontBuildMetricDataQueries(t *testing.T) {
 func TestCloudFrontGetMeasurementString(t *testing.T) {
 	defer quiet()()
 	assert := assert.New(t)
-	preset := &CloudFront{}
+	preset := builtinPreset("CloudFront")
 	err := preset.SetVerbose(true)
 	assert.NoError(err)
 	err = preset.Ready()
@@ -99,3 +99,17 @@ func TestCloudFrontGetMeasurementString(t *testing.T) {
 	fmt.Println(output)
 
 }
+
+func TestCloudFrontExtendedStatistics(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	preset := builtinPreset("CloudFront")
+	err := preset.Ready()
+	assert.NoError(err)
+	config, ok := preset.GetStatConfig("OriginLatency", "aws_cloud_front_origin_latency_p99_9")
+	assert.True(ok)
+	assert.Equal("p99.9", config.Stat)
+	config, ok = preset.GetStatConfig("OriginLatency", "aws_cloud_front_origin_latency_tm10_90")
+	assert.True(ok)
+	assert.Equal("TM(10%:90%)", config.Stat)
+}
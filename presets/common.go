@@ -3,24 +3,27 @@ package presets
 import (
 	"encoding/json"
 	"fmt"
+	"regexp"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 	"github.com/google/uuid"
 	"github.com/sensu/sensu-cloudwatch-check/common"
+	v2 "github.com/sensu/sensu-go/api/core/v2"
 )
 
 var (
 	Presets = make(map[string]PresetInterface)
+	// GetMetricData query ids must start with a lowercase letter
+	matchQueryId = regexp.MustCompile(`^[a-z][a-zA-Z0-9_]*$`)
 )
 
 func init() {
 	Presets["None"] = &None{Preset: Preset{Description: "No Service Presets Active, use cmdline --namespace --metric --dimension-filters to tailer cloudwatch results"}}
-	Presets["CLB"] = &CLB{Preset: Preset{Description: "Preset Metrics for AWS Classic Load Balancer"}}
-	Presets["ALB"] = &ALB{Preset: Preset{Description: "Preset Metrics for AWS Application Load Balancer"}}
-	Presets["EC2"] = &EC2{Preset: Preset{Description: "Preset Metrics for AWS EC2"}}
-	Presets["CloudFront"] = &CloudFront{Preset: Preset{Description: "Preset Metrics for AWS CloudFront. Note: requires --region us-east-1"}}
+	if err := registerBuiltinPresets(); err != nil {
+		panic(err)
+	}
 }
 
 type Preset struct {
@@ -29,13 +32,18 @@ type Preset struct {
 	Namespace         string
 	MetricFilter      string
 	Region            string
+	EndpointURL       string
+	GraphiteTemplate  string
 	PeriodMinutes     int
 	Description       string
 	Name              string
 	configMap         map[string][]StatConfig
+	expressions       []MeasurementConfig
 	measurementString string
 	verbose           bool
 	errorOnMissing    bool
+	// event the dimension filter templates of the measurement config are resolved against
+	event *v2.Event
 }
 
 type PresetInterface interface {
@@ -49,6 +57,8 @@ type PresetInterface interface {
 	SetPeriodMinutes(period int) error
 	GetRegion() string
 	SetRegion(region string) error
+	GetEndpointURL() string
+	GetGraphiteTemplate() string
 	SetVerbose(flag bool) error
 	SetErrorOnMissing(flag bool) error
 	SetMeasurementString(config string) error
@@ -56,27 +66,79 @@ type PresetInterface interface {
 	GetMeasurementString(pretty bool) (string, error)
 	GetDimensionFilters() []types.DimensionFilter
 	AddDimensionFilters(filters []types.DimensionFilter) error
+	GetStatConfig(metricName string, measurement string) (StatConfig, bool)
+	UsesListMetrics() bool
+	Clone() PresetInterface
 	Ready() error
 }
 
 type StatConfig struct {
-	Stat        string `json:"stat"`
+	Stat        string `json:"stat,omitempty"`
 	Measurement string `json:"measurement"`
+	Warning     string `json:"warning,omitempty"`
+	Critical    string `json:"critical,omitempty"`
+	// Id is a stable identifier expressions use to reference this measurement
+	Id string `json:"id,omitempty"`
+	// Unit is the CloudWatch unit of the measurement, Ex: "Seconds", used for output formats with units
+	Unit string `json:"unit,omitempty"`
+	// ReturnData false keeps an intermediate measurement out of the check output
+	ReturnData *bool `json:"return-data,omitempty"`
 }
+
+// MeasurementConfig describes either a CloudWatch metric (MetricName) or a metric math Expression
+// evaluated per set of dimensions, referencing the ids of other measurements
 type MeasurementConfig struct {
-	MetricName string       `json:"metric"`
+	MetricName string       `json:"metric,omitempty"`
+	Expression string       `json:"expression,omitempty"`
 	Config     []StatConfig `json:"config"`
 }
 
+// PresetMetadata describes the preset a measurement config file defines
+type PresetMetadata struct {
+	// Name is the preset name, defaults to the file name
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	// RequiredRegion is the only region the metrics are published in, Ex: us-east-1 for CloudFront
+	RequiredRegion string `json:"required-region,omitempty"`
+	// Reference is the AWS documentation of the metrics the config was developed from
+	Reference string `json:"reference,omitempty"`
+	// Date the config was developed from the AWS documentation, Ex: 2021-08-18
+	Date  string `json:"date,omitempty"`
+	Notes string `json:"notes,omitempty"`
+}
+
 type MeasurementJSON struct {
+	PresetMetadata
 	Namespace        string              `json:"namespace"`
 	PeriodMinutes    int                 `json:"period-minutes,omitempty"`
 	Region           string              `json:"region,omitempty"`
+	EndpointURL      string              `json:"endpoint-url,omitempty"`
+	GraphiteTemplate string              `json:"graphite-template,omitempty"`
 	MetricFilter     string              `json:"metric-filter,omitempty"`
 	DimensionFilters []string            `json:"dimension-filters,omitempty"`
 	Measurements     []MeasurementConfig `json:"measurements,omitempty"`
 }
 
+// clone copies the preset with its own metrics and configuration, so copies can discover metrics independently
+func (p *Preset) clone() Preset {
+	c := *p
+	c.Metrics = append([]types.Metric{}, p.Metrics...)
+	c.DimensionFilters = append([]types.DimensionFilter{}, p.DimensionFilters...)
+	c.expressions = append([]MeasurementConfig{}, p.expressions...)
+	if p.configMap != nil {
+		c.configMap = make(map[string][]StatConfig, len(p.configMap))
+		for metricName, configs := range p.configMap {
+			c.configMap[metricName] = configs
+		}
+	}
+	return c
+}
+
+func (p *Preset) Clone() PresetInterface {
+	c := p.clone()
+	return &c
+}
+
 func (p *Preset) AddDimensionFilters(filters []types.DimensionFilter) error {
 	p.DimensionFilters = append(p.DimensionFilters, filters...)
 	return nil
@@ -88,6 +150,8 @@ func (p *Preset) GetMeasurementString(pretty bool) (string, error) {
 	measurementConfig.Namespace = p.Namespace
 	measurementConfig.PeriodMinutes = p.PeriodMinutes
 	measurementConfig.Region = p.Region
+	measurementConfig.EndpointURL = p.EndpointURL
+	measurementConfig.GraphiteTemplate = p.GraphiteTemplate
 	measurementConfig.MetricFilter = p.MetricFilter
 	dimStrings := []string{}
 	for _, d := range p.DimensionFilters {
@@ -106,6 +170,7 @@ func (p *Preset) GetMeasurementString(pretty bool) (string, error) {
 		}
 		measurementConfig.Measurements = append(measurementConfig.Measurements, config)
 	}
+	measurementConfig.Measurements = append(measurementConfig.Measurements, p.expressions...)
 	prefix := ""
 	indent := ""
 	if pretty {
@@ -133,8 +198,21 @@ func (p *Preset) BuildMeasurementConfig() error {
 	if len(measurementConfig.Region) > 0 {
 		p.Region = measurementConfig.Region
 	}
+	if len(measurementConfig.EndpointURL) > 0 {
+		p.EndpointURL = measurementConfig.EndpointURL
+	}
+	if len(measurementConfig.GraphiteTemplate) > 0 {
+		if err := common.CheckGraphiteTemplate(measurementConfig.GraphiteTemplate); err != nil {
+			return err
+		}
+		p.GraphiteTemplate = measurementConfig.GraphiteTemplate
+	}
 	if len(measurementConfig.DimensionFilters) > 0 {
-		if dimensionFilters, err := common.BuildDimensionFilters(measurementConfig.DimensionFilters); err == nil {
+		filterStrings, err := common.ExpandDimensionFilterTemplates(measurementConfig.DimensionFilters, p.event)
+		if err != nil {
+			return err
+		}
+		if dimensionFilters, err := common.BuildDimensionFilters(filterStrings); err == nil {
 			err := p.AddDimensionFilters(dimensionFilters)
 			if err != nil {
 				return err
@@ -145,18 +223,74 @@ func (p *Preset) BuildMeasurementConfig() error {
 		}
 	}
 	p.configMap = make(map[string][]StatConfig)
+	p.expressions = []MeasurementConfig{}
+	ids := make(map[string]bool)
 	for _, m := range measurementConfig.Measurements {
-		p.configMap[m.MetricName] = []StatConfig{}
+		if len(m.MetricName) > 0 && len(m.Expression) > 0 {
+			return fmt.Errorf("measurement config can not set both metric %v and expression %v", m.MetricName, m.Expression)
+		}
+		items := []StatConfig{}
 		for _, item := range m.Config {
+			if len(item.Measurement) > 0 && !matchMeasurementName.MatchString(item.Measurement) {
+				return fmt.Errorf("measurement %q must start with a letter or underscore and only contain letters, numbers, underscores and dots", item.Measurement)
+			}
 			item.Measurement = strings.ReplaceAll(item.Measurement, ".", "_")
-			p.configMap[m.MetricName] = append(p.configMap[m.MetricName], item)
+			if len(m.Expression) == 0 && !common.ValidStatistic(item.Stat) {
+				return fmt.Errorf("measurement %v has invalid statistic %q", item.Measurement, item.Stat)
+			}
+			if len(item.Unit) > 0 && !common.ValidUnit(item.Unit) {
+				return fmt.Errorf("measurement %v has invalid unit %q", item.Measurement, item.Unit)
+			}
+			if _, err := common.ParseThreshold(item.Warning); err != nil {
+				return fmt.Errorf("measurement %v warning: %v", item.Measurement, err)
+			}
+			if _, err := common.ParseThreshold(item.Critical); err != nil {
+				return fmt.Errorf("measurement %v critical: %v", item.Measurement, err)
+			}
+			if len(item.Id) > 0 {
+				if !matchQueryId.MatchString(item.Id) {
+					return fmt.Errorf("measurement %v id %v must start with a lowercase letter and only contain letters, numbers and underscores", item.Measurement, item.Id)
+				}
+				if ids[item.Id] {
+					return fmt.Errorf("measurement id %v is used more than once", item.Id)
+				}
+				ids[item.Id] = true
+			}
+			items = append(items, item)
+		}
+		if len(m.Expression) > 0 {
+			p.expressions = append(p.expressions, MeasurementConfig{Expression: m.Expression, Config: items})
+		} else {
+			p.configMap[m.MetricName] = items
 		}
-
 	}
 
 	return nil
 }
 
+// GetStatConfig looks up the configured stat for a metric by its (already normalized) measurement label,
+// an empty metricName looks up expression measurements
+func (p *Preset) GetStatConfig(metricName string, measurement string) (StatConfig, bool) {
+	configs := p.configMap[metricName]
+	if len(metricName) == 0 {
+		configs = []StatConfig{}
+		for _, e := range p.expressions {
+			configs = append(configs, e.Config...)
+		}
+	}
+	for _, config := range configs {
+		if config.Measurement == measurement {
+			return config, true
+		}
+	}
+	return StatConfig{}, false
+}
+
+// UsesListMetrics reports whether the preset needs metrics discovered with ListMetrics before building data queries
+func (p *Preset) UsesListMetrics() bool {
+	return true
+}
+
 func (p *Preset) GetDimensionFilters() []types.DimensionFilter {
 	return p.DimensionFilters
 }
@@ -187,6 +321,15 @@ func (p *Preset) GetRegion() string {
 	return p.Region
 }
 
+func (p *Preset) GetEndpointURL() string {
+	return p.EndpointURL
+}
+
+// GetGraphiteTemplate returns the default Graphite path template of the preset, if any
+func (p *Preset) GetGraphiteTemplate() string {
+	return p.GraphiteTemplate
+}
+
 func (p *Preset) SetRegion(region string) error {
 	p.Region = region
 	return nil
@@ -197,6 +340,12 @@ func (p *Preset) SetVerbose(flag bool) error {
 	return nil
 }
 
+// SetEvent sets the Sensu event dimension filter templates like InstanceId={{ .Entity.Labels.aws_instance_id }} resolve against
+func (p *Preset) SetEvent(event *v2.Event) error {
+	p.event = event
+	return nil
+}
+
 func (p *Preset) SetErrorOnMissing(flag bool) error {
 	p.errorOnMissing = flag
 	return nil
@@ -274,52 +423,147 @@ func (p *Preset) BuildMetricDataQueries(period int32) ([]types.MetricDataQuery,
 		fmt.Println("Preset::BuildMetricDataQueries")
 	}
 	dataQueries := []types.MetricDataQuery{}
+	// Group metrics sharing the same dimensions, so expressions can reference the measurements of a single resource
+	groupKeys := []string{}
+	groups := make(map[string][]types.Metric)
 	for _, m := range p.Metrics {
-		if statConfigs, ok := p.configMap[*m.MetricName]; ok {
-			for _, config := range statConfigs {
-				stat := config.Stat
-				measurement := config.Measurement
-				id := uuid.New()
-				idString := "aws_" + strings.ReplaceAll(id.String(), "-", "_")
-				if p.verbose {
-					fmt.Printf("Preset.BuildMetricDataQueries: %v %v %v %v %v\n", *m.MetricName, idString, stat, measurement, *m.Namespace)
-				}
-				labelString := measurement
-				dimensions := []types.Dimension{}
-				for _, d := range m.Dimensions {
-					dimension := types.Dimension{}
-					if d.Name != nil {
-						dimension.Name = aws.String(*d.Name)
+		key := common.DimString(m.Dimensions)
+		if _, ok := groups[key]; !ok {
+			groupKeys = append(groupKeys, key)
+		}
+		groups[key] = append(groups[key], m)
+	}
+	for g, key := range groupKeys {
+		// stable measurement ids are suffixed by group to keep them unique within a GetMetricData call
+		groupIds := make(map[string]string)
+		for _, m := range groups[key] {
+			if statConfigs, ok := p.configMap[*m.MetricName]; ok {
+				for _, config := range statConfigs {
+					stat := config.Stat
+					measurement := config.Measurement
+					idString := newQueryId(config.Id, g)
+					if len(config.Id) > 0 {
+						groupIds[config.Id] = idString
 					}
-					if d.Value != nil {
-						dimension.Value = aws.String(*d.Value)
+					if p.verbose {
+						fmt.Printf("Preset.BuildMetricDataQueries: %v %v %v %v %v\n", *m.MetricName, idString, stat, measurement, *m.Namespace)
+					}
+					labelString := measurement
+					dimensions := []types.Dimension{}
+					for _, d := range m.Dimensions {
+						dimension := types.Dimension{}
+						if d.Name != nil {
+							dimension.Name = aws.String(*d.Name)
+						}
+						if d.Value != nil {
+							dimension.Value = aws.String(*d.Value)
+						}
+						dimensions = append(dimensions, dimension)
 					}
-					dimensions = append(dimensions, dimension)
-				}
 
-				dataQuery := types.MetricDataQuery{
-					Id:    &idString,
-					Label: &labelString,
-					MetricStat: &types.MetricStat{
-						Metric: &types.Metric{
-							Dimensions: dimensions,
-							MetricName: aws.String(*m.MetricName),
-							Namespace:  aws.String(*m.Namespace),
+					dataQuery := types.MetricDataQuery{
+						Id:    aws.String(idString),
+						Label: aws.String(labelString),
+						MetricStat: &types.MetricStat{
+							Metric: &types.Metric{
+								Dimensions: dimensions,
+								MetricName: aws.String(*m.MetricName),
+								Namespace:  aws.String(*m.Namespace),
+							},
+							Period: aws.Int32(60 * period),
+							Stat:   aws.String(stat),
 						},
-						Period: aws.Int32(60 * period),
-						Stat:   aws.String(stat),
-					},
-				}
-				dataQueries = append(dataQueries, dataQuery)
+						ReturnData: config.ReturnData,
+					}
+					dataQueries = append(dataQueries, dataQuery)
 
+				}
+			} else {
+				fmt.Printf("Preset.BuildMetricDataQueries no config for: %v\n", *m.MetricName)
 			}
-		} else {
-			fmt.Printf("Preset.BuildMetricDataQueries no config for: %v\n", *m.MetricName)
 		}
+		for _, e := range p.expressions {
+			for _, config := range e.Config {
+				idString := newQueryId(config.Id, g)
+				if len(config.Id) > 0 {
+					groupIds[config.Id] = idString
+				}
+			}
+		}
+		dataQueries = append(dataQueries, p.buildExpressionQueries(groupIds, g)...)
 	}
 	return dataQueries, nil
 }
 
+// buildExpressionQueries rewrites the configured expressions to reference the query ids of a single dimension group,
+// expressions referencing measurements missing from the group are skipped
+func (p *Preset) buildExpressionQueries(groupIds map[string]string, group int) []types.MetricDataQuery {
+	dataQueries := []types.MetricDataQuery{}
+	for _, e := range p.expressions {
+		missing := []string{}
+		referenced := false
+		expression := common.ReplaceExpressionReferences(e.Expression, func(id string) string {
+			if groupId, ok := groupIds[id]; ok {
+				referenced = true
+				return groupId
+			}
+			if p.isDeclaredId(id) {
+				missing = append(missing, id)
+			}
+			return id
+		})
+		if len(missing) > 0 {
+			if p.verbose {
+				fmt.Printf("Preset.BuildMetricDataQueries: skipping expression %v, missing measurements %v\n", e.Expression, missing)
+			}
+			continue
+		}
+		// expressions without measurement references, such as SEARCH, only need to run once
+		if !referenced && group > 0 {
+			continue
+		}
+		for _, config := range e.Config {
+			idString := newQueryId(config.Id, group)
+			if p.verbose {
+				fmt.Printf("Preset.BuildMetricDataQueries: %v %v %v\n", expression, idString, config.Measurement)
+			}
+			dataQuery := types.MetricDataQuery{
+				Id:         aws.String(idString),
+				Label:      aws.String(config.Measurement),
+				Expression: aws.String(expression),
+				ReturnData: config.ReturnData,
+			}
+			dataQueries = append(dataQueries, dataQuery)
+		}
+	}
+	return dataQueries
+}
+
+func (p *Preset) isDeclaredId(id string) bool {
+	for _, statConfigs := range p.configMap {
+		for _, config := range statConfigs {
+			if config.Id == id {
+				return true
+			}
+		}
+	}
+	for _, e := range p.expressions {
+		for _, config := range e.Config {
+			if config.Id == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func newQueryId(id string, group int) string {
+	if len(id) > 0 {
+		return fmt.Sprintf("%v_g%v", id, group)
+	}
+	return "aws_" + strings.ReplaceAll(uuid.New().String(), "-", "_")
+}
+
 // overwrite the Ready function when building a new preset to enforce specific behavior
 func (p *Preset) Ready() error {
 	return nil
@@ -4,6 +4,11 @@ import (
 	"log"
 	"os"
 	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/stretchr/testify/assert"
 )
 
 var (
@@ -30,3 +35,178 @@ func quiet() func() {
 func TestPresetGetMeasurementString(t *testing.T) {
 
 }
+
+func TestPresetGetStatConfig(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	preset := &Preset{}
+	err := preset.SetMeasurementString(`{"namespace":"AWS/Test","measurements":[{"metric":"CPU","config":[{"stat":"Average","measurement":"aws.test.cpu","warning":">80","critical":">95"}]}]}`)
+	assert.NoError(err)
+	err = preset.BuildMeasurementConfig()
+	assert.NoError(err)
+	config, ok := preset.GetStatConfig("CPU", "aws_test_cpu")
+	assert.True(ok)
+	assert.Equal(">80", config.Warning)
+	assert.Equal(">95", config.Critical)
+	_, ok = preset.GetStatConfig("CPU", "aws.test.cpu")
+	assert.False(ok)
+	err = preset.SetMeasurementString(`{"namespace":"AWS/Test","measurements":[{"metric":"CPU","config":[{"stat":"Average","measurement":"aws.test.cpu","warning":"high"}]}]}`)
+	assert.NoError(err)
+	err = preset.BuildMeasurementConfig()
+	assert.Error(err)
+}
+
+func TestPresetBuildExpressionQueries(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	preset := &Preset{}
+	err := preset.SetMeasurementString(`{
+  "namespace": "AWS/ApplicationELB",
+  "measurements": [
+    {"metric": "HTTPCode_Target_5XX_Count", "config": [{"stat": "Sum", "measurement": "aws.alb.target_5xx", "id": "errors", "return-data": false}]},
+    {"metric": "RequestCount", "config": [{"stat": "Sum", "measurement": "aws.alb.request_count", "id": "requests"}]},
+    {"expression": "100 * errors / requests", "config": [{"measurement": "aws.alb.target_5xx_ratio", "critical": ">5"}]}
+  ]
+}`)
+	assert.NoError(err)
+	err = preset.BuildMeasurementConfig()
+	assert.NoError(err)
+	config, ok := preset.GetStatConfig("", "aws_alb_target_5xx_ratio")
+	assert.True(ok)
+	assert.Equal(">5", config.Critical)
+
+	namespace := "AWS/ApplicationELB"
+	metrics := []types.Metric{}
+	for _, lb := range []string{"app/a/1", "app/b/2"} {
+		for _, name := range []string{"HTTPCode_Target_5XX_Count", "RequestCount"} {
+			metrics = append(metrics, types.Metric{
+				MetricName: aws.String(name),
+				Namespace:  &namespace,
+				Dimensions: []types.Dimension{{Name: aws.String("LoadBalancer"), Value: aws.String(lb)}},
+			})
+		}
+	}
+	// a load balancer without errors reported only gets the request count
+	metrics = append(metrics, types.Metric{
+		MetricName: aws.String("RequestCount"),
+		Namespace:  &namespace,
+		Dimensions: []types.Dimension{{Name: aws.String("LoadBalancer"), Value: aws.String("app/c/3")}},
+	})
+	err = preset.AddMetrics(metrics)
+	assert.NoError(err)
+	queries, err := preset.BuildMetricDataQueries(1)
+	assert.NoError(err)
+	assert.Equal(7, len(queries))
+	assert.Equal("errors_g0", *queries[0].Id)
+	assert.False(*queries[0].ReturnData)
+	assert.Equal("requests_g0", *queries[1].Id)
+	assert.Equal("100 * errors_g0 / requests_g0", *queries[2].Expression)
+	assert.Equal("aws_alb_target_5xx_ratio", *queries[2].Label)
+	assert.Nil(queries[2].MetricStat)
+	assert.Equal("100 * errors_g1 / requests_g1", *queries[5].Expression)
+	assert.Equal("requests_g2", *queries[6].Id)
+
+	output, err := preset.GetMeasurementString(false)
+	assert.NoError(err)
+	assert.Contains(output, `"expression": "100 * errors / requests"`)
+}
+
+func TestPresetBuildMeasurementConfigIds(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	preset := &Preset{}
+	err := preset.SetMeasurementString(`{"measurements":[{"metric":"A","config":[{"stat":"Sum","measurement":"a","id":"Bad"}]}]}`)
+	assert.NoError(err)
+	assert.Error(preset.BuildMeasurementConfig())
+	err = preset.SetMeasurementString(`{"measurements":[{"metric":"A","config":[{"stat":"Sum","measurement":"a","id":"m1"}]},{"metric":"B","config":[{"stat":"Sum","measurement":"b","id":"m1"}]}]}`)
+	assert.NoError(err)
+	assert.Error(preset.BuildMeasurementConfig())
+	err = preset.SetMeasurementString(`{"measurements":[{"metric":"A","expression":"m1","config":[{"measurement":"a"}]}]}`)
+	assert.NoError(err)
+	assert.Error(preset.BuildMeasurementConfig())
+}
+
+func TestPresetBuildMeasurementConfigStats(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	preset := &Preset{}
+	err := preset.SetMeasurementString(`{"measurements":[{"metric":"Latency","config":[{"stat":"p99.9","measurement":"aws.test.latency.p99.9"},{"stat":"TM(10%:90%)","measurement":"aws.test.latency.tm_10_90"}]}]}`)
+	assert.NoError(err)
+	assert.NoError(preset.BuildMeasurementConfig())
+	_, ok := preset.GetStatConfig("Latency", "aws_test_latency_p99_9")
+	assert.True(ok)
+	_, ok = preset.GetStatConfig("Latency", "aws_test_latency_tm_10_90")
+	assert.True(ok)
+	err = preset.SetMeasurementString(`{"measurements":[{"metric":"Latency","config":[{"stat":"Average","measurement":"aws.test.latency","unit":"Seconds"}]}]}`)
+	assert.NoError(err)
+	assert.NoError(preset.BuildMeasurementConfig())
+	config, _ := preset.GetStatConfig("Latency", "aws_test_latency")
+	assert.Equal("Seconds", config.Unit)
+	err = preset.SetMeasurementString(`{"measurements":[{"metric":"Latency","config":[{"stat":"Average","measurement":"aws.test.latency","unit":"seconds"}]}]}`)
+	assert.NoError(err)
+	assert.Error(preset.BuildMeasurementConfig())
+	for _, stat := range []string{"", "Avg", "p999", "TM(10%:90)"} {
+		err = preset.SetMeasurementString(`{"measurements":[{"metric":"Latency","config":[{"stat":"` + stat + `","measurement":"aws.test.latency"}]}]}`)
+		assert.NoError(err)
+		assert.Error(preset.BuildMeasurementConfig(), stat)
+	}
+	// configured names are not rewritten beyond dots, invalid names are rejected
+	err = preset.SetMeasurementString(`{"measurements":[{"metric":"Latency","config":[{"stat":"p99","measurement":"aws.test.latency:p99"}]}]}`)
+	assert.NoError(err)
+	assert.Error(preset.BuildMeasurementConfig())
+}
+
+func TestPresetBuildMeasurementConfigGraphiteTemplate(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	preset := &Preset{}
+	err := preset.SetMeasurementString(`{"graphite-template":"aws.{region}.test.{LoadBalancer}.{metric}.{stat}"}`)
+	assert.NoError(err)
+	assert.NoError(preset.BuildMeasurementConfig())
+	assert.Equal("aws.{region}.test.{LoadBalancer}.{metric}.{stat}", preset.GetGraphiteTemplate())
+	output, err := preset.GetMeasurementString(false)
+	assert.NoError(err)
+	assert.Contains(output, `"graphite-template": "aws.{region}.test.{LoadBalancer}.{metric}.{stat}"`)
+	err = preset.SetMeasurementString(`{"graphite-template":"aws.{region.test"}`)
+	assert.NoError(err)
+	assert.Error(preset.BuildMeasurementConfig())
+}
+
+func TestPresetBuildMeasurementConfigDimensionFilterTemplates(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	config := `{"namespace":"AWS/EC2","dimension-filters":["InstanceId={{ .Entity.Labels.aws_instance_id }}"]}`
+	preset := &Preset{}
+	assert.NoError(preset.SetMeasurementString(config))
+	// the template needs the event
+	assert.Error(preset.BuildMeasurementConfig())
+
+	event := v2.FixtureEvent("webserver01", "cloudwatch")
+	event.Entity.Labels = map[string]string{"aws_instance_id": "i-0123456789abcdef0"}
+	preset = &Preset{}
+	assert.NoError(preset.SetEvent(event))
+	assert.NoError(preset.SetMeasurementString(config))
+	assert.NoError(preset.BuildMeasurementConfig())
+	assert.Equal(1, len(preset.DimensionFilters))
+	assert.Equal("InstanceId", aws.ToString(preset.DimensionFilters[0].Name))
+	assert.Equal("i-0123456789abcdef0", aws.ToString(preset.DimensionFilters[0].Value))
+}
+
+func TestPresetClone(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	metric := types.Metric{Namespace: aws.String("AWS/ApplicationELB"), MetricName: aws.String("RequestCount"),
+		Dimensions: []types.Dimension{{Name: aws.String("LoadBalancer"), Value: aws.String("app/my-lb/123")}}}
+	for name, preset := range Presets {
+		assert.NoError(preset.Ready(), name)
+		region := preset.GetRegion()
+		clone := preset.Clone()
+		assert.IsType(preset, clone, name)
+		assert.NoError(clone.SetRegion("eu-west-1"))
+		assert.NoError(clone.AddMetrics([]types.Metric{metric}))
+		assert.Equal(region, preset.GetRegion(), name)
+		original, err := preset.BuildMetricDataQueries(1)
+		assert.NoError(err)
+		assert.Empty(original, name)
+	}
+}
@@ -11,7 +11,7 @@ import (
 func TestEC2Ready(t *testing.T) {
 	defer quiet()()
 	assert := assert.New(t)
-	preset := &EC2{}
+	preset := builtinPreset("EC2")
 	err := preset.SetVerbose(true)
 	assert.NoError(err)
 	err = preset.Ready()
@@ -28,7 +28,7 @@ func TestEC2Ready(t *testing.T) {
 func TestEC2AddMetrics(t *testing.T) {
 	defer quiet()()
 	assert := assert.New(t)
-	preset := &EC2{}
+	preset := builtinPreset("EC2")
 	err := preset.SetVerbose(true)
 	assert.NoError(err)
 	err = preset.Ready()
@@ -65,7 +65,7 @@ func TestEC2AddMetrics(t *testing.T) {
 func TestEC2BuildMetricDataQueries(t *testing.T) {
 	defer quiet()()
 	assert := assert.New(t)
-	preset := &EC2{}
+	preset := builtinPreset("EC2")
 	err := preset.SetVerbose(true)
 	assert.NoError(err)
 	err = preset.Ready()
@@ -89,7 +89,7 @@ func TestEC2BuildMetricDataQueries(t *testing.T) {
 func TestEC2GetMeasurementString(t *testing.T) {
 	defer quiet()()
 	assert := assert.New(t)
-	preset := &EC2{}
+	preset := builtinPreset("EC2")
 	err := preset.SetVerbose(true)
 	assert.NoError(err)
 	err = preset.Ready()
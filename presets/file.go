@@ -0,0 +1,188 @@
+package presets
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// File is a preset defined by a measurement config data file, either one of the built-in presets embedded
+// in the binary or loaded from a --preset-dir, built like any other preset when it is Ready
+type File struct {
+	Preset
+	Metadata PresetMetadata
+	Path     string
+	// builtin presets are embedded in the binary
+	builtin bool
+}
+
+func (p *File) Clone() PresetInterface {
+	return &File{Preset: p.clone(), Metadata: p.Metadata, Path: p.Path, builtin: p.builtin}
+}
+
+// Ready overwrites the Preset Ready function to build the measurement config read from the file
+func (p *File) Ready() error {
+	if p.verbose {
+		fmt.Println("File::Ready Setting up preset from", p.Path)
+	}
+	return p.BuildMeasurementConfig()
+}
+
+// GetRegion returns the region of the measurement config, else the only region the metrics are published in
+func (p *File) GetRegion() string {
+	if len(p.Region) == 0 {
+		return p.Metadata.RequiredRegion
+	}
+	return p.Region
+}
+
+// RequiredRegion returns the only region the metrics of the preset are published in, if any, Ex: us-east-1 for
+// CloudFront
+func RequiredRegion(preset PresetInterface) string {
+	if p, ok := preset.(*File); ok {
+		return p.Metadata.RequiredRegion
+	}
+	return ""
+}
+
+// presetFileExtensions are the measurement config file formats, by file extension
+var presetFileExtensions = map[string]bool{".json": true, ".yaml": true, ".yml": true}
+
+// ReadMeasurementFile reads a JSON or YAML measurement config file, returning it as a JSON measurement config
+// string. YAML files are told apart by their .yaml or .yml extension. Keys not part of the measurement config
+// are an error, so a misspelled key does not silently change the metrics collected.
+func ReadMeasurementFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	config, _, err := parseMeasurementData(path, data)
+	return config, err
+}
+
+// parseMeasurementData validates the JSON or YAML measurement config data of a file, returning it as a JSON
+// measurement config string along with the preset metadata it holds
+func parseMeasurementData(path string, data []byte) (string, PresetMetadata, error) {
+	root, errs := checkConfigNode(path, data)
+	if len(errs) > 0 {
+		return "", PresetMetadata{}, &ValidationErrors{File: path, Errors: errs}
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".yaml" || ext == ".yml" {
+		var err error
+		if data, err = json.Marshal(root.value()); err != nil {
+			return "", PresetMetadata{}, fmt.Errorf("%v: %v", path, err)
+		}
+	}
+	measurementConfig := MeasurementJSON{}
+	if err := json.Unmarshal(data, &measurementConfig); err != nil {
+		return "", PresetMetadata{}, fmt.Errorf("%v: %v", path, err)
+	}
+	return string(data), measurementConfig.PresetMetadata, nil
+}
+
+// newFilePreset checks the measurement config data of a file and builds a preset from it, named by the name
+// of the metadata or else after the file, Ex: rds.yaml becomes the rds preset. The event resolves dimension
+// filter templates, like for the --config measurement config.
+func newFilePreset(path string, data []byte, event *v2.Event) (*File, error) {
+	config, metadata, err := parseMeasurementData(path, data)
+	if err != nil {
+		return nil, err
+	}
+	name := metadata.Name
+	if len(name) == 0 {
+		name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	description := metadata.Description
+	if len(description) == 0 {
+		description = "Preset loaded from " + path
+	}
+	p := &File{Preset: Preset{Name: name, Description: description}, Metadata: metadata, Path: path}
+	if err := p.SetEvent(event); err != nil {
+		return nil, err
+	}
+	if err := p.SetMeasurementString(config); err != nil {
+		return nil, err
+	}
+	// build a copy so the preset is still built once when it is Ready
+	check := p.clone()
+	if err := check.BuildMeasurementConfig(); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	if len(check.Namespace) == 0 {
+		return nil, fmt.Errorf("%v: measurement config has no namespace", path)
+	}
+	return p, nil
+}
+
+// LoadPresetFile reads and checks a measurement config file as a preset
+func LoadPresetFile(path string, event *v2.Event) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newFilePreset(path, data, event)
+}
+
+// loadPresetFS loads every JSON and YAML measurement config file of a directory of the file system,
+// with root naming the directory in errors and preset paths
+func loadPresetFS(fsys fs.FS, root string, event *v2.Event) ([]*File, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	loaded := []*File{}
+	for _, entry := range entries {
+		if entry.IsDir() || !presetFileExtensions[strings.ToLower(filepath.Ext(entry.Name()))] {
+			continue
+		}
+		data, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		p, err := newFilePreset(filepath.Join(root, entry.Name()), data, event)
+		if err != nil {
+			return nil, err
+		}
+		loaded = append(loaded, p)
+	}
+	return loaded, nil
+}
+
+// registerPresets registers presets into Presets by name, returning the names. A name already taken by another
+// preset is an error, and then none of the presets are registered.
+func registerPresets(loaded []*File) ([]string, error) {
+	names := []string{}
+	seen := make(map[string]string)
+	for _, p := range loaded {
+		if _, ok := Presets[p.Name]; ok {
+			return nil, fmt.Errorf("%v: preset %v is already defined", p.Path, p.Name)
+		}
+		if other, ok := seen[p.Name]; ok {
+			return nil, fmt.Errorf("%v: preset %v is already defined by %v", p.Path, p.Name, other)
+		}
+		seen[p.Name] = p.Path
+		names = append(names, p.Name)
+	}
+	for _, p := range loaded {
+		Presets[p.Name] = p
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// LoadPresetDir loads every JSON and YAML measurement config file of a directory, registering each into
+// Presets by name. It returns the names loaded, a name already taken by another preset is an error.
+func LoadPresetDir(dir string, event *v2.Event) ([]string, error) {
+	loaded, err := loadPresetFS(os.DirFS(dir), dir, event)
+	if err != nil {
+		return nil, err
+	}
+	return registerPresets(loaded)
+}
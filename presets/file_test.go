@@ -0,0 +1,122 @@
+package presets
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testPresetYAML = `
+namespace: AWS/RDS
+graphite-template: aws.{region}.rds.{DBInstanceIdentifier}.{metric}.{stat}
+dimension-filters:
+  - DBInstanceIdentifier
+measurements:
+  - metric: CPUUtilization
+    config:
+      - stat: Average
+        measurement: aws.rds.cpu_utilization.average
+        unit: Percent
+        critical: ">90"
+`
+	testPresetJSON = `{"namespace": "AWS/SQS", "measurements": [{"metric": "ApproximateAgeOfOldestMessage", "config": [{"stat": "Maximum", "measurement": "aws.sqs.oldest_message_age.maximum", "unit": "Seconds"}]}]}`
+)
+
+func writePresetFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestReadMeasurementFile(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	dir := writePresetFiles(t, map[string]string{
+		"rds.yaml":     testPresetYAML,
+		"sqs.json":     testPresetJSON,
+		"typo.yml":     "namespace: AWS/RDS\ndimension-filter: [DBInstanceIdentifier]\n",
+		"invalid.json": `{"namespace": "AWS/SQS"`,
+		"keys.yaml":    "namespace: AWS/RDS\n1: one\n",
+	})
+
+	config, err := ReadMeasurementFile(filepath.Join(dir, "rds.yaml"))
+	assert.NoError(err)
+	preset := &Preset{}
+	assert.NoError(preset.SetMeasurementString(config))
+	assert.NoError(preset.BuildMeasurementConfig())
+	assert.Equal("AWS/RDS", preset.GetNamespace())
+	assert.Equal("aws.{region}.rds.{DBInstanceIdentifier}.{metric}.{stat}", preset.GetGraphiteTemplate())
+	stat, ok := preset.GetStatConfig("CPUUtilization", "aws_rds_cpu_utilization_average")
+	assert.True(ok)
+	assert.Equal("Percent", stat.Unit)
+	assert.Equal(">90", stat.Critical)
+
+	config, err = ReadMeasurementFile(filepath.Join(dir, "sqs.json"))
+	assert.NoError(err)
+	assert.Equal(testPresetJSON, config)
+
+	for _, name := range []string{"typo.yml", "invalid.json", "keys.yaml", "missing.json"} {
+		_, err = ReadMeasurementFile(filepath.Join(dir, name))
+		assert.Error(err, name)
+	}
+}
+
+func TestLoadPresetDir(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	dir := writePresetFiles(t, map[string]string{
+		"rds.yaml":  testPresetYAML,
+		"sqs.json":  testPresetJSON,
+		"notes.txt": "not a preset",
+	})
+	names, err := LoadPresetDir(dir, nil)
+	assert.NoError(err)
+	defer delete(Presets, "rds")
+	defer delete(Presets, "sqs")
+	assert.Equal([]string{"rds", "sqs"}, names)
+
+	preset, ok := Presets["rds"].(*File)
+	assert.True(ok)
+	assert.Equal(filepath.Join(dir, "rds.yaml"), preset.Path)
+	assert.Contains(preset.GetDescription(), "rds.yaml")
+	// the preset is built when it is Ready, like the built-in presets
+	assert.Empty(preset.GetNamespace())
+	assert.NoError(preset.Ready())
+	assert.Equal("AWS/RDS", preset.GetNamespace())
+	assert.Equal(1, len(preset.GetDimensionFilters()))
+	assert.Equal("DBInstanceIdentifier", aws.ToString(preset.GetDimensionFilters()[0].Name))
+	clone := preset.Clone()
+	assert.IsType(preset, clone)
+
+	// presets can not be redefined
+	_, err = LoadPresetDir(dir, nil)
+	assert.Error(err)
+	builtin := writePresetFiles(t, map[string]string{"ALB.json": testPresetJSON})
+	_, err = LoadPresetDir(builtin, nil)
+	assert.Error(err)
+	duplicate := writePresetFiles(t, map[string]string{"queue.json": testPresetJSON, "queue.yaml": "namespace: AWS/SQS\n"})
+	_, err = LoadPresetDir(duplicate, nil)
+	assert.Error(err)
+	_, ok = Presets["queue"]
+	assert.False(ok)
+
+	invalid := map[string]string{
+		"namespace.yaml": "measurements: []\n",
+		"stat.yaml":      "namespace: AWS/SQS\nmeasurements:\n  - metric: NumberOfMessagesSent\n    config:\n      - stat: Avg\n        measurement: sent\n",
+		"template.yaml":  "namespace: AWS/EC2\ndimension-filters: ['InstanceId={{ .Entity.Labels.aws_instance_id }}']\n",
+	}
+	for name, content := range invalid {
+		_, err = LoadPresetDir(writePresetFiles(t, map[string]string{name: content}), nil)
+		assert.Error(err, name)
+	}
+	_, err = LoadPresetDir(filepath.Join(dir, "missing"), nil)
+	assert.Error(err)
+}
@@ -0,0 +1,163 @@
+package presets
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/google/uuid"
+	"github.com/sensu/sensu-cloudwatch-check/common"
+)
+
+var (
+	// Setup regexp to pick apart CloudWatch Metrics Insights queries, see:
+	//  https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/cloudwatch-metrics-insights-querylanguage.html
+	matchInsightsSelect  = regexp.MustCompile(`(?is)^\s*SELECT\s+(\w+)\s*\(\s*"?([^")]+?)"?\s*\)\s+FROM\s+(.+?)(?:\s+WHERE\s|\s+GROUP\s+BY\s|\s+ORDER\s+BY\s|\s+LIMIT\s|$)`)
+	matchInsightsSchema  = regexp.MustCompile(`(?is)^SCHEMA\(\s*"?([^",)]+?)"?\s*(?:,|\))`)
+	matchInsightsGroupBy = regexp.MustCompile(`(?is)\sGROUP\s+BY\s+(.+?)(?:\s+ORDER\s+BY\s|\s+LIMIT\s|$)`)
+
+	insightsStats = map[string]string{
+		"AVG":   "Average",
+		"SUM":   "Sum",
+		"MIN":   "Minimum",
+		"MAX":   "Maximum",
+		"COUNT": "SampleCount",
+	}
+)
+
+const insightsQueryId = "insights"
+
+// groupLabelSeparator separates the GROUP BY values in the label of grouped results. Dimension values can hold any
+// UTF-8 character, including the spaces CloudWatch separates them with by default, and dynamic labels can not escape
+// them, so the separator holds a random token drawn once per run which no dimension value is expected to contain.
+var groupLabelSeparator = "\u241f" + strings.ReplaceAll(uuid.New().String(), "-", "") + "\u241f"
+
+// InsightsQuery holds the parts of a Metrics Insights query needed to label its results
+type InsightsQuery struct {
+	Function   string
+	MetricName string
+	Namespace  string
+	GroupBy    []string
+}
+
+// IsInsightsQuery reports whether a data query expression is a Metrics Insights SQL query rather than metric math
+func IsInsightsQuery(expression string) bool {
+	return strings.HasPrefix(strings.ToUpper(strings.TrimSpace(expression)), "SELECT ")
+}
+
+func ParseInsightsQuery(query string) (InsightsQuery, error) {
+	result := InsightsQuery{}
+	m := matchInsightsSelect.FindStringSubmatch(query)
+	if m == nil {
+		return result, fmt.Errorf("could not parse Metrics Insights query: %v", query)
+	}
+	result.Function = strings.ToUpper(m[1])
+	if _, ok := insightsStats[result.Function]; !ok {
+		return result, fmt.Errorf("unsupported Metrics Insights function: %v", m[1])
+	}
+	result.MetricName = strings.TrimSpace(m[2])
+	from := strings.TrimSpace(m[3])
+	if s := matchInsightsSchema.FindStringSubmatch(from); s != nil {
+		result.Namespace = strings.TrimSpace(s[1])
+	} else {
+		result.Namespace = strings.Trim(from, `"`)
+	}
+	if g := matchInsightsGroupBy.FindStringSubmatch(query); g != nil {
+		for _, key := range strings.Split(g[1], ",") {
+			result.GroupBy = append(result.GroupBy, strings.Trim(strings.TrimSpace(key), `"`))
+		}
+	}
+	return result, nil
+}
+
+// Statistic returns the CloudWatch statistic computed by the query function
+func (q InsightsQuery) Statistic() string {
+	return insightsStats[q.Function]
+}
+
+// GroupLabel returns a dynamic label holding the value of every GROUP BY key of the query, so grouped results
+// can be split back into dimensions, see https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/graph-dynamic-labels.html
+func (q InsightsQuery) GroupLabel() string {
+	fields := make([]string, 0, len(q.GroupBy))
+	for _, key := range q.GroupBy {
+		fields = append(fields, fmt.Sprintf("${PROP('Dim.%v')}", key))
+	}
+	return strings.Join(fields, groupLabelSeparator)
+}
+
+// GroupDimensions splits the label of a Metrics Insights result, labeled with the GroupLabel of the query,
+// back into dimensions. A label without exactly one value for every GROUP BY key has no dimensions.
+func (q InsightsQuery) GroupDimensions(label string) []types.Dimension {
+	dimensions := []types.Dimension{}
+	values := strings.Split(label, groupLabelSeparator)
+	if len(q.GroupBy) == 0 || len(values) != len(q.GroupBy) {
+		return dimensions
+	}
+	for i, key := range q.GroupBy {
+		dimensions = append(dimensions, types.Dimension{Name: aws.String(key), Value: aws.String(values[i])})
+	}
+	return dimensions
+}
+
+// Insights runs a single Metrics Insights query instead of discovering metrics with ListMetrics
+type Insights struct {
+	Preset
+	Query       string
+	Measurement string
+	parsed      InsightsQuery
+}
+
+func (p *Insights) Ready() error {
+	if p.verbose {
+		fmt.Println("Insights::Ready Parsing query")
+	}
+	parsed, err := ParseInsightsQuery(p.Query)
+	if err != nil {
+		return err
+	}
+	p.parsed = parsed
+	p.Namespace = parsed.Namespace
+	if len(p.Measurement) == 0 {
+		metric := types.Metric{Namespace: aws.String(parsed.Namespace), MetricName: aws.String(parsed.MetricName)}
+		p.Measurement = common.SanitizeLabel(fmt.Sprintf("%v_%v", common.BuildLabelBase(metric), common.StatisticLabel(parsed.Statistic())))
+	} else if !matchMeasurementName.MatchString(p.Measurement) {
+		return fmt.Errorf("query measurement %q must start with a letter or underscore and only contain letters, numbers, underscores and dots", p.Measurement)
+	} else {
+		p.Measurement = strings.ReplaceAll(p.Measurement, ".", "_")
+	}
+	p.expressions = []MeasurementConfig{{Expression: p.Query, Config: []StatConfig{{Measurement: p.Measurement, Id: insightsQueryId}}}}
+	return nil
+}
+
+func (p *Insights) Clone() PresetInterface {
+	c := *p
+	c.Preset = p.clone()
+	return &c
+}
+
+func (p *Insights) UsesListMetrics() bool {
+	return false
+}
+
+func (p *Insights) AddMetrics(metrics []types.Metric) error {
+	return nil
+}
+
+func (p *Insights) BuildMetricDataQueries(period int32) ([]types.MetricDataQuery, error) {
+	if p.verbose {
+		fmt.Println("Insights::BuildMetricDataQueries")
+	}
+	dataQuery := types.MetricDataQuery{
+		Id:         aws.String(insightsQueryId),
+		Label:      aws.String(p.Measurement),
+		Expression: aws.String(p.Query),
+		Period:     aws.Int32(60 * period),
+	}
+	return []types.MetricDataQuery{dataQuery}, nil
+}
+
+func (p *Insights) GetMeasurementString(pretty bool) (string, error) {
+	return "", fmt.Errorf("Metrics Insights queries have no measurement configuration")
+}
@@ -0,0 +1,99 @@
+package presets
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseInsightsQuery(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	parsed, err := ParseInsightsQuery(`SELECT AVG(CPUUtilization) FROM SCHEMA("AWS/EC2", InstanceId) GROUP BY InstanceId ORDER BY AVG() DESC LIMIT 10`)
+	assert.NoError(err)
+	assert.Equal("AVG", parsed.Function)
+	assert.Equal("CPUUtilization", parsed.MetricName)
+	assert.Equal("AWS/EC2", parsed.Namespace)
+	assert.Equal([]string{"InstanceId"}, parsed.GroupBy)
+
+	parsed, err = ParseInsightsQuery(`select sum("RequestCount") from "AWS/ApplicationELB" where LoadBalancer != 'x' group by LoadBalancer, AvailabilityZone`)
+	assert.NoError(err)
+	assert.Equal("SUM", parsed.Function)
+	assert.Equal("RequestCount", parsed.MetricName)
+	assert.Equal("AWS/ApplicationELB", parsed.Namespace)
+	assert.Equal([]string{"LoadBalancer", "AvailabilityZone"}, parsed.GroupBy)
+
+	parsed, err = ParseInsightsQuery(`SELECT MAX(CPUUtilization) FROM SCHEMA("AWS/EC2")`)
+	assert.NoError(err)
+	assert.Equal("AWS/EC2", parsed.Namespace)
+	assert.Empty(parsed.GroupBy)
+
+	_, err = ParseInsightsQuery(`SELECT MEDIAN(CPUUtilization) FROM SCHEMA("AWS/EC2")`)
+	assert.Error(err)
+	_, err = ParseInsightsQuery(`m1 / m2`)
+	assert.Error(err)
+	assert.True(IsInsightsQuery(` select AVG(x) FROM y`))
+	assert.False(IsInsightsQuery(`SEARCH('{AWS/EC2} CPUUtilization', 'Average')`))
+}
+
+func TestInsightsGroupDimensions(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	parsed := InsightsQuery{GroupBy: []string{"LoadBalancer", "AvailabilityZone"}}
+	assert.Equal("${PROP('Dim.LoadBalancer')}"+groupLabelSeparator+"${PROP('Dim.AvailabilityZone')}", parsed.GroupLabel())
+	dims := parsed.GroupDimensions("app/my-lb/123" + groupLabelSeparator + "us-east-1a")
+	assert.Equal(2, len(dims))
+	assert.Equal("LoadBalancer", *dims[0].Name)
+	assert.Equal("app/my-lb/123", *dims[0].Value)
+	assert.Equal("us-east-1a", *dims[1].Value)
+
+	// values containing spaces, in any group
+	parsed = InsightsQuery{GroupBy: []string{"AutoScalingGroupName", "InstanceType"}}
+	dims = parsed.GroupDimensions("web servers blue" + groupLabelSeparator + "t3.micro")
+	assert.Equal(2, len(dims))
+	assert.Equal("AutoScalingGroupName", *dims[0].Name)
+	assert.Equal("web servers blue", *dims[0].Value)
+	assert.Equal("InstanceType", *dims[1].Name)
+	assert.Equal("t3.micro", *dims[1].Value)
+
+	// values holding any UTF-8 character, including the characters around the separator token
+	dims = parsed.GroupDimensions("web \u241f servers\u241f" + groupLabelSeparator + "t3.micro")
+	assert.Equal(2, len(dims))
+	assert.Equal("web \u241f servers\u241f", *dims[0].Value)
+	assert.Equal("t3.micro", *dims[1].Value)
+
+	single := InsightsQuery{GroupBy: []string{"TargetGroup"}}
+	dims = single.GroupDimensions("targetgroup/my tg/123")
+	assert.Equal(1, len(dims))
+	assert.Equal("targetgroup/my tg/123", *dims[0].Value)
+
+	// labels not split by the group label are not guessed at
+	assert.Empty(parsed.GroupDimensions("web servers blue t3.micro"))
+	assert.Empty(InsightsQuery{}.GroupDimensions("anything"))
+}
+
+func TestInsightsBuildMetricDataQueries(t *testing.T) {
+	defer quiet()()
+	assert := assert.New(t)
+	preset := &Insights{Query: `SELECT AVG(CPUUtilization) FROM SCHEMA("AWS/EC2", InstanceId) GROUP BY InstanceId`}
+	assert.NoError(preset.SetVerbose(true))
+	assert.NoError(preset.Ready())
+	assert.False(preset.UsesListMetrics())
+	assert.Equal("AWS/EC2", preset.GetNamespace())
+	assert.Equal("aws_ec2_cpu_utilization_average", preset.Measurement)
+	_, ok := preset.GetStatConfig("", "aws_ec2_cpu_utilization_average")
+	assert.True(ok)
+	queries, err := preset.BuildMetricDataQueries(5)
+	assert.NoError(err)
+	assert.Equal(1, len(queries))
+	assert.Equal(preset.Query, *queries[0].Expression)
+	assert.Equal(int32(300), *queries[0].Period)
+
+	preset = &Insights{Query: `SELECT AVG(CPUUtilization) FROM SCHEMA("AWS/EC2", InstanceId)`, Measurement: "top.cpu"}
+	assert.NoError(preset.Ready())
+	assert.Equal("top_cpu", preset.Measurement)
+	preset = &Insights{Query: `SELECT AVG(CPUUtilization) FROM SCHEMA("AWS/EC2", InstanceId)`, Measurement: "top-cpu"}
+	assert.Error(preset.Ready())
+	preset = &Insights{Query: `not a query`}
+	assert.Error(preset.Ready())
+}
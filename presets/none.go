@@ -16,6 +16,10 @@ type None struct {
 	Stats []string
 }
 
+func (p *None) Clone() PresetInterface {
+	return &None{Preset: p.clone(), Stats: append([]string{}, p.Stats...)}
+}
+
 func (p *None) GetMeasurementString(pretty bool) (string, error) {
 	if err := p.BuildMeasurementString(); err != nil {
 		return "", err
@@ -60,7 +64,7 @@ func (p *None) BuildMeasurementString() error {
 		}
 
 		for j := range p.Stats {
-			labelString := fmt.Sprintf("%v.%v", common.BuildLabelBase(p.Metrics[i]), common.ToSnakeCase(p.Stats[j]))
+			labelString := fmt.Sprintf("%v.%v", common.BuildLabelBase(p.Metrics[i]), common.StatisticLabel(p.Stats[j]))
 			s := StatConfig{
 				Stat:        p.Stats[j],
 				Measurement: labelString,
@@ -120,7 +124,7 @@ func (p *None) BuildMetricDataQueries(period int32) ([]types.MetricDataQuery, er
 		for j := range p.Stats {
 			id := uuid.New()
 			idString := "aws_" + strings.ReplaceAll(id.String(), "-", "_")
-			labelString := fmt.Sprintf("%v_%v", common.BuildLabelBase(p.Metrics[i]), common.ToSnakeCase(p.Stats[j]))
+			labelString := fmt.Sprintf("%v_%v", common.BuildLabelBase(p.Metrics[i]), common.StatisticLabel(p.Stats[j]))
 			dataQuery := types.MetricDataQuery{
 				Id:    &idString,
 				Label: &labelString,
@@ -0,0 +1,602 @@
+package presets
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+
+	"github.com/sensu/sensu-cloudwatch-check/common"
+	"gopkg.in/yaml.v3"
+)
+
+// Schema is the published JSON Schema of measurement configs, editors can use it to check configs as they are written
+//
+//go:embed schema.json
+var Schema []byte
+
+var (
+	measurementSchema = mustParseSchema(Schema)
+	// Measurement names become metric names, dots are replaced with underscores
+	matchMeasurementName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.]*$`)
+	matchYAMLErrorLine   = regexp.MustCompile(`line (\d+)`)
+	matchInteger         = regexp.MustCompile(`^-?[0-9]+$`)
+)
+
+// ValidationError is a problem found in a measurement config, at the line and column of the value when known
+type ValidationError struct {
+	Line    int
+	Column  int
+	Path    string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	str := e.Message
+	if len(e.Path) > 0 {
+		str = e.Path + ": " + str
+	}
+	if e.Line > 0 {
+		str = fmt.Sprintf("%d:%d: %v", e.Line, e.Column, str)
+	}
+	return str
+}
+
+// ValidationErrors lists every problem found in a measurement config file, ordered by line
+type ValidationErrors struct {
+	File   string
+	Errors []ValidationError
+}
+
+func (e *ValidationErrors) Error() string {
+	lines := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		lines = append(lines, e.File+":"+err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ValidateMeasurementConfig checks JSON, or YAML for files with a .yaml or .yml extension, measurement config data
+// against the Schema and the rules BuildMeasurementConfig relies on: valid statistics, units and thresholds, measurement
+// names and ids that are unique and valid metric names, well formed dimension filters and templates. It returns nil
+// or the *ValidationErrors found.
+func ValidateMeasurementConfig(file string, data []byte) error {
+	_, errs := checkConfigNode(file, data)
+	if len(errs) == 0 {
+		return nil
+	}
+	return &ValidationErrors{File: file, Errors: errs}
+}
+
+// checkConfigNode parses and validates measurement config data, returning the parsed config and the problems found
+func checkConfigNode(file string, data []byte) (*configNode, []ValidationError) {
+	root, err := parseConfigNode(file, data)
+	if err != nil {
+		var validationErr ValidationError
+		if errors.As(err, &validationErr) {
+			return nil, []ValidationError{validationErr}
+		}
+		return nil, []ValidationError{{Message: err.Error()}}
+	}
+	v := &configValidator{}
+	v.checkSchema(root, measurementSchema, "")
+	v.checkRules(root)
+	sort.SliceStable(v.errs, func(i, j int) bool {
+		if v.errs[i].Line != v.errs[j].Line {
+			return v.errs[i].Line < v.errs[j].Line
+		}
+		return v.errs[i].Column < v.errs[j].Column
+	})
+	return root, v.errs
+}
+
+// configNode is a JSON or YAML value of a measurement config, along with its position for line precise errors
+type configNode struct {
+	Kind   string
+	Line   int
+	Column int
+	// Keys of an object, each at the position of the key, with their values at the same index of Items
+	Keys []*configNode
+	// Items are the values of an object or the items of an array
+	Items []*configNode
+	// Value of a scalar, a string, json.Number, bool or nil
+	Value interface{}
+}
+
+// get returns the value of an object key, or nil
+func (n *configNode) get(key string) *configNode {
+	if n == nil || n.Kind != "object" {
+		return nil
+	}
+	for i, k := range n.Keys {
+		if k.Value == key {
+			return n.Items[i]
+		}
+	}
+	return nil
+}
+
+// str returns the value of a string node
+func (n *configNode) str() (string, bool) {
+	if n == nil || n.Kind != "string" {
+		return "", false
+	}
+	return n.Value.(string), true
+}
+
+// value converts the node to the values encoding/json decodes to
+func (n *configNode) value() interface{} {
+	switch n.Kind {
+	case "object":
+		m := make(map[string]interface{}, len(n.Keys))
+		for i, k := range n.Keys {
+			m[k.Value.(string)] = n.Items[i].value()
+		}
+		return m
+	case "array":
+		s := make([]interface{}, 0, len(n.Items))
+		for _, item := range n.Items {
+			s = append(s, item.value())
+		}
+		return s
+	}
+	return n.Value
+}
+
+// parseConfigNode parses JSON, or YAML for files with a .yaml or .yml extension
+func parseConfigNode(file string, data []byte) (*configNode, error) {
+	ext := strings.ToLower(filepath.Ext(file))
+	if ext == ".yaml" || ext == ".yml" {
+		return parseYAMLNode(data)
+	}
+	return parseJSONNode(data)
+}
+
+// position converts a byte offset of the data to a line and column
+func position(data []byte, offset int) (int, int) {
+	if offset > len(data) {
+		offset = len(data)
+	}
+	line := bytes.Count(data[:offset], []byte("\n")) + 1
+	column := offset - bytes.LastIndexByte(data[:offset], '\n')
+	return line, column
+}
+
+func parseJSONNode(data []byte) (*configNode, error) {
+	// the decoder tokens do not tell where syntax errors are, check the syntax first
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		var syntaxErr *json.SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			return nil, err
+		}
+		// the offset is after the invalid character, or the end of the data for truncated data
+		offset := int(syntaxErr.Offset)
+		if offset > 0 && !strings.Contains(syntaxErr.Error(), "unexpected end") {
+			offset--
+		}
+		line, column := position(data, offset)
+		return nil, ValidationError{Line: line, Column: column, Message: "invalid JSON: " + syntaxErr.Error()}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	// the decoder offset is the end of the last token, skip to the start of the next one
+	start := func() (int, int) {
+		offset := int(decoder.InputOffset())
+		for offset < len(data) && strings.IndexByte(" \t\r\n,:", data[offset]) >= 0 {
+			offset++
+		}
+		return position(data, offset)
+	}
+	var parse func() (*configNode, error)
+	parse = func() (*configNode, error) {
+		line, column := start()
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		node := &configNode{Line: line, Column: column, Value: token}
+		switch t := token.(type) {
+		case json.Delim:
+			node.Value = nil
+			if t == '{' {
+				node.Kind = "object"
+			} else {
+				node.Kind = "array"
+			}
+			for decoder.More() {
+				if node.Kind == "object" {
+					keyLine, keyColumn := start()
+					key, err := decoder.Token()
+					if err != nil {
+						return nil, err
+					}
+					node.Keys = append(node.Keys, &configNode{Kind: "string", Line: keyLine, Column: keyColumn, Value: key})
+				}
+				item, err := parse()
+				if err != nil {
+					return nil, err
+				}
+				node.Items = append(node.Items, item)
+			}
+			if _, err := decoder.Token(); err != nil {
+				return nil, err
+			}
+		case string:
+			node.Kind = "string"
+		case json.Number:
+			node.Kind = "number"
+		case bool:
+			node.Kind = "boolean"
+		default:
+			node.Kind = "null"
+		}
+		return node, nil
+	}
+	root, err := parse()
+	if err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+func parseYAMLNode(data []byte) (*configNode, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		line := 0
+		if m := matchYAMLErrorLine.FindStringSubmatch(err.Error()); m != nil {
+			line, _ = strconv.Atoi(m[1])
+		}
+		return nil, ValidationError{Line: line, Column: 1, Message: "invalid YAML: " + strings.TrimPrefix(err.Error(), "yaml: ")}
+	}
+	if len(document.Content) == 0 {
+		return nil, ValidationError{Line: 1, Column: 1, Message: "empty measurement config"}
+	}
+	var convert func(n *yaml.Node) *configNode
+	convert = func(n *yaml.Node) *configNode {
+		if n.Kind == yaml.AliasNode {
+			n = n.Alias
+		}
+		node := &configNode{Line: n.Line, Column: n.Column}
+		switch n.Kind {
+		case yaml.MappingNode:
+			node.Kind = "object"
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				key := n.Content[i]
+				node.Keys = append(node.Keys, &configNode{Kind: "string", Line: key.Line, Column: key.Column, Value: key.Value})
+				node.Items = append(node.Items, convert(n.Content[i+1]))
+			}
+		case yaml.SequenceNode:
+			node.Kind = "array"
+			for _, item := range n.Content {
+				node.Items = append(node.Items, convert(item))
+			}
+		default:
+			switch n.ShortTag() {
+			case "!!int", "!!float":
+				node.Kind = "number"
+				node.Value = json.Number(n.Value)
+			case "!!bool":
+				node.Kind = "boolean"
+				node.Value, _ = strconv.ParseBool(strings.ToLower(n.Value))
+			case "!!null":
+				node.Kind = "null"
+			default:
+				node.Kind = "string"
+				node.Value = n.Value
+			}
+		}
+		return node
+	}
+	return convert(document.Content[0]), nil
+}
+
+// jsonSchema is the subset of JSON Schema the measurement config Schema uses
+type jsonSchema struct {
+	Ref                  string                 `json:"$ref"`
+	Type                 string                 `json:"type"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Required             []string               `json:"required"`
+	Items                *jsonSchema            `json:"items"`
+	MinItems             *int                   `json:"minItems"`
+	MinLength            *int                   `json:"minLength"`
+	Minimum              *float64               `json:"minimum"`
+	Pattern              string                 `json:"pattern"`
+	Definitions          map[string]*jsonSchema `json:"definitions"`
+	pattern              *regexp.Regexp
+}
+
+// schemaKeywords are the JSON Schema keywords checkSchema enforces, along with the annotations it ignores
+var schemaKeywords = map[string]bool{
+	"$ref": true, "type": true, "properties": true, "additionalProperties": true, "required": true, "items": true,
+	"minItems": true, "minLength": true, "minimum": true, "pattern": true, "definitions": true,
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true, "default": true, "examples": true,
+}
+
+// checkSchemaKeywords rejects the keywords of a schema and its subschemas that checkSchema does not enforce, so the
+// published schema can not drift from what is validated
+func checkSchemaKeywords(data []byte, path string) error {
+	keywords := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &keywords); err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	for keyword, value := range keywords {
+		if !schemaKeywords[keyword] {
+			return fmt.Errorf("%v: unsupported schema keyword %q", path, keyword)
+		}
+		switch keyword {
+		case "properties", "definitions":
+			subschemas := make(map[string]json.RawMessage)
+			if err := json.Unmarshal(value, &subschemas); err != nil {
+				return fmt.Errorf("%v/%v: %v", path, keyword, err)
+			}
+			for name, subschema := range subschemas {
+				if err := checkSchemaKeywords(subschema, path+"/"+keyword+"/"+name); err != nil {
+					return err
+				}
+			}
+		case "items":
+			if err := checkSchemaKeywords(value, path+"/items"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func mustParseSchema(data []byte) *jsonSchema {
+	if err := checkSchemaKeywords(data, "#"); err != nil {
+		panic(err)
+	}
+	schema := &jsonSchema{}
+	if err := json.Unmarshal(data, schema); err != nil {
+		panic(err)
+	}
+	var compile func(s *jsonSchema)
+	compile = func(s *jsonSchema) {
+		if s == nil {
+			return
+		}
+		if len(s.Ref) > 0 {
+			if _, ok := schema.Definitions[strings.TrimPrefix(s.Ref, "#/definitions/")]; !ok || !strings.HasPrefix(s.Ref, "#/definitions/") {
+				panic(fmt.Errorf("unsupported schema reference %q", s.Ref))
+			}
+		}
+		if len(s.Pattern) > 0 {
+			s.pattern = regexp.MustCompile(s.Pattern)
+		}
+		for _, p := range s.Properties {
+			compile(p)
+		}
+		for _, d := range s.Definitions {
+			compile(d)
+		}
+		compile(s.Items)
+	}
+	compile(schema)
+	return schema
+}
+
+// configValidator collects the problems found in a measurement config
+type configValidator struct {
+	errs []ValidationError
+}
+
+func (v *configValidator) addError(n *configNode, path string, format string, a ...interface{}) {
+	v.errs = append(v.errs, ValidationError{Line: n.Line, Column: n.Column, Path: path, Message: fmt.Sprintf(format, a...)})
+}
+
+func (v *configValidator) checkSchema(n *configNode, schema *jsonSchema, path string) {
+	if len(schema.Ref) > 0 {
+		schema = measurementSchema.Definitions[strings.TrimPrefix(schema.Ref, "#/definitions/")]
+	}
+	kind := n.Kind
+	if kind == "number" && matchInteger.MatchString(string(n.Value.(json.Number))) {
+		kind = "integer"
+	}
+	if schema.Type == "integer" && n.Kind == "number" && kind != "integer" {
+		v.addError(n, path, "must be a whole number, not %v", n.Value)
+		return
+	}
+	if len(schema.Type) > 0 && schema.Type != kind && !(schema.Type == "number" && kind == "integer") {
+		v.addError(n, path, "must be %v %v, not %v", article(schema.Type), schema.Type, kind)
+		return
+	}
+	switch n.Kind {
+	case "object":
+		for _, key := range schema.Required {
+			if n.get(key) == nil {
+				v.addError(n, path, "missing required key %q", key)
+			}
+		}
+		seen := make(map[string]*configNode)
+		for i, k := range n.Keys {
+			key := k.Value.(string)
+			keyPath := key
+			if len(path) > 0 {
+				keyPath = path + "." + key
+			}
+			if other, ok := seen[key]; ok {
+				v.addError(k, keyPath, "duplicate key, already set at line %v", other.Line)
+			}
+			seen[key] = k
+			if s, ok := schema.Properties[key]; ok {
+				v.checkSchema(n.Items[i], s, keyPath)
+			} else if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+				v.addError(k, keyPath, "unknown key %q", key)
+			}
+		}
+	case "array":
+		if schema.MinItems != nil && len(n.Items) < *schema.MinItems {
+			if *schema.MinItems == 1 {
+				v.addError(n, path, "must not be empty")
+			} else {
+				v.addError(n, path, "must have at least %v items", *schema.MinItems)
+			}
+		}
+		if schema.Items != nil {
+			for i, item := range n.Items {
+				v.checkSchema(item, schema.Items, fmt.Sprintf("%v[%v]", path, i))
+			}
+		}
+	case "string":
+		str := n.Value.(string)
+		if schema.MinLength != nil && utf8.RuneCountInString(str) < *schema.MinLength {
+			v.addError(n, path, "must not be empty")
+		}
+		if schema.pattern != nil && !schema.pattern.MatchString(str) {
+			v.addError(n, path, "%q does not match %v", str, schema.Pattern)
+		}
+	case "number":
+		if value, err := n.Value.(json.Number).Float64(); err != nil {
+			v.addError(n, path, "invalid number %v", n.Value)
+		} else if schema.Minimum != nil && value < *schema.Minimum {
+			v.addError(n, path, "must be at least %v", *schema.Minimum)
+		}
+	}
+}
+
+func article(kind string) string {
+	if strings.IndexByte("aeiou", kind[0]) >= 0 {
+		return "an"
+	}
+	return "a"
+}
+
+// checkRules checks what the schema can not express, values of the wrong type were already reported
+func (v *configValidator) checkRules(root *configNode) {
+	if template, ok := root.get("graphite-template").str(); ok && len(template) > 0 {
+		if err := common.CheckGraphiteTemplate(template); err != nil {
+			v.addError(root.get("graphite-template"), "graphite-template", "%v", err)
+		}
+	}
+	if endpointURL, ok := root.get("endpoint-url").str(); ok {
+		if err := common.CheckHTTPURL(endpointURL); err != nil {
+			v.addError(root.get("endpoint-url"), "endpoint-url", "%v", err)
+		}
+	}
+	if filters := root.get("dimension-filters"); filters != nil && filters.Kind == "array" {
+		for i, filter := range filters.Items {
+			if str, ok := filter.str(); ok && len(str) > 0 {
+				v.checkDimensionFilter(filter, fmt.Sprintf("dimension-filters[%v]", i), str)
+			}
+		}
+	}
+	measurements := root.get("measurements")
+	if measurements == nil || measurements.Kind != "array" {
+		return
+	}
+	// ids and names are checked across every measurement, expressions may reference ids defined after them
+	ids := make(map[string]*configNode)
+	names := make(map[string]*configNode)
+	metrics := make(map[string]*configNode)
+	for i, m := range measurements.Items {
+		for j, config := range m.get("config").arrayItems() {
+			if id, ok := config.get("id").str(); ok && len(id) > 0 {
+				if other, ok := ids[id]; ok {
+					v.addError(config.get("id"), fmt.Sprintf("measurements[%v].config[%v].id", i, j), "id %v is already used at line %v", id, other.Line)
+				} else {
+					ids[id] = config.get("id")
+				}
+			}
+		}
+	}
+	for i, m := range measurements.Items {
+		path := fmt.Sprintf("measurements[%v]", i)
+		if m.Kind != "object" {
+			continue
+		}
+		metric, hasMetric := m.get("metric").str()
+		expression, hasExpression := m.get("expression").str()
+		switch {
+		case hasMetric && hasExpression:
+			v.addError(m, path, "can not set both metric %v and expression %v", metric, expression)
+		case !hasMetric && !hasExpression:
+			v.addError(m, path, "must set either a metric or an expression")
+		case hasMetric:
+			if other, ok := metrics[metric]; ok {
+				v.addError(m.get("metric"), path+".metric", "metric %v is already configured at line %v, list every statistic in a single config", metric, other.Line)
+			} else {
+				metrics[metric] = m.get("metric")
+			}
+		case hasExpression:
+			for _, ref := range common.ExpressionReferences(expression) {
+				// metric math functions are upper case, measurement ids start with a lower case letter
+				if matchQueryId.MatchString(ref) && ids[ref] == nil {
+					v.addError(m.get("expression"), path+".expression", "expression references unknown id %v", ref)
+				}
+			}
+		}
+		for j, config := range m.get("config").arrayItems() {
+			configPath := fmt.Sprintf("%v.config[%v]", path, j)
+			if config.Kind != "object" {
+				continue
+			}
+			stat, hasStat := config.get("stat").str()
+			if hasMetric && !hasExpression {
+				if !hasStat {
+					v.addError(config, configPath, "missing required key %q for metric %v", "stat", metric)
+				} else if !common.ValidStatistic(stat) {
+					v.addError(config.get("stat"), configPath+".stat", "invalid statistic %q, see https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/Statistics-definitions.html", stat)
+				}
+			}
+			if name, ok := config.get("measurement").str(); ok && len(name) > 0 {
+				if !matchMeasurementName.MatchString(name) {
+					v.addError(config.get("measurement"), configPath+".measurement", "measurement %q must start with a letter or underscore and only contain letters, numbers, underscores and dots", name)
+				}
+				sanitized := strings.ReplaceAll(name, ".", "_")
+				if other, ok := names[sanitized]; ok {
+					v.addError(config.get("measurement"), configPath+".measurement", "measurement %v is already used at line %v", sanitized, other.Line)
+				} else {
+					names[sanitized] = config.get("measurement")
+				}
+			}
+			if unit, ok := config.get("unit").str(); ok && len(unit) > 0 && !common.ValidUnit(unit) {
+				v.addError(config.get("unit"), configPath+".unit", "invalid unit %q", unit)
+			}
+			for _, key := range []string{"warning", "critical"} {
+				if threshold, ok := config.get(key).str(); ok {
+					if _, err := common.ParseThreshold(threshold); err != nil {
+						v.addError(config.get(key), configPath+"."+key, "%v", err)
+					}
+				}
+			}
+		}
+	}
+}
+
+// arrayItems returns the items of an array node, or none
+func (n *configNode) arrayItems() []*configNode {
+	if n == nil || n.Kind != "array" {
+		return nil
+	}
+	return n.Items
+}
+
+// checkDimensionFilter checks a Name or Name=Value dimension filter, which may be a template resolved against the event
+func (v *configValidator) checkDimensionFilter(n *configNode, path string, filter string) {
+	if strings.Contains(filter, "{{") {
+		if _, err := template.New("dimension-filter").Parse(filter); err != nil {
+			v.addError(n, path, "invalid template: %v", err)
+		}
+		return
+	}
+	name, value, found := strings.Cut(filter, "=")
+	switch {
+	case len(strings.TrimSpace(name)) == 0:
+		v.addError(n, path, "dimension filter %q has no dimension name", filter)
+	case found && strings.Contains(value, "="):
+		v.addError(n, path, "dimension filter %q must be Name or Name=Value", filter)
+	case found && len(strings.TrimSpace(value)) == 0:
+		v.addError(n, path, "dimension filter %q has an empty value, use %v to match any value", filter, strings.TrimSpace(name))
+	}
+}
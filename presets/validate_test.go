@@ -0,0 +1,150 @@
+package presets
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// validationMessages returns the errors of a measurement config as line:column: path: message strings
+func validationMessages(t *testing.T, file string, data string) []string {
+	err := ValidateMeasurementConfig(file, []byte(data))
+	if err == nil {
+		return nil
+	}
+	var validationErrs *ValidationErrors
+	if !errors.As(err, &validationErrs) {
+		t.Fatalf("unexpected error type %T", err)
+	}
+	messages := []string{}
+	for _, e := range validationErrs.Errors {
+		messages = append(messages, e.Error())
+	}
+	return messages
+}
+
+func TestValidateMeasurementConfig(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(ValidateMeasurementConfig("rds.yaml", []byte(testPresetYAML)))
+	assert.NoError(ValidateMeasurementConfig("sqs.json", []byte(testPresetJSON)))
+	assert.NoError(ValidateMeasurementConfig("--config", []byte(`{"namespace": "AWS/EC2", "dimension-filters": ["InstanceId={{ .Entity.Name }}"],
+		"measurements": [{"metric": "CPUUtilization", "config": [{"stat": "p99.9", "measurement": "cpu", "id": "cpu"}]},
+		{"expression": "cpu * 2 + SUM(METRICS())", "config": [{"measurement": "cpu_double"}]}]}`)))
+
+	for _, name := range []string{"alb", "clb", "ec2", "cloudfront"} {
+		data, err := builtinData.ReadFile("data/" + name + ".json")
+		assert.NoError(err)
+		assert.NoError(ValidateMeasurementConfig(name+".json", data), name)
+	}
+
+	err := ValidateMeasurementConfig("rds.yaml", []byte("namespace: AWS/RDS\nperiod-minutes: 0\n"))
+	assert.EqualError(err, "rds.yaml:2:17: period-minutes: must be at least 1")
+}
+
+func TestValidateMeasurementConfigJSON(t *testing.T) {
+	assert := assert.New(t)
+	config := `{
+  "namespace": "AWS/EC2",
+  "period-minutes": 1.5,
+  "dimension-filters": ["=i-123", "InstanceId={{ .Entity.Name"],
+  "measurements": [
+    {"metric": "CPUUtilization", "config": [
+      {"stat": "Avg", "measurement": "cpu", "unit": "Percnt", "warning": ">>1"},
+      {"stat": "Maximum", "measurement": "1cpu", "id": "Max"}
+    ]},
+    {"metric": "CPUUtilization", "expression": "cpu", "config": [{"measurement": "cpu"}]},
+    {"config": [], "namspace": "AWS/EC2"}
+  ]
+}`
+	assert.Equal([]string{
+		"3:21: period-minutes: must be a whole number, not 1.5",
+		`4:25: dimension-filters[0]: dimension filter "=i-123" has no dimension name`,
+		"4:35: dimension-filters[1]: invalid template: template: dimension-filter:1: unclosed action",
+		`7:16: measurements[0].config[0].stat: invalid statistic "Avg", see https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/Statistics-definitions.html`,
+		`7:53: measurements[0].config[0].unit: invalid unit "Percnt"`,
+		`7:74: measurements[0].config[0].warning: invalid threshold ">>1": strconv.ParseFloat: parsing ">1": invalid syntax`,
+		`8:42: measurements[0].config[1].measurement: measurement "1cpu" must start with a letter or underscore and only contain letters, numbers, underscores and dots`,
+		`8:56: measurements[0].config[1].id: "Max" does not match ^[a-z][a-zA-Z0-9_]*$`,
+		"10:5: measurements[1]: can not set both metric CPUUtilization and expression cpu",
+		"10:82: measurements[1].config[0].measurement: measurement cpu is already used at line 7",
+		"11:5: measurements[2]: must set either a metric or an expression",
+		"11:16: measurements[2].config: must not be empty",
+		`11:20: measurements[2].namspace: unknown key "namspace"`,
+	}, validationMessages(t, "ec2.json", config))
+
+	assert.Equal([]string{"1:109: measurements[1].metric: metric CPUUtilization is already configured at line 1, list every statistic in a single config"},
+		validationMessages(t, "ec2.json", `{"measurements": [{"metric": "CPUUtilization", "config": [{"stat": "Sum", "measurement": "a"}]}, {"metric": "CPUUtilization", "config": [{"stat": "Average", "measurement": "b"}]}]}`))
+	assert.Equal([]string{"1:26: namespace: duplicate key, already set at line 1"},
+		validationMessages(t, "ec2.json", `{"namespace": "AWS/EC2", "namespace": "AWS/EC2"}`))
+	assert.Equal([]string{`1:1: must be an object, not array`}, validationMessages(t, "ec2.json", `[]`))
+	assert.Equal([]string{"2:1: invalid JSON: invalid character '}' looking for beginning of object key string"},
+		validationMessages(t, "ec2.json", "{\"namespace\": \"AWS/EC2\",\n}"))
+	assert.Equal([]string{"1:24: invalid JSON: unexpected end of JSON input"}, validationMessages(t, "ec2.json", `{"namespace": "AWS/EC2"`))
+	assert.Equal([]string{"1:26: invalid JSON: invalid character '{' after top-level value"}, validationMessages(t, "ec2.json", `{"namespace": "AWS/EC2"} {}`))
+}
+
+func TestValidateMeasurementConfigYAML(t *testing.T) {
+	assert := assert.New(t)
+	config := `
+namespace: AWS/RDS
+measurements:
+  - expression: cpu / total
+    config:
+      - measurement: aws.rds.ratio
+        id: ratio
+  - metric: CPUUtilization
+    config:
+      - measurement: aws.rds.cpu
+        id: cpu
+        return-data: "no"
+      - measurement: aws.rds.cpu_max
+        stat: Maximum
+        id: ratio
+`
+	assert.Equal([]string{
+		"4:17: measurements[0].expression: expression references unknown id total",
+		`10:9: measurements[1].config[0]: missing required key "stat" for metric CPUUtilization`,
+		"12:22: measurements[1].config[0].return-data: must be a boolean, not string",
+		"15:13: measurements[1].config[1].id: id ratio is already used at line 7",
+	}, validationMessages(t, "rds.yaml", config))
+
+	assert.Equal([]string{"3:1: invalid YAML: line 3: could not find expected ':'"}, validationMessages(t, "rds.yaml", "namespace: AWS/RDS\nmeasurements:\nfoo\n"))
+	assert.Equal([]string{"1:1: empty measurement config"}, validationMessages(t, "rds.yml", ""))
+	assert.Equal([]string{`2:1: 1: unknown key "1"`}, validationMessages(t, "keys.yaml", "namespace: AWS/RDS\n1: one\n"))
+
+	err := ValidateMeasurementConfig("rds.yaml", []byte(config))
+	assert.True(strings.HasPrefix(err.Error(), "rds.yaml:4:17: measurements[0].expression: expression references unknown id total\nrds.yaml:10:9: "))
+}
+
+func TestSchema(t *testing.T) {
+	assert := assert.New(t)
+	var schema map[string]interface{}
+	assert.NoError(json.Unmarshal(Schema, &schema))
+	// every key of the measurement config is described by the schema
+	properties := schema["properties"].(map[string]interface{})
+	for _, key := range []string{"name", "description", "required-region", "reference", "date", "notes", "namespace", "period-minutes", "region", "endpoint-url", "graphite-template", "metric-filter", "dimension-filters", "measurements"} {
+		assert.Contains(properties, key)
+	}
+	data, err := json.Marshal(MeasurementJSON{})
+	assert.NoError(err)
+	var keys map[string]interface{}
+	assert.NoError(json.Unmarshal(data, &keys))
+	for key := range keys {
+		assert.Contains(properties, key)
+	}
+}
+
+func TestCheckSchemaKeywords(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(checkSchemaKeywords(Schema, "#"))
+	assert.EqualError(checkSchemaKeywords([]byte(`{"properties": {"unit": {"type": "string", "enum": ["Seconds"]}}}`), "#"),
+		`#/properties/unit: unsupported schema keyword "enum"`)
+	assert.EqualError(checkSchemaKeywords([]byte(`{"definitions": {"stat": {"items": {"oneOf": []}}}}`), "#"),
+		`#/definitions/stat/items: unsupported schema keyword "oneOf"`)
+	assert.Panics(func() { mustParseSchema([]byte(`{"type": "object", "anyOf": []}`)) })
+	assert.Panics(func() { mustParseSchema([]byte(`{"items": {"$ref": "#/definitions/missing"}}`)) })
+	assert.NotPanics(func() { mustParseSchema(Schema) })
+}
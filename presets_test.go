@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sensu/sensu-cloudwatch-check/presets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPresetsCommand(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	assert.Equal(0, presetsCommand(&buf, []string{"list"}))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(6, len(lines))
+	assert.True(strings.HasPrefix(lines[0], "NAME"))
+	assert.Regexp(`^CloudFront\s+AWS/CloudFront\s+us-east-1\s+19\s+23\s+built-in\s+Preset Metrics for AWS CloudFront`, lines[3])
+
+	buf.Reset()
+	assert.Equal(0, presetsCommand(&buf, []string{"list", "--format", "json"}))
+	summaries := []presets.PresetSummary{}
+	assert.NoError(json.Unmarshal(buf.Bytes(), &summaries))
+	assert.Equal(5, len(summaries))
+	assert.Equal("EC2", summaries[3].Name)
+
+	// the json format of show is a measurement config, valid for --config-file
+	buf.Reset()
+	assert.Equal(0, presetsCommand(&buf, []string{"show", "--format=json", "EC2"}))
+	assert.NoError(presets.ValidateMeasurementConfig("ec2.json", buf.Bytes()))
+	config := presets.MeasurementJSON{}
+	assert.NoError(json.Unmarshal(buf.Bytes(), &config))
+	assert.Equal("EC2", config.Name)
+	assert.Equal("AWS/EC2", config.Namespace)
+
+	buf.Reset()
+	assert.Equal(0, presetsCommand(&buf, []string{"show", "ALB"}))
+	assert.Contains(buf.String(), "Namespace:    AWS/ApplicationELB\n")
+	assert.Regexp(`\nTargetResponseTime\s+p99\.9\s+aws_alb_target_response_time_p99_9\s+Seconds\s+-\s+-\s+-\n`, buf.String())
+	assert.Contains(buf.String(), `"namespace": "AWS/ApplicationELB"`)
+
+	dir := t.TempDir()
+	config = presets.MeasurementJSON{Namespace: "AWS/ApplicationELB", Measurements: []presets.MeasurementConfig{
+		{MetricName: "RequestCount", Config: []presets.StatConfig{{Stat: "Sum", Measurement: "requests", Id: "requests"}}},
+		{Expression: "requests / 60", Config: []presets.StatConfig{{Measurement: "request_rate", Critical: ">100"}}},
+	}}
+	data, err := json.Marshal(config)
+	assert.NoError(err)
+	assert.NoError(os.WriteFile(filepath.Join(dir, "rate.json"), data, 0644))
+	buf.Reset()
+	assert.Equal(0, presetsCommand(&buf, []string{"show", "rate", "--preset-dir", dir}))
+	delete(presets.Presets, "rate")
+	assert.Regexp(`\n= requests / 60\s+-\s+request_rate\s+-\s+-\s+>100\s+-\n`, buf.String())
+
+	buf.Reset()
+	assert.Equal(1, presetsCommand(&buf, []string{"show", "Missing"}))
+	assert.Equal("preset Missing not defined, choose from: ALB, CLB, CloudFront, EC2, None\n", buf.String())
+	assert.Equal(1, presetsCommand(&buf, []string{"list", "--preset-dir", filepath.Join(dir, "missing")}))
+	assert.Equal(2, presetsCommand(&buf, []string{"show"}))
+	assert.Equal(2, presetsCommand(&buf, []string{"describe"}))
+	assert.Equal(2, presetsCommand(&buf, []string{"list", "--format", "yaml"}))
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	sensuAWS "github.com/sensu/sensu-cloudwatch-check/aws"
+	"github.com/sensu/sensu-cloudwatch-check/common"
+	"github.com/sensu/sensu-cloudwatch-check/presets"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// allEnabledRegions selects every region enabled for the account with --regions
+const allEnabledRegions = "all-enabled"
+
+// enabledRegions looks up the regions enabled for the account, replaced in tests
+var enabledRegions = sensuAWS.EnabledRegions
+
+// regionClient is the CloudWatch client of a single region. Region is empty when the check runs
+// for the region of the AWS config only, in which case points are not tagged with a region.
+type regionClient struct {
+	Region string
+	Client ServiceAPI
+}
+
+// regionResult collects everything a single region contributes to the check output
+type regionResult struct {
+	Region string
+	// State is the worst state of the problems found in the region, thresholds are evaluated when reporting
+	State          int
+	Problems       []string
+	Discovery      discoveryResult
+	NumQueries     int
+	NumResults     int
+	Unused         []MetricQueryMap
+	DataMessages   []types.MessageData
+	StatusWarnings []string
+	// Queries holds the queries with datapoints to output, with a state file only the datapoints not output by
+	// previous runs
+	Queries []MetricQueryMap
+	// Evaluated holds the queries with datapoints, with every datapoint fetched, their thresholds are evaluated on
+	// the latest one whether or not it was output by a previous run
+	Evaluated []MetricQueryMap
+}
+
+// fail records a problem stopping the region from returning results
+func (r *regionResult) fail(state int, message string) *regionResult {
+	if state > r.State {
+		r.State = state
+	}
+	severity := "Warning"
+	if state == sensu.CheckStateCritical {
+		severity = "Error"
+	}
+	r.Problems = append(r.Problems, fmt.Sprintf("%v: %v%v", severity, r.prefix(), message))
+	return r
+}
+
+// prefix names the region in messages when the check runs for several regions
+func (r *regionResult) prefix() string {
+	if len(r.Region) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("region %v: ", r.Region)
+}
+
+// collectRegion discovers the metrics of the preset in a single region and fetches their data
+func collectRegion(ctx context.Context, r regionClient, preset presets.PresetInterface) *regionResult {
+	result := &regionResult{Region: r.Region}
+	client := newRateLimitedClient(r.Client, plugin.RequestsPerSecond)
+	metricDataQueries, periodMinutes, ok := regionQueries(ctx, client, preset, result)
+	if !ok {
+		return result
+	}
+	getData(client, preset, metricDataQueries, periodMinutes, result)
+	return result
+}
+
+// regionQueries discovers the metrics of the preset in the region of the result and builds their data queries,
+// recording the discovery into the result. It returns false when the region failed.
+func regionQueries(ctx context.Context, client ServiceAPI, preset presets.PresetInterface, result *regionResult) ([]types.MetricDataQuery, int, bool) {
+	if len(result.Region) > 0 {
+		if err := preset.SetRegion(result.Region); err != nil {
+			result.fail(sensu.CheckStateCritical, "Preset SetRegion error")
+			return nil, 0, false
+		}
+	}
+	if preset.UsesListMetrics() {
+		discovery, err := discoverMetrics(ctx, client, preset, plugin.MaxPages)
+		result.Discovery = discovery
+		if err != nil {
+			result.fail(sensu.CheckStateCritical, err.Error())
+			return nil, 0, false
+		}
+	}
+	periodMinutes := plugin.PeriodMinutes
+	if p := preset.GetPeriodMinutes(); p > 0 {
+		periodMinutes = p
+	}
+	metricDataQueries, err := preset.BuildMetricDataQueries(int32(periodMinutes))
+	if err != nil {
+		result.fail(sensu.CheckStateCritical, "Could not build DataQuery")
+		return nil, 0, false
+	}
+	if len(metricDataQueries) == 0 {
+		result.fail(sensu.CheckStateWarning, "No metricDataQueries to process")
+		return nil, 0, false
+	}
+	return metricDataQueries, periodMinutes, true
+}
+
+// resolveRegions expands the --regions list, looking up the regions enabled for the account for all-enabled.
+// Presets with a required region, like CloudFront, only run in that region whatever the list.
+func resolveRegions(ctx context.Context, preset presets.PresetInterface, regions []string) ([]string, error) {
+	if region := presets.RequiredRegion(preset); len(region) > 0 {
+		return []string{region}, nil
+	}
+	if len(regions) == 1 && regions[0] == allEnabledRegions {
+		return enabledRegions(ctx, *plugin.AWSConfig)
+	}
+	return regions, nil
+}
+
+// reportRegions prints the results of all regions as a single check output. The check state is the worst
+// state of any region problem, incomplete result or breached threshold.
+func reportRegions(results []*regionResult) (int, error) {
+	state := sensu.CheckStateOK
+	var problems, statusWarnings, truncated []string
+	var dataMessages []types.MessageData
+	var queries, evaluated []MetricQueryMap
+	for _, r := range results {
+		if plugin.Verbose {
+			if len(r.Region) > 0 {
+				fmt.Printf("\nRegion %v:\n", r.Region)
+			}
+			fmt.Println("Found " + strconv.Itoa(r.Discovery.Metrics) + " metrics")
+			fmt.Println("Result Pages " + strconv.Itoa(r.Discovery.Pages))
+			if r.Discovery.Truncated {
+				fmt.Println("More result pages available")
+			}
+			fmt.Println("\nExecution Summary:")
+			fmt.Printf("  MetricDataQueries: %v\n", r.NumQueries)
+			fmt.Printf("  Number of MetricDataResults: %v\n", r.NumResults)
+			if len(r.Unused) > 0 {
+				fmt.Printf("  MetricDataQueries with no results:\n")
+
+				region := r.Region
+				if len(region) == 0 {
+					region = plugin.AWSConfig.Region
+				}
+				for _, q := range r.Unused {
+					fmt.Printf("    Label: %v\n      Namespace:%v MetricName:%v Region:%v Dimensions:%v\n",
+						q.Label, q.Namespace, q.MetricName, region, common.DimString(q.Dimensions))
+				}
+			}
+		}
+		if r.State > state {
+			state = r.State
+		}
+		problems = append(problems, r.Problems...)
+		for _, warning := range r.StatusWarnings {
+			statusWarnings = append(statusWarnings, r.prefix()+warning)
+		}
+		if r.Discovery.Truncated {
+			truncated = append(truncated, fmt.Sprintf("Warning: %v%v", r.prefix(), r.Discovery.Warning(plugin.MaxPages)))
+		}
+		dataMessages = append(dataMessages, r.DataMessages...)
+		queries = append(queries, r.Queries...)
+		evaluated = append(evaluated, r.Evaluated...)
+	}
+	if plugin.Verbose {
+		fmt.Println("")
+		fmt.Println("Normal Output:")
+	}
+	if plugin.AccountIDErr != nil {
+		problems = append(problems, fmt.Sprintf("Warning: could not get the account id, points are not tagged with it: %v", plugin.AccountIDErr))
+		if state < sensu.CheckStateWarning {
+			state = sensu.CheckStateWarning
+		}
+	}
+	if entity := entityProblems(queries); len(entity) > 0 {
+		problems = append(problems, entity...)
+		if state < sensu.CheckStateWarning {
+			state = sensu.CheckStateWarning
+		}
+	}
+	// comment lines describing problems, printed before the metrics output
+	lines := append([]string{}, problems...)
+	if len(dataMessages) > 0 {
+		lines = append(lines, "Warning: Some calls to GetMetricData resulted in error messages")
+		for _, m := range dataMessages {
+			lines = append(lines, fmt.Sprintf("GetMetricData:: Code: %v Message: %v", *m.Code, *m.Value))
+		}
+		if state < sensu.CheckStateWarning {
+			state = sensu.CheckStateWarning
+		}
+	}
+	thresholdState, summary := evaluateThresholds(thresholdQueries(evaluated))
+	if thresholdState > state {
+		state = thresholdState
+	}
+	if len(statusWarnings) > 0 {
+		lines = append(lines, "Warning: Some GetMetricData results are incomplete")
+		lines = append(lines, statusWarnings...)
+		if state < sensu.CheckStateWarning {
+			state = sensu.CheckStateWarning
+		}
+	}
+	if len(truncated) > 0 && state < sensu.CheckStateWarning {
+		state = sensu.CheckStateWarning
+	}
+	writer := bufio.NewWriter(os.Stdout)
+	defer writer.Flush()
+	if report, ok := reportFormats[plugin.OutputFormat]; ok {
+		err := report(writer, checkReport{State: state, Summary: summary, Problems: append(lines, truncated...), Queries: queries})
+		if err != nil {
+			return sensu.CheckStateCritical, err
+		}
+		if err := writer.Flush(); err != nil {
+			return sensu.CheckStateCritical, err
+		}
+		return state, nil
+	}
+	for _, line := range append(lines, summary...) {
+		fmt.Fprintf(writer, "# %v\n", line)
+	}
+	if len(queries) > 0 {
+		err := outputFormats[plugin.OutputFormat](writer, queries)
+		if err != nil {
+			return sensu.CheckStateCritical, err
+		}
+	}
+	if len(truncated) > 0 {
+		fmt.Fprintf(writer, "\n# %v\n", strings.Join(truncated, "\n# "))
+	}
+	if err := writer.Flush(); err != nil {
+		return sensu.CheckStateCritical, err
+	}
+	return state, nil
+}
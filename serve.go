@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/sensu/sensu-cloudwatch-check/presets"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// serveMode is set by the serve subcommand, which runs the check as a Prometheus exporter
+var serveMode bool
+
+// Prometheus label values escape backslashes, double quotes and line feeds
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Prometheus help texts escape backslashes and line feeds
+var promHelpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// scrapeTarget is a preset served at its own scrape interval
+type scrapeTarget struct {
+	Name     string
+	Preset   presets.PresetInterface
+	Interval time.Duration
+}
+
+// scrapeTargets returns the presets of --scrape-presets, each at its NAME=SECONDS interval or the --scrape-interval,
+// else the preset selected like for the check
+func scrapeTargets() ([]scrapeTarget, error) {
+	if plugin.ScrapeInterval < 1 {
+		return nil, fmt.Errorf("--scrape-interval must be at least 1 second")
+	}
+	interval := time.Duration(plugin.ScrapeInterval) * time.Second
+	if len(plugin.ScrapePresets) == 0 {
+		return []scrapeTarget{{Name: plugin.PresetName, Preset: plugin.Preset, Interval: interval}}, nil
+	}
+	names := []string{}
+	for _, name := range presets.PresetNames() {
+		if name != "None" {
+			names = append(names, name)
+		}
+	}
+	targets := []scrapeTarget{}
+	seen := make(map[string]bool)
+	for _, entry := range plugin.ScrapePresets {
+		name, seconds, found := strings.Cut(strings.TrimSpace(entry), "=")
+		target := scrapeTarget{Name: strings.TrimSpace(name), Interval: interval}
+		preset, ok := presets.Presets[target.Name]
+		if !ok || target.Name == "None" {
+			return nil, fmt.Errorf("--scrape-presets %v: preset not defined, choose from: %v", entry, strings.Join(names, ", "))
+		}
+		if seen[target.Name] {
+			return nil, fmt.Errorf("--scrape-presets %v: preset is listed more than once", entry)
+		}
+		seen[target.Name] = true
+		if found {
+			s, err := strconv.Atoi(strings.TrimSpace(seconds))
+			if err != nil || s < 1 {
+				return nil, fmt.Errorf("--scrape-presets %v: scrape interval must be a number of seconds", entry)
+			}
+			target.Interval = time.Duration(s) * time.Second
+		}
+		target.Preset = preset.Clone()
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// apiCounter counts the CloudWatch API calls of a served preset by API name, along with the calls that failed
+// and the attempts that were throttled
+type apiCounter struct {
+	mu        sync.Mutex
+	calls     map[string]int
+	errors    map[string]int
+	throttles map[string]int
+}
+
+func newAPICounter() *apiCounter {
+	return &apiCounter{calls: make(map[string]int), errors: make(map[string]int), throttles: make(map[string]int)}
+}
+
+// apiOptions adds the middlewares counting the calls of a CloudWatch client. Calls and errors are counted once per
+// call, throttles for every attempt, as the SDK retries throttled attempts and the call only fails once it runs out
+// of retries.
+func (c *apiCounter) apiOptions(o *cloudwatch.Options) {
+	o.APIOptions = append(o.APIOptions, c.addMiddlewares)
+}
+
+func (c *apiCounter) addMiddlewares(stack *middleware.Stack) error {
+	countCalls := middleware.InitializeMiddlewareFunc("CountCalls", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (
+		middleware.InitializeOutput, middleware.Metadata, error) {
+		out, metadata, err := next.HandleInitialize(ctx, in)
+		c.recordCall(awsmiddleware.GetOperationName(ctx), err)
+		return out, metadata, err
+	})
+	if err := stack.Initialize.Add(countCalls, middleware.After); err != nil {
+		return err
+	}
+	countThrottles := middleware.FinalizeMiddlewareFunc("CountThrottles", func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (
+		middleware.FinalizeOutput, middleware.Metadata, error) {
+		out, metadata, err := next.HandleFinalize(ctx, in)
+		if err != nil && retry.IsErrorThrottles(retry.DefaultThrottles).IsErrorThrottle(err) == aws.TrueTernary {
+			c.recordThrottle(awsmiddleware.GetOperationName(ctx))
+		}
+		return out, metadata, err
+	})
+	// inserted after the retry middleware, so it runs for every attempt
+	return stack.Finalize.Insert(countThrottles, (&retry.Attempt{}).ID(), middleware.After)
+}
+
+func (c *apiCounter) recordCall(api string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls[api]++
+	if err != nil {
+		c.errors[api]++
+	}
+}
+
+func (c *apiCounter) recordThrottle(api string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.throttles[api]++
+}
+
+// scrapeJob collects the metrics of a preset on its own schedule, keeping the output of the latest successful scrape
+type scrapeJob struct {
+	target  scrapeTarget
+	regions []regionClient
+	counter *apiCounter
+
+	mu           sync.Mutex
+	families     []promFamily
+	scrapes      int
+	scrapeErrors int
+	lastSuccess  time.Time
+	lastError    string
+	duration     time.Duration
+}
+
+// newScrapeJob creates the scrape job of a target, the counter counts the calls of the region clients
+func newScrapeJob(target scrapeTarget, regions []regionClient, counter *apiCounter) *scrapeJob {
+	return &scrapeJob{target: target, regions: regions, counter: counter}
+}
+
+// scrape collects the metrics of every region of the preset. A region failing keeps the metrics of the previous
+// scrape, so series do not disappear on a transient error.
+func (j *scrapeJob) scrape(ctx context.Context) {
+	start := time.Now()
+	var queries []MetricQueryMap
+	var problems []string
+	for _, r := range collectRegions(ctx, j.regions, j.target.Preset) {
+		if r.State == sensu.CheckStateCritical {
+			problems = append(problems, r.Problems...)
+		}
+		queries = append(queries, r.Queries...)
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.scrapes++
+	j.duration = time.Since(start)
+	if len(problems) > 0 {
+		j.scrapeErrors++
+		j.lastError = strings.Join(problems, "; ")
+		if plugin.Verbose {
+			fmt.Printf("Preset %v scrape failed: %v\n", j.target.Name, j.lastError)
+		}
+		return
+	}
+	j.families = latestFamilies(queries)
+	j.lastError = ""
+	j.lastSuccess = time.Now()
+}
+
+// run scrapes right away, then at every interval until the context is done
+func (j *scrapeJob) run(ctx context.Context) {
+	ticker := time.NewTicker(j.target.Interval)
+	defer ticker.Stop()
+	for {
+		j.scrape(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// exporter serves the latest metrics of the scrape jobs along with metrics about the jobs themselves
+type exporter struct {
+	jobs []*scrapeJob
+}
+
+func (e *exporter) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", e.serveMetrics)
+	mux.HandleFunc("/healthz", e.serveHealthz)
+	return mux
+}
+
+func (e *exporter) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := e.writeMetrics(w); err != nil {
+		return
+	}
+	_ = e.writeSelfMetrics(w)
+}
+
+// promFamily is a metric family of the CloudWatch metrics, with the latest datapoint of each of its series
+type promFamily struct {
+	name    string
+	help    string
+	samples []promSeries
+}
+
+// promSeries is the latest datapoint of a series, with its labels already formatted and its timestamp in milliseconds
+type promSeries struct {
+	labels    string
+	value     float64
+	timestamp int64
+}
+
+// latestFamilies groups the latest datapoint of every series by metric name, sorted by name. Prometheus rejects
+// samples older than the latest one it ingested for a series, so a series exposes a single sample, with the
+// timestamp of its CloudWatch datapoint, rather than every datapoint of the period.
+func latestFamilies(queries []MetricQueryMap) []promFamily {
+	byName := make(map[string]*promFamily)
+	names := []string{}
+	for _, q := range queries {
+		i, ok := q.latestIndex()
+		if !ok {
+			continue
+		}
+		f, ok := byName[q.Label]
+		if !ok {
+			measured := "MetricName:" + q.MetricName
+			if len(q.Expression) > 0 {
+				measured = "Expression:" + q.Expression
+			}
+			f = &promFamily{name: q.Label, help: fmt.Sprintf("Namespace:%v %v", q.Namespace, measured)}
+			byName[q.Label] = f
+			names = append(names, q.Label)
+		}
+		f.samples = append(f.samples, promSeries{
+			labels:    q.promLabels(),
+			value:     q.MetricDataResult.Values[i],
+			timestamp: q.MetricDataResult.Timestamps[i].UnixMilli(),
+		})
+	}
+	sort.Strings(names)
+	families := []promFamily{}
+	for _, name := range names {
+		families = append(families, *byName[name])
+	}
+	return families
+}
+
+// promLabels formats the dimensions of the query as Prometheus labels, along with its account and region
+func (q MetricQueryMap) promLabels() string {
+	labels := []string{}
+	for _, d := range q.Dimensions {
+		labels = append(labels, fmt.Sprintf(`%v="%v"`, aws.ToString(d.Name), promLabelEscaper.Replace(aws.ToString(d.Value))))
+	}
+	if len(q.AccountId) > 0 {
+		labels = append(labels, fmt.Sprintf(`aws_account_id="%v"`, q.AccountId))
+	}
+	if len(q.Region) > 0 {
+		labels = append(labels, fmt.Sprintf(`aws_region="%v"`, q.Region))
+	}
+	return strings.Join(labels, ",")
+}
+
+// writeMetrics writes the CloudWatch metrics of every preset, merging the families of the presets so each metric
+// has a single HELP and TYPE header. A series measured by several presets is written once, for the first preset.
+func (e *exporter) writeMetrics(w io.Writer) error {
+	byName := make(map[string]*promFamily)
+	names := []string{}
+	for _, j := range e.jobs {
+		j.mu.Lock()
+		families := j.families
+		j.mu.Unlock()
+		for _, f := range families {
+			merged, ok := byName[f.name]
+			if !ok {
+				merged = &promFamily{name: f.name, help: f.help}
+				byName[f.name] = merged
+				names = append(names, f.name)
+			}
+			merged.samples = append(merged.samples, f.samples...)
+		}
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		f := byName[name]
+		fmt.Fprintf(&b, "# HELP %v %v\n# TYPE %v gauge\n", name, promHelpEscaper.Replace(f.help), name)
+		seen := make(map[string]bool)
+		for _, s := range f.samples {
+			if seen[s.labels] {
+				continue
+			}
+			seen[s.labels] = true
+			fmt.Fprintf(&b, "%v{%v} %v %v\n", name, s.labels, strconv.FormatFloat(s.value, 'f', -1, 64), s.timestamp)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeSelfMetrics writes the CloudWatch API calls, errors and throttles and the scrape results of every preset
+func (e *exporter) writeSelfMetrics(w io.Writer) error {
+	families := []struct {
+		name    string
+		kind    string
+		help    string
+		samples func(j *scrapeJob) []promSample
+	}{
+		{"cloudwatch_check_api_calls_total", "counter", "CloudWatch API calls by preset and API", func(j *scrapeJob) []promSample {
+			return apiSamples(j, j.counter.calls)
+		}},
+		{"cloudwatch_check_api_errors_total", "counter", "CloudWatch API calls that failed by preset and API", func(j *scrapeJob) []promSample {
+			return apiSamples(j, j.counter.errors)
+		}},
+		{"cloudwatch_check_api_throttles_total", "counter", "CloudWatch API call attempts that were throttled, retried or not, by preset and API", func(j *scrapeJob) []promSample {
+			return apiSamples(j, j.counter.throttles)
+		}},
+		{"cloudwatch_check_scrapes_total", "counter", "Scrapes of the CloudWatch metrics of the preset", func(j *scrapeJob) []promSample {
+			return []promSample{{presetLabel(j), float64(j.scrapes)}}
+		}},
+		{"cloudwatch_check_scrape_errors_total", "counter", "Scrapes of the CloudWatch metrics of the preset that failed", func(j *scrapeJob) []promSample {
+			return []promSample{{presetLabel(j), float64(j.scrapeErrors)}}
+		}},
+		{"cloudwatch_check_scrape_duration_seconds", "gauge", "Duration of the latest scrape of the preset", func(j *scrapeJob) []promSample {
+			return []promSample{{presetLabel(j), j.duration.Seconds()}}
+		}},
+		{"cloudwatch_check_last_success_timestamp_seconds", "gauge", "Time of the latest successful scrape of the preset, zero before the first one", func(j *scrapeJob) []promSample {
+			value := 0.0
+			if !j.lastSuccess.IsZero() {
+				value = float64(j.lastSuccess.UnixNano()) / 1e9
+			}
+			return []promSample{{presetLabel(j), value}}
+		}},
+	}
+	var b strings.Builder
+	for _, f := range families {
+		fmt.Fprintf(&b, "# HELP %v %v\n# TYPE %v %v\n", f.name, f.help, f.name, f.kind)
+		for _, j := range e.jobs {
+			j.mu.Lock()
+			j.counter.mu.Lock()
+			samples := f.samples(j)
+			j.counter.mu.Unlock()
+			j.mu.Unlock()
+			for _, s := range samples {
+				fmt.Fprintf(&b, "%v{%v} %v\n", f.name, s.labels, strconv.FormatFloat(s.value, 'f', -1, 64))
+			}
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func presetLabel(j *scrapeJob) string {
+	return fmt.Sprintf(`preset="%v"`, promLabelEscaper.Replace(j.target.Name))
+}
+
+// promSample is a sample of a self-metric, with its labels already formatted
+type promSample struct {
+	labels string
+	value  float64
+}
+
+// apiSamples returns a sample per API, both APIs are always listed so the counters start at zero
+func apiSamples(j *scrapeJob, counts map[string]int) []promSample {
+	samples := []promSample{}
+	for _, api := range []string{"GetMetricData", "ListMetrics"} {
+		samples = append(samples, promSample{fmt.Sprintf(`%v,api="%v"`, presetLabel(j), api), float64(counts[api])})
+	}
+	return samples
+}
+
+// serveHealthz reports healthy once every preset had a successful scrape within its last three scrape intervals
+func (e *exporter) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	problems := []string{}
+	now := time.Now()
+	for _, j := range e.jobs {
+		j.mu.Lock()
+		switch {
+		case j.lastSuccess.IsZero() && len(j.lastError) > 0:
+			problems = append(problems, fmt.Sprintf("preset %v: no successful scrape yet: %v", j.target.Name, j.lastError))
+		case j.lastSuccess.IsZero():
+			problems = append(problems, fmt.Sprintf("preset %v: no successful scrape yet", j.target.Name))
+		case now.Sub(j.lastSuccess) > 3*j.target.Interval:
+			problems = append(problems, fmt.Sprintf("preset %v: last successful scrape at %v: %v", j.target.Name, j.lastSuccess.Format(time.RFC3339), j.lastError))
+		}
+		j.mu.Unlock()
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(problems, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// serveJobs runs the scrape jobs and serves their metrics on the listener until the context is done
+func serveJobs(ctx context.Context, listener net.Listener, jobs []*scrapeJob) error {
+	e := &exporter{jobs: jobs}
+	server := &http.Server{Handler: e.handler(), ReadHeaderTimeout: 10 * time.Second}
+	var wg sync.WaitGroup
+	for _, j := range jobs {
+		wg.Add(1)
+		go func(j *scrapeJob) {
+			defer wg.Done()
+			j.run(ctx)
+		}(j)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+	var err error
+	select {
+	case <-ctx.Done():
+		shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err = server.Shutdown(shutdown)
+	case err = <-errs:
+	}
+	wg.Wait()
+	return err
+}
+
+// scrapeRegions returns the region clients of a served preset: the --regions, else the region of the preset
+// or of the AWS config. The counter counts the calls of the clients.
+func scrapeRegions(ctx context.Context, preset presets.PresetInterface, counter *apiCounter) ([]regionClient, error) {
+	regions := []string{}
+	if len(plugin.Regions) > 0 {
+		resolved, err := resolveRegions(ctx, preset, plugin.Regions)
+		if err != nil {
+			return nil, fmt.Errorf("could not list enabled regions: %v", err)
+		}
+		regions = resolved
+	} else if region := preset.GetRegion(); len(region) > 0 {
+		regions = append(regions, region)
+	} else {
+		regions = append(regions, plugin.AWSConfig.Region)
+	}
+	clients := []regionClient{}
+	for _, region := range regions {
+		cfg := plugin.AWSConfig.Copy()
+		cfg.Region = region
+		clients = append(clients, regionClient{Region: region, Client: plugin.CloudWatchClient(cfg, counter.apiOptions)})
+	}
+	return clients, nil
+}
+
+// serveExporter runs the serve subcommand, a Prometheus exporter of the presets, until interrupted
+func serveExporter() (int, error) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	jobs := []*scrapeJob{}
+	for _, target := range plugin.ScrapeTargets {
+		if err := preparePreset(target.Preset); err != nil {
+			return sensu.CheckStateCritical, fmt.Errorf("preset %v: %v", target.Name, err)
+		}
+		counter := newAPICounter()
+		regions, err := scrapeRegions(ctx, target.Preset, counter)
+		if err != nil {
+			return sensu.CheckStateCritical, err
+		}
+		jobs = append(jobs, newScrapeJob(target, regions, counter))
+	}
+	listener, err := net.Listen("tcp", plugin.ListenAddress)
+	if err != nil {
+		return sensu.CheckStateCritical, err
+	}
+	if plugin.AccountIDErr != nil {
+		fmt.Printf("Warning: could not get the account id, points are not tagged with it: %v\n", plugin.AccountIDErr)
+	}
+	fmt.Printf("Serving %v presets on %v/metrics\n", len(jobs), listener.Addr())
+	if err := serveJobs(ctx, listener, jobs); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return sensu.CheckStateCritical, err
+	}
+	return sensu.CheckStateOK, nil
+}
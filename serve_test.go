@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/smithy-go/encoding/cbor"
+	"github.com/sensu/sensu-cloudwatch-check/presets"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestScrapeJob(client mockService) *scrapeJob {
+	none := &presets.None{}
+	none.AddStats([]string{"Sum"})
+	_ = none.Ready()
+	return newScrapeJob(scrapeTarget{Name: "Test", Preset: none, Interval: time.Minute}, []regionClient{{Client: client}}, newAPICounter())
+}
+
+func TestScrapeTargets(t *testing.T) {
+	defer cleanPluginValues()
+	assert := assert.New(t)
+	cleanPluginValues()
+	none := &presets.None{}
+	plugin.PresetName = "None"
+	plugin.Preset = none
+
+	targets, err := scrapeTargets()
+	assert.NoError(err)
+	assert.Equal([]scrapeTarget{{Name: "None", Preset: none, Interval: time.Minute}}, targets)
+
+	plugin.ScrapePresets = []string{"ALB=300", " EC2 "}
+	targets, err = scrapeTargets()
+	assert.NoError(err)
+	if assert.Equal(2, len(targets)) {
+		assert.Equal("ALB", targets[0].Name)
+		assert.Equal(5*time.Minute, targets[0].Interval)
+		assert.Equal(presets.Presets["ALB"].GetDescription(), targets[0].Preset.GetDescription())
+		assert.Equal("EC2", targets[1].Name)
+		assert.Equal(time.Minute, targets[1].Interval)
+	}
+	// the served presets are copies, the registered presets are left alone
+	assert.NotSame(presets.Presets["ALB"], targets[0].Preset)
+
+	for entry, message := range map[string]string{
+		"Nope":    "--scrape-presets Nope: preset not defined, choose from: ",
+		"None":    "--scrape-presets None: preset not defined, choose from: ",
+		"EC2=0":   "--scrape-presets EC2=0: scrape interval must be a number of seconds",
+		"EC2=1m":  "--scrape-presets EC2=1m: scrape interval must be a number of seconds",
+		"EC2,EC2": "--scrape-presets EC2: preset is listed more than once",
+	} {
+		plugin.ScrapePresets = strings.Split(entry, ",")
+		_, err = scrapeTargets()
+		if assert.Error(err, entry) {
+			assert.True(strings.HasPrefix(err.Error(), message), err.Error())
+		}
+	}
+
+	plugin.ScrapeInterval = 0
+	_, err = scrapeTargets()
+	assert.EqualError(err, "--scrape-interval must be at least 1 second")
+}
+
+func TestScrapeJob(t *testing.T) {
+	defer quiet()()
+	defer cleanPluginValues()
+	assert := assert.New(t)
+	cleanPluginValues()
+	getMetricDataBatches = []int{}
+
+	job := newTestScrapeJob(mockService{statusCode: types.StatusCodeComplete})
+	job.scrape(context.TODO())
+	assert.Equal([]int{1}, getMetricDataBatches)
+	assert.Equal(1, job.scrapes)
+	assert.Equal(0, job.scrapeErrors)
+	assert.False(job.lastSuccess.IsZero())
+	if assert.Equal(1, len(job.families)) {
+		assert.Equal("aws_test_test_sum", job.families[0].name)
+	}
+
+	// a failed scrape keeps the metrics of the previous one
+	families := job.families
+	lastSuccess := job.lastSuccess
+	job.regions[0].Client = mockService{dataErr: fmt.Errorf("access denied")}
+	job.scrape(context.TODO())
+	assert.Equal(2, job.scrapes)
+	assert.Equal(1, job.scrapeErrors)
+	assert.Equal(families, job.families)
+	assert.Equal(lastSuccess, job.lastSuccess)
+	assert.Contains(job.lastError, "Could not get metrics")
+}
+
+func TestAPICounter(t *testing.T) {
+	assert := assert.New(t)
+	throttled := 2
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Smithy-Protocol", "rpc-v2-cbor")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/operation/ListMetrics"):
+			w.Header().Set("X-Amzn-Query-Error", "AccessDenied;Sender")
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write(cbor.Encode(cbor.Map{"__type": cbor.String("AccessDenied"), "message": cbor.String("access denied")}))
+		case throttled > 0:
+			throttled--
+			w.Header().Set("X-Amzn-Query-Error", "Throttling;Sender")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write(cbor.Encode(cbor.Map{"__type": cbor.String("Throttling"), "message": cbor.String("Rate exceeded")}))
+		default:
+			_, _ = w.Write(cbor.Encode(cbor.Map{}))
+		}
+	}))
+	defer server.Close()
+
+	counter := newAPICounter()
+	cfg := aws.Config{Region: "us-east-1", Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", "")}
+	client := cloudwatch.NewFromConfig(cfg, counter.apiOptions, func(o *cloudwatch.Options) {
+		o.BaseEndpoint = aws.String(server.URL)
+		o.Retryer = retry.NewStandard(func(o *retry.StandardOptions) {
+			o.Backoff = retry.BackoffDelayerFunc(func(int, error) (time.Duration, error) { return 0, nil })
+		})
+	})
+
+	// the throttled attempts are counted although the SDK retried them and the call succeeded
+	_, err := client.GetMetricData(context.TODO(), &cloudwatch.GetMetricDataInput{
+		StartTime:         aws.Time(time.Now().Add(-time.Hour)),
+		EndTime:           aws.Time(time.Now()),
+		MetricDataQueries: []types.MetricDataQuery{{Id: aws.String("q"), Expression: aws.String("1")}},
+	})
+	assert.NoError(err)
+	assert.Equal(map[string]int{"GetMetricData": 1}, counter.calls)
+	assert.Empty(counter.errors)
+	assert.Equal(map[string]int{"GetMetricData": 2}, counter.throttles)
+
+	_, err = client.ListMetrics(context.TODO(), &cloudwatch.ListMetricsInput{})
+	assert.Error(err)
+	assert.Equal(map[string]int{"GetMetricData": 1, "ListMetrics": 1}, counter.calls)
+	assert.Equal(map[string]int{"ListMetrics": 1}, counter.errors)
+	assert.Equal(map[string]int{"GetMetricData": 2}, counter.throttles)
+}
+
+func TestLatestFamilies(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	series := func(label string, value string, region string) MetricQueryMap {
+		return MetricQueryMap{
+			Label:      label,
+			Namespace:  "AWS/ELB",
+			MetricName: "Latency",
+			Region:     region,
+			Dimensions: []types.Dimension{{Name: aws.String("LoadBalancerName"), Value: aws.String(value)}},
+			MetricDataResult: types.MetricDataResult{
+				Timestamps: []time.Time{now.Add(-2 * time.Minute), now, now.Add(-time.Minute)},
+				Values:     []float64{1, 3, 2},
+			},
+		}
+	}
+	empty := series("aws_elb_latency_p99", "c", "")
+	empty.MetricDataResult = types.MetricDataResult{}
+	queries := []MetricQueryMap{series("aws_elb_latency_p99", "a", ""), series("aws_elb_latency_average", "a\"b", "eu-west-1"), series("aws_elb_latency_p99", "b", ""), empty}
+
+	// a single sample per series, its latest datapoint, and families sorted by name
+	assert.Equal([]promFamily{
+		{name: "aws_elb_latency_average", help: "Namespace:AWS/ELB MetricName:Latency", samples: []promSeries{
+			{labels: `LoadBalancerName="a\"b",aws_region="eu-west-1"`, value: 3, timestamp: now.UnixMilli()},
+		}},
+		{name: "aws_elb_latency_p99", help: "Namespace:AWS/ELB MetricName:Latency", samples: []promSeries{
+			{labels: `LoadBalancerName="a"`, value: 3, timestamp: now.UnixMilli()},
+			{labels: `LoadBalancerName="b"`, value: 3, timestamp: now.UnixMilli()},
+		}},
+	}, latestFamilies(queries))
+
+	// the families of every preset are merged under a single HELP and TYPE header
+	e := &exporter{jobs: []*scrapeJob{
+		{families: latestFamilies(queries[:2])},
+		{families: latestFamilies(queries[1:3])},
+	}}
+	var b strings.Builder
+	assert.NoError(e.writeMetrics(&b))
+	ts := fmt.Sprint(now.UnixMilli())
+	assert.Equal("# HELP aws_elb_latency_average Namespace:AWS/ELB MetricName:Latency\n"+
+		"# TYPE aws_elb_latency_average gauge\n"+
+		`aws_elb_latency_average{LoadBalancerName="a\"b",aws_region="eu-west-1"} 3 `+ts+"\n"+
+		"# HELP aws_elb_latency_p99 Namespace:AWS/ELB MetricName:Latency\n"+
+		"# TYPE aws_elb_latency_p99 gauge\n"+
+		`aws_elb_latency_p99{LoadBalancerName="a"} 3 `+ts+"\n"+
+		`aws_elb_latency_p99{LoadBalancerName="b"} 3 `+ts+"\n", b.String())
+}
+
+func TestExporter(t *testing.T) {
+	defer quiet()()
+	defer cleanPluginValues()
+	assert := assert.New(t)
+	cleanPluginValues()
+
+	job := newTestScrapeJob(mockService{statusCode: types.StatusCodeComplete})
+	server := httptest.NewServer((&exporter{jobs: []*scrapeJob{job}}).handler())
+	defer server.Close()
+	get := func(path string) (int, string) {
+		resp, err := http.Get(server.URL + path)
+		if !assert.NoError(err) {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(err)
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := get("/healthz")
+	assert.Equal(http.StatusServiceUnavailable, status)
+	assert.Equal("preset Test: no successful scrape yet\n", body)
+	status, body = get("/metrics")
+	assert.Equal(http.StatusOK, status)
+	assert.Contains(body, "# TYPE cloudwatch_check_api_calls_total counter\n")
+	assert.Contains(body, "cloudwatch_check_api_calls_total{preset=\"Test\",api=\"GetMetricData\"} 0\n")
+	assert.Contains(body, "cloudwatch_check_last_success_timestamp_seconds{preset=\"Test\"} 0\n")
+	assert.NotContains(body, "test_sum")
+
+	job.scrape(context.TODO())
+	job.counter.recordCall("GetMetricData", nil)
+	job.counter.recordCall("ListMetrics", nil)
+	job.counter.recordThrottle("GetMetricData")
+	status, body = get("/healthz")
+	assert.Equal(http.StatusOK, status)
+	assert.Equal("ok\n", body)
+	status, body = get("/metrics")
+	assert.Equal(http.StatusOK, status)
+	assert.Contains(body, "test_sum{")
+	assert.Contains(body, "cloudwatch_check_api_calls_total{preset=\"Test\",api=\"GetMetricData\"} 1\n")
+	assert.Contains(body, "cloudwatch_check_api_calls_total{preset=\"Test\",api=\"ListMetrics\"} 1\n")
+	assert.Contains(body, "cloudwatch_check_api_throttles_total{preset=\"Test\",api=\"GetMetricData\"} 1\n")
+	assert.Contains(body, "cloudwatch_check_api_throttles_total{preset=\"Test\",api=\"ListMetrics\"} 0\n")
+	assert.Contains(body, "cloudwatch_check_scrapes_total{preset=\"Test\"} 1\n")
+	assert.Contains(body, "cloudwatch_check_scrape_errors_total{preset=\"Test\"} 0\n")
+	assert.Contains(body, fmt.Sprintf("cloudwatch_check_last_success_timestamp_seconds{preset=\"Test\"} %v", job.lastSuccess.Unix()))
+
+	// unhealthy once the latest successful scrape is older than three scrape intervals
+	job.lastSuccess = time.Now().Add(-4 * time.Minute)
+	job.lastError = "Could not get metrics"
+	status, body = get("/healthz")
+	assert.Equal(http.StatusServiceUnavailable, status)
+	assert.Contains(body, "preset Test: last successful scrape at ")
+	assert.Contains(body, ": Could not get metrics\n")
+
+	assert.Equal(`preset="a\"b\\c"`, presetLabel(&scrapeJob{target: scrapeTarget{Name: `a"b\c`}}))
+}
+
+func TestServeJobs(t *testing.T) {
+	defer quiet()()
+	defer cleanPluginValues()
+	assert := assert.New(t)
+	cleanPluginValues()
+
+	job := newTestScrapeJob(mockService{statusCode: types.StatusCodeComplete})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serveJobs(ctx, listener, []*scrapeJob{job})
+	}()
+
+	// the first scrape runs as soon as the job starts
+	assert.Eventually(func() bool {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/healthz")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("serveJobs did not return after the context was cancelled")
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// stateVersion is the version of the state file format, state files of another version are started over
+const stateVersion = 1
+
+// fetchState records the timestamp of the latest datapoint output for every series, so a run fetches the
+// datapoints since the previous run and only outputs the new ones. Regions share the state, which is saved
+// once the results of every region were reported.
+type fetchState struct {
+	mu   sync.Mutex
+	path string
+	// lock is the lock file held for the whole run, so overlapping runs do not output the same datapoints
+	lock *os.File
+	// loadErr is why the state file could not be read, reported along with the results
+	loadErr error
+
+	Version int `json:"version"`
+	// Series maps the key of a query to the latest timestamp of each of its series by label, queries have a
+	// single series except Metrics Insights queries, which have one per GROUP BY value
+	Series map[string]map[string]time.Time `json:"series"`
+}
+
+// errStateLocked is returned by loadState when another run holds the lock of the state file
+var errStateLocked = errors.New("locked by another run")
+
+// loadState locks the state file and reads it, starting with an empty state when it does not exist or can not
+// be read. The lock is taken on a .lock file next to the state file, as saving renames a new file over the
+// state file, and fails right away when another run holds it.
+func loadState(path string) (*fetchState, error) {
+	lock, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	state := &fetchState{path: path, lock: lock, Version: stateVersion, Series: make(map[string]map[string]time.Time)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		state.loadErr = err
+		return state, nil
+	}
+	loaded := fetchState{}
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		state.loadErr = err
+		return state, nil
+	}
+	if loaded.Version != stateVersion {
+		state.loadErr = fmt.Errorf("unsupported state file version %v", loaded.Version)
+		return state, nil
+	}
+	for key, series := range loaded.Series {
+		if series != nil {
+			state.Series[key] = series
+		}
+	}
+	return state, nil
+}
+
+// unlock releases the lock of the state file, the lock file itself is left in place for the next run
+func (s *fetchState) unlock() {
+	if s.lock != nil {
+		s.lock.Close()
+		s.lock = nil
+	}
+}
+
+// stateKey identifies a query across runs by what it measures rather than by its id, which changes along with
+// the discovered metrics, Ex:
+//
+//	us-east-1 123456789012 AWS/EC2 CPUUtilization Average 60 InstanceId="i-0123"
+func stateKey(q MetricQueryMap) string {
+	measured := q.MetricName
+	if len(q.Expression) > 0 {
+		measured = q.Expression
+	}
+	fields := []string{q.awsRegion(), q.AccountId, q.Namespace, measured, q.Stat, fmt.Sprint(q.Period)}
+	// Metrics Insights series are told apart by their label, their dimensions are only known from the results
+	if q.Insights == nil {
+		dims := []string{}
+		for _, d := range q.Dimensions {
+			dims = append(dims, fmt.Sprintf(`%v="%v"`, aws.ToString(d.Name), aws.ToString(d.Value)))
+		}
+		sort.Strings(dims)
+		fields = append(fields, strings.Join(dims, ","))
+	}
+	return strings.Join(fields, " ")
+}
+
+// extendWindow moves the start time of the input back to the oldest latest datapoint of the queries, so series
+// lagging behind are fetched from their last datapoint, at most maxLookback before the end time
+func (s *fetchState) extendWindow(input *cloudwatch.GetMetricDataInput, queries map[string]MetricQueryMap, maxLookback time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start := aws.ToTime(input.StartTime)
+	earliest := aws.ToTime(input.EndTime).Add(-maxLookback)
+	for _, d := range input.MetricDataQueries {
+		q, ok := queries[aws.ToString(d.Id)]
+		if !ok {
+			continue
+		}
+		for _, latest := range s.Series[stateKey(q)] {
+			if latest.Before(earliest) {
+				latest = earliest
+			}
+			if latest.Before(start) {
+				start = latest
+			}
+		}
+	}
+	input.StartTime = aws.Time(time.Unix(start.Unix(), 0))
+}
+
+// newDatapoints returns the result of the query without the datapoints output by previous runs, recording the
+// latest datapoint of the series
+func (s *fetchState) newDatapoints(q MetricQueryMap) types.MetricDataResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := q.MetricDataResult
+	key := stateKey(q)
+	label := aws.ToString(result.Label)
+	last, seen := s.Series[key][label]
+	latest := last
+	result.Timestamps, result.Values = nil, nil
+	for i, t := range q.MetricDataResult.Timestamps {
+		if i >= len(q.MetricDataResult.Values) {
+			break
+		}
+		if seen && !t.After(last) {
+			continue
+		}
+		result.Timestamps = append(result.Timestamps, t)
+		result.Values = append(result.Values, q.MetricDataResult.Values[i])
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	if len(result.Timestamps) > 0 {
+		if s.Series[key] == nil {
+			s.Series[key] = make(map[string]time.Time)
+		}
+		s.Series[key][label] = latest
+	}
+	return result
+}
+
+// stage writes the state to a temporary file next to the state file, leaving out the series without a datapoint
+// within maxLookback. The temporary file is renamed over the state file by commit once the results were reported,
+// so datapoints that failed to be reported are output again by the next run, and an interrupted run never leaves
+// a partial state file.
+func (s *fetchState) stage(now time.Time, maxLookback time.Duration) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, series := range s.Series {
+		for label, latest := range series {
+			if latest.Before(now.Add(-maxLookback)) {
+				delete(series, label)
+			}
+		}
+		if len(series) == 0 {
+			delete(s.Series, key)
+		}
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), "."+filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// commit renames the staged temporary file over the state file
+func (s *fetchState) commit(staged string) error {
+	if err := os.Rename(staged, s.path); err != nil {
+		os.Remove(staged)
+		return err
+	}
+	return nil
+}
+
+// stageState stages the state once every region was collected, reporting state file problems as warnings of the
+// first region result. It returns the staged file to commit once the results were reported, or an empty string
+// when the state could not be staged.
+func stageState(state *fetchState, results []*regionResult) string {
+	if len(results) == 0 {
+		return ""
+	}
+	var problems []string
+	if state.loadErr != nil {
+		problems = append(problems, fmt.Sprintf("Warning: could not read state file %v, starting over: %v", state.path, state.loadErr))
+	}
+	staged, err := state.stage(time.Now(), time.Duration(plugin.MaxLookbackMinutes)*time.Minute)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("Warning: could not save state file: %v", err))
+	}
+	if len(problems) > 0 {
+		results[0].Problems = append(results[0].Problems, problems...)
+		if results[0].State < sensu.CheckStateWarning {
+			results[0].State = sensu.CheckStateWarning
+		}
+	}
+	return staged
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/sensu/sensu-cloudwatch-check/presets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadState(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	state, err := loadState(filepath.Join(dir, "missing.json"))
+	assert.NoError(err)
+	assert.NoError(state.loadErr)
+	assert.Empty(state.Series)
+	state.unlock()
+
+	path := filepath.Join(dir, "state.json")
+	assert.NoError(os.WriteFile(path, []byte(`{"version": 1, "series": {"us-east-1  AWS/EC2 CPUUtilization Average 60 ": {"cpu": "2024-05-01T10:00:00Z"}}}`), 0600))
+	state, err = loadState(path)
+	assert.NoError(err)
+	assert.NoError(state.loadErr)
+	assert.Equal(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC), state.Series["us-east-1  AWS/EC2 CPUUtilization Average 60 "]["cpu"])
+
+	// overlapping runs fail right away rather than output the same datapoints
+	_, err = loadState(path)
+	assert.Equal(errStateLocked, err)
+	state.unlock()
+
+	assert.NoError(os.WriteFile(path, []byte(`{"version": 1, "series": {`), 0600))
+	state, err = loadState(path)
+	assert.NoError(err)
+	assert.EqualError(state.loadErr, "unexpected end of JSON input")
+	assert.Empty(state.Series)
+	state.unlock()
+
+	assert.NoError(os.WriteFile(path, []byte(`{"version": 2, "series": {}}`), 0600))
+	state, err = loadState(path)
+	assert.NoError(err)
+	assert.EqualError(state.loadErr, "unsupported state file version 2")
+	state.unlock()
+
+	_, err = loadState(filepath.Join(dir, "missing", "state.json"))
+	assert.Error(err)
+}
+
+func TestStateKey(t *testing.T) {
+	defer cleanPluginValues()
+	assert := assert.New(t)
+	cleanPluginValues()
+	plugin.AWSConfig.Region = "us-east-1"
+	q := MetricQueryMap{
+		Namespace:  "AWS/ELB",
+		MetricName: "Latency",
+		Stat:       "p99",
+		Period:     60,
+		Dimensions: []types.Dimension{
+			{Name: aws.String("LoadBalancerName"), Value: aws.String("lb")},
+			{Name: aws.String("AvailabilityZone"), Value: aws.String("us-east-1a")},
+		},
+	}
+	assert.Equal(`us-east-1  AWS/ELB Latency p99 60 AvailabilityZone="us-east-1a",LoadBalancerName="lb"`, stateKey(q))
+	// the order of the dimensions does not matter
+	q.Dimensions[0], q.Dimensions[1] = q.Dimensions[1], q.Dimensions[0]
+	assert.Equal(`us-east-1  AWS/ELB Latency p99 60 AvailabilityZone="us-east-1a",LoadBalancerName="lb"`, stateKey(q))
+
+	q.Region = "eu-west-1"
+	q.AccountId = "123456789012"
+	assert.Equal(`eu-west-1 123456789012 AWS/ELB Latency p99 60 AvailabilityZone="us-east-1a",LoadBalancerName="lb"`, stateKey(q))
+
+	insights := MetricQueryMap{Namespace: "AWS/EC2", Expression: "SELECT AVG(CPUUtilization) FROM SCHEMA(\"AWS/EC2\", InstanceId) GROUP BY InstanceId", Period: 300, Insights: &presets.InsightsQuery{}}
+	insights.Dimensions = []types.Dimension{{Name: aws.String("InstanceId"), Value: aws.String("i-aaa")}}
+	assert.Equal(`us-east-1  AWS/EC2 SELECT AVG(CPUUtilization) FROM SCHEMA("AWS/EC2", InstanceId) GROUP BY InstanceId  300`, stateKey(insights))
+}
+
+func TestExtendWindow(t *testing.T) {
+	assert := assert.New(t)
+	end := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	queries := map[string]MetricQueryMap{
+		"a": {Namespace: "AWS/test", MetricName: "a", Region: "us-east-1"},
+		"b": {Namespace: "AWS/test", MetricName: "b", Region: "us-east-1"},
+	}
+	newInput := func() *cloudwatch.GetMetricDataInput {
+		return &cloudwatch.GetMetricDataInput{
+			StartTime:         aws.Time(end.Add(-5 * time.Minute)),
+			EndTime:           aws.Time(end),
+			MetricDataQueries: []types.MetricDataQuery{{Id: aws.String("a")}, {Id: aws.String("b")}},
+		}
+	}
+	state := &fetchState{Series: map[string]map[string]time.Time{}}
+
+	// series without state are fetched over the period
+	input := newInput()
+	state.extendWindow(input, queries, time.Hour)
+	assert.Equal(end.Add(-5*time.Minute).Unix(), input.StartTime.Unix())
+
+	// series seen within the period do not shorten it
+	state.Series[stateKey(queries["a"])] = map[string]time.Time{"a": end.Add(-time.Minute)}
+	input = newInput()
+	state.extendWindow(input, queries, time.Hour)
+	assert.Equal(end.Add(-5*time.Minute).Unix(), input.StartTime.Unix())
+
+	// lagging series are fetched from their latest datapoint
+	state.Series[stateKey(queries["b"])] = map[string]time.Time{"b": end.Add(-20 * time.Minute)}
+	input = newInput()
+	state.extendWindow(input, queries, time.Hour)
+	assert.Equal(end.Add(-20*time.Minute).Unix(), input.StartTime.Unix())
+
+	// at most the max lookback
+	input = newInput()
+	state.extendWindow(input, queries, 10*time.Minute)
+	assert.Equal(end.Add(-10*time.Minute).Unix(), input.StartTime.Unix())
+}
+
+func TestNewDatapoints(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	q := MetricQueryMap{Namespace: "AWS/test", MetricName: "test", Region: "us-east-1"}
+	q.MetricDataResult = types.MetricDataResult{
+		Label:      aws.String("test"),
+		Timestamps: []time.Time{now, now.Add(-time.Minute), now.Add(-2 * time.Minute)},
+		Values:     []float64{3, 2, 1},
+	}
+	state := &fetchState{Series: map[string]map[string]time.Time{}}
+	result := state.newDatapoints(q)
+	assert.Equal([]float64{3, 2, 1}, result.Values)
+	assert.Equal(now, state.Series[stateKey(q)]["test"])
+
+	q.MetricDataResult.Timestamps = []time.Time{now.Add(2 * time.Minute), now.Add(time.Minute), now, now.Add(-time.Minute)}
+	q.MetricDataResult.Values = []float64{5, 4, 3, 2}
+	result = state.newDatapoints(q)
+	assert.Equal([]time.Time{now.Add(2 * time.Minute), now.Add(time.Minute)}, result.Timestamps)
+	assert.Equal([]float64{5, 4}, result.Values)
+	assert.Equal(aws.String("test"), result.Label)
+	assert.Equal(now.Add(2*time.Minute), state.Series[stateKey(q)]["test"])
+	// the query result is left alone
+	assert.Equal(4, len(q.MetricDataResult.Timestamps))
+
+	result = state.newDatapoints(q)
+	assert.Empty(result.Timestamps)
+	assert.Equal(now.Add(2*time.Minute), state.Series[stateKey(q)]["test"])
+}
+
+func TestStageState(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	state, err := loadState(path)
+	assert.NoError(err)
+	defer state.unlock()
+	state.Series["recent"] = map[string]time.Time{"a": now.Add(-time.Minute), "b": now.Add(-2 * time.Hour)}
+	state.Series["stale"] = map[string]time.Time{"a": now.Add(-2 * time.Hour)}
+	staged, err := state.stage(now, time.Hour)
+	assert.NoError(err)
+	// the state file is left alone until the staged file is committed
+	_, err = os.Stat(path)
+	assert.True(os.IsNotExist(err))
+	assert.NoError(state.commit(staged))
+
+	state.unlock()
+	loaded, err := loadState(path)
+	assert.NoError(err)
+	defer loaded.unlock()
+	assert.NoError(loaded.loadErr)
+	assert.Equal(map[string]map[string]time.Time{"recent": {"a": now.Add(-time.Minute)}}, loaded.Series)
+	// the staged file is renamed over the state file, next to the lock file
+	entries, err := os.ReadDir(dir)
+	assert.NoError(err)
+	assert.Equal(2, len(entries))
+
+	state.path = filepath.Join(dir, "missing", "state.json")
+	_, err = state.stage(now, time.Hour)
+	assert.Error(err)
+}
+
+func TestCollectRegionsState(t *testing.T) {
+	defer quiet()()
+	defer cleanPluginValues()
+	assert := assert.New(t)
+	cleanPluginValues()
+	none := &presets.None{}
+	none.AddStats([]string{"Sum"})
+	assert.NoError(none.Ready())
+	plugin.PeriodMinutes = 3
+	plugin.StateFile = filepath.Join(t.TempDir(), "state.json")
+	load := func() {
+		if plugin.State != nil {
+			plugin.State.unlock()
+		}
+		state, err := loadState(plugin.StateFile)
+		assert.NoError(err)
+		plugin.State = state
+	}
+	load()
+	regions := []regionClient{{Client: mockService{dataPages: 3, statusCode: types.StatusCodeComplete}}}
+
+	// the first run outputs every datapoint of the period
+	results := collectRegions(context.TODO(), regions, none)
+	assert.Equal(0, results[0].State)
+	if assert.Equal(1, len(results[0].Queries)) {
+		assert.Equal([]float64{0, 1, 2}, results[0].Queries[0].MetricDataResult.Values)
+	}
+	staged := stageState(plugin.State, results)
+	assert.Empty(results[0].Problems)
+	assert.NoError(plugin.State.commit(staged))
+
+	// the next run only outputs the datapoints after the latest one of the state file
+	load()
+	results = collectRegions(context.TODO(), regions, none)
+	if assert.Equal(1, len(results[0].Queries)) {
+		assert.Equal([]float64{0}, results[0].Queries[0].MetricDataResult.Values)
+	}
+	// queries without new datapoints are not reported as missing
+	assert.Empty(results[0].Unused)
+
+	// series without new datapoints are left out of the output, their thresholds are still evaluated
+	for _, series := range plugin.State.Series {
+		for label := range series {
+			series[label] = time.Now().Add(time.Hour)
+		}
+	}
+	results = collectRegions(context.TODO(), regions, none)
+	assert.Empty(results[0].Queries)
+	if assert.Equal(1, len(results[0].Evaluated)) {
+		assert.Equal([]float64{0, 1, 2}, results[0].Evaluated[0].MetricDataResult.Values)
+	}
+
+	assert.NoError(os.WriteFile(plugin.StateFile, []byte("{"), 0600))
+	load()
+	results = collectRegions(context.TODO(), regions, none)
+	staged = stageState(plugin.State, results)
+	assert.NotEmpty(staged)
+	os.Remove(staged)
+	assert.Equal(1, results[0].State)
+	if assert.Equal(1, len(results[0].Problems)) {
+		assert.True(strings.HasPrefix(results[0].Problems[0], "Warning: could not read state file "+plugin.StateFile+", starting over: "))
+	}
+}
+
+func TestCheckRegionsState(t *testing.T) {
+	defer quiet()()
+	defer cleanPluginValues()
+	assert := assert.New(t)
+	cleanPluginValues()
+	status := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	none := &presets.None{}
+	none.AddStats([]string{"Sum"})
+	plugin.Preset = none
+	plugin.OutputFormat = eventOutputFormat
+	plugin.AgentAPIURL = server.URL + "/events"
+	plugin.EventCheckName = "aws-metrics"
+	dir := t.TempDir()
+	plugin.StateFile = filepath.Join(dir, "state.json")
+	regions := []regionClient{{Client: mockService{dataPages: 3, statusCode: types.StatusCodeComplete}}}
+
+	// datapoints that failed to be reported are output again by the next run
+	state, err := loadState(plugin.StateFile)
+	assert.NoError(err)
+	plugin.State = state
+	_, err = checkRegions(regions)
+	assert.Error(err)
+	_, err = os.Stat(plugin.StateFile)
+	assert.True(os.IsNotExist(err))
+	entries, err := os.ReadDir(dir)
+	assert.NoError(err)
+	assert.Equal(1, len(entries))
+
+	status = http.StatusCreated
+	state, err = loadState(plugin.StateFile)
+	assert.NoError(err)
+	plugin.State = state
+	_, err = checkRegions(regions)
+	assert.NoError(err)
+	loaded, err := loadState(plugin.StateFile)
+	assert.NoError(err)
+	defer loaded.unlock()
+	assert.NoError(loaded.loadErr)
+	assert.Equal(1, len(loaded.Series))
+}
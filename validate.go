@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sensu/sensu-cloudwatch-check/presets"
+)
+
+// validateCommand checks measurement config files, or stdin for a - argument, against the measurement config schema
+// and rules, printing a line per problem prefixed with the file, line and column. It returns the exit status: 0 when
+// every file is valid, 1 when problems were found and 2 for usage errors.
+func validateCommand(stdin io.Reader, w io.Writer, args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	flags.SetOutput(w)
+	printSchema := flags.Bool("schema", false, "Print the JSON Schema of measurement configs")
+	flags.Usage = func() {
+		fmt.Fprintln(w, "Usage: sensu-cloudwatch-check validate [--schema] FILE...")
+		fmt.Fprintln(w, "Checks JSON or YAML (.yaml or .yml) measurement config files, - reads a JSON config from stdin")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if *printSchema {
+		if _, err := w.Write(presets.Schema); err != nil {
+			return 1
+		}
+		return 0
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	status := 0
+	for _, file := range flags.Args() {
+		var data []byte
+		var err error
+		if file == "-" {
+			file = "stdin"
+			data, err = io.ReadAll(stdin)
+		} else {
+			data, err = os.ReadFile(file)
+		}
+		if err == nil {
+			err = presets.ValidateMeasurementConfig(file, data)
+		}
+		if err != nil {
+			fmt.Fprintln(w, err)
+			status = 1
+			continue
+		}
+		fmt.Fprintf(w, "%v: valid\n", file)
+	}
+	return status
+}
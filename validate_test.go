@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sensu/sensu-cloudwatch-check/presets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateCommand(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "rds.yaml")
+	invalid := filepath.Join(dir, "ec2.json")
+	assert.NoError(os.WriteFile(valid, []byte("namespace: AWS/RDS\nmeasurements:\n  - metric: CPUUtilization\n    config:\n      - stat: Average\n        measurement: aws.rds.cpu_utilization.average\n"), 0644))
+	assert.NoError(os.WriteFile(invalid, []byte("{\n  \"namespace\": \"AWS/EC2\",\n  \"dimension-filter\": [\"InstanceId\"]\n}\n"), 0644))
+
+	var buf bytes.Buffer
+	assert.Equal(0, validateCommand(strings.NewReader(""), &buf, []string{valid}))
+	assert.Equal(valid+": valid\n", buf.String())
+
+	buf.Reset()
+	assert.Equal(1, validateCommand(strings.NewReader(""), &buf, []string{valid, invalid, filepath.Join(dir, "missing.json")}))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(3, len(lines))
+	assert.Equal(invalid+`:3:3: dimension-filter: unknown key "dimension-filter"`, lines[1])
+	assert.Contains(lines[2], "missing.json")
+
+	buf.Reset()
+	assert.Equal(1, validateCommand(strings.NewReader(`{"namespace": 1}`), &buf, []string{"-"}))
+	assert.Equal("stdin:1:15: namespace: must be a string, not integer\n", buf.String())
+
+	buf.Reset()
+	assert.Equal(0, validateCommand(strings.NewReader(""), &buf, []string{"--schema"}))
+	assert.Equal(string(presets.Schema), buf.String())
+
+	buf.Reset()
+	assert.Equal(2, validateCommand(strings.NewReader(""), &buf, []string{}))
+	assert.Contains(buf.String(), "Usage: sensu-cloudwatch-check validate")
+	assert.Equal(2, validateCommand(strings.NewReader(""), &buf, []string{"--unknown"}))
+}